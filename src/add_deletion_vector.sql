@@ -0,0 +1,15 @@
+-- re-adds file $1 with deletion vector $2 marking rows deleted from it, after its remove
+-- in the same commit like other writers do. Its newest add, maybe staged, is the one being replaced.
+INSERT INTO log_json ("add")
+SELECT struct_pack(
+    path := "add".path,
+    partitionValues := "add".partitionValues,
+    size := "add".size,
+    modificationTime := "add".modificationTime,
+    dataChange := true,
+    stats := "add".stats,
+    deletionVector := $2::JSON
+)
+FROM log_json
+WHERE "add".path = $1
+QUALIFY row_number() OVER (ORDER BY version DESC NULLS FIRST, rowid DESC) = 1;
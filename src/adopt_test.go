@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// externalTableSchema is the schemaString of a table written like python's write_deltalake does
+const externalTableSchema = `{"type":"struct","fields":[` +
+	`{"name":"id","type":"long","nullable":true,"metadata":{}},` +
+	`{"name":"message","type":"string","nullable":true,"metadata":{}},` +
+	`{"name":"last_modified","type":"timestamp_ntz","nullable":true,"metadata":{}},` +
+	`{"name":"user","type":"string","nullable":true,"metadata":{}}]}`
+
+// externalTableWriter writes a delta table partitioned by user the way other engines do:
+// partition columns only in partitionValues, actions and fields duckpond doesn't write
+type externalTableWriter struct {
+	t   *testing.T
+	db  *sql.DB
+	dir string
+}
+
+// dataFile writes rows with ids to a parquet file in the user's partition and returns its add action
+func (w *externalTableWriter) dataFile(name string, user *string, ids ...int) string {
+	partition := "user=" + hiveDefaultPartition
+	partitionValue := "null"
+	if user != nil {
+		partition, partitionValue = "user="+*user, fmt.Sprintf("%q", *user)
+	}
+	path := partition + "/" + name + ".c000.snappy.parquet"
+	require.NoError(w.t, os.MkdirAll(filepath.Join(w.dir, partition), 0755))
+	values := make([]string, len(ids))
+	for i, id := range ids {
+		values[i] = fmt.Sprintf("(%d, 'Hello, World!', TIMESTAMP '2024-01-01' + INTERVAL (%d) DAY)", id, id)
+	}
+	_, err := w.db.Exec(fmt.Sprintf("COPY (SELECT * FROM (VALUES %s) t(id, message, last_modified)) TO '%s' (FORMAT PARQUET)",
+		strings.Join(values, ", "), filepath.Join(w.dir, path)))
+	require.NoError(w.t, err)
+	info, err := os.Stat(filepath.Join(w.dir, path))
+	require.NoError(w.t, err)
+	stats := fmt.Sprintf(`{\"numRecords\":%d,\"minValues\":{\"id\":%d},\"maxValues\":{\"id\":%d},\"nullCount\":{\"id\":0}}`,
+		len(ids), ids[0], ids[len(ids)-1])
+	return fmt.Sprintf(`{"add":{"path":"%s","partitionValues":{"user":%s},"size":%d,"modificationTime":1700000000000,`+
+		`"dataChange":true,"stats":"%s","tags":null,"deletionVector":null,"baseRowId":null,"defaultRowCommitVersion":null,"clusteringProvider":null}}`,
+		path, partitionValue, info.Size(), stats)
+}
+
+// commit writes actions as commit version
+func (w *externalTableWriter) commit(version int64, actions ...string) {
+	commitInfo := fmt.Sprintf(`{"commitInfo":{"timestamp":%d,"operation":"WRITE","operationParameters":{"mode":"Append"},"clientVersion":"delta-rs.0.22.0"}}`,
+		1700000000000+version)
+	data := strings.Join(append([]string{commitInfo}, actions...), "\n") + "\n"
+	require.NoError(w.t, os.WriteFile(filepath.Join(w.dir, "_delta_log", fmt.Sprintf("%020d.json", version)), []byte(data), 0644))
+}
+
+// newExternalTable writes a table another engine made with 4 commits and a checkpoint of version 2
+// in two parts. Rows with ids 1, 3, 4, 5 and 7 are live, id 2 was deleted.
+func newExternalTable(t *testing.T, storageDir, table string) {
+	dir := filepath.Join(storageDir, table)
+	require.NoError(t, os.RemoveAll(dir))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "_delta_log"), 0755))
+	db, err := InitializeDuckDB()
+	require.NoError(t, err)
+	defer db.Close()
+	w := &externalTableWriter{t: t, db: db, dir: dir}
+	even, odd := "even_user", "odd_user"
+
+	protocol := `{"protocol":{"minReaderVersion":1,"minWriterVersion":2}}`
+	metaData := fmt.Sprintf(`{"metaData":{"id":"7c3a8d6e-2f4b-4e1a-9d0c-5b6a7e8f9a0b","name":null,"description":null,`+
+		`"format":{"provider":"parquet","options":{}},"schemaString":%q,"partitionColumns":["user"],`+
+		`"createdTime":1700000000000,"configuration":{}}}`, externalTableSchema)
+	evenFile := w.dataFile("part-00000-even", &even, 2, 4)
+	oddFile := w.dataFile("part-00000-odd", &odd, 1, 3)
+	w.commit(0, protocol, metaData, evenFile, oddFile)
+	nullFile := w.dataFile("part-00001-null", nil, 5)
+	w.commit(1, `{"txn":{"appId":"ingest","version":1,"lastUpdated":1700000000001}}`, nullFile)
+	rewritten := w.dataFile("part-00002-even", &even, 4)
+	remove := `{"remove":{"path":"user=even_user/part-00000-even.c000.snappy.parquet","deletionTimestamp":1700000000002,` +
+		`"dataChange":true,"extendedFileMetadata":true,"partitionValues":{"user":"even_user"},"size":1,"tags":null}}`
+	w.commit(2, remove, rewritten)
+
+	// checkpoint of version 2 like spark writes them, protocol and metaData in one part and files in the other
+	_, err = db.Exec(fmt.Sprintf(`
+		COPY (
+			SELECT
+				{'minReaderVersion': 1, 'minWriterVersion': 2} AS protocol,
+				{'id': '7c3a8d6e-2f4b-4e1a-9d0c-5b6a7e8f9a0b', 'name': NULL::VARCHAR, 'description': NULL::VARCHAR,
+				 'format': {'provider': 'parquet', 'options': MAP {}::MAP(VARCHAR, VARCHAR)},
+				 'schemaString': %s, 'partitionColumns': ['user'], 'createdTime': 1700000000000::BIGINT,
+				 'configuration': MAP {}::MAP(VARCHAR, VARCHAR)} AS metaData
+		) TO '%s' (FORMAT PARQUET)`, quoteSQLString(externalTableSchema),
+		filepath.Join(dir, "_delta_log", "00000000000000000002.checkpoint.0000000001.0000000002.parquet")))
+	require.NoError(t, err)
+	var adds []string
+	for _, add := range []string{oddFile, nullFile, rewritten} {
+		adds = append(adds, quoteSQLString(add))
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+		COPY (
+			SELECT
+				{'appId': 'ingest', 'version': 1::BIGINT, 'lastUpdated': 1700000000001::BIGINT} AS txn,
+				NULL::STRUCT(path VARCHAR, partitionValues MAP(VARCHAR, VARCHAR), size BIGINT, modificationTime BIGINT,
+					dataChange BOOLEAN, stats VARCHAR, tags MAP(VARCHAR, VARCHAR)) AS "add"
+			UNION ALL
+			SELECT NULL, json_transform(a::JSON->'add', '{"path": "VARCHAR", "partitionValues": "MAP(VARCHAR, VARCHAR)",
+				"size": "BIGINT", "modificationTime": "BIGINT", "dataChange": "BOOLEAN", "stats": "VARCHAR",
+				"tags": "MAP(VARCHAR, VARCHAR)"}')
+			FROM unnest([%s]) AS t(a)
+		) TO '%s' (FORMAT PARQUET)`, strings.Join(adds, ", "),
+		filepath.Join(dir, "_delta_log", "00000000000000000002.checkpoint.0000000002.0000000002.parquet")))
+	require.NoError(t, err)
+	lastCheckpoint, err := json.Marshal(map[string]any{"version": 2, "size": 6, "parts": 2, "sizeInBytes": 1234, "numOfAddFiles": 3})
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "_delta_log", "_last_checkpoint"), lastCheckpoint, 0644))
+
+	w.commit(3, w.dataFile("part-00003-odd", &odd, 7))
+}
+
+func queryIDs(t *testing.T, ib *DuckpondDB, query string) string {
+	resp, err := ib.PostEndpoint("/query", query)
+	require.NoError(t, err)
+	var result QueryResponse
+	require.NoError(t, json.Unmarshal([]byte(resp), &result))
+	ids := make([]string, len(result.Data))
+	for i, row := range result.Data {
+		ids[i] = fmt.Sprint(row[0])
+	}
+	return strings.Join(ids, ",")
+}
+
+func TestAdoptExternalTable(t *testing.T) {
+	storageDir := t.TempDir()
+	newExternalTable(t, storageDir, "external")
+	ib := newTestDB(t, WithStorageDir(storageDir))
+
+	// partition values are read from the log, the files don't have them
+	assert.Equal(t, "1,3,4,5,7", queryIDs(t, ib, "SELECT id FROM external ORDER BY id"))
+	assert.Equal(t, "1,3,7", queryIDs(t, ib, `SELECT id FROM external WHERE "user" = 'odd_user' ORDER BY id`))
+	assert.Equal(t, "5", queryIDs(t, ib, `SELECT id FROM external WHERE "user" IS NULL`))
+	assert.Equal(t, "2024-01-05 00:00:00 +0000 UTC", queryIDs(t, ib, "SELECT last_modified FROM external WHERE id = 4"))
+	assert.Equal(t, "1,3,4", queryIDs(t, ib, "SELECT id FROM external VERSION AS OF 2 WHERE id < 5 ORDER BY id"))
+
+	// appends are partitioned the same way
+	_, err := ib.PostEndpoint("/query", "INSERT INTO external VALUES (8, 'hi', '2024-02-01', 'even_user')")
+	require.NoError(t, err)
+	assert.Equal(t, "4,8", queryIDs(t, ib, `SELECT id FROM external WHERE "user" = 'even_user' ORDER BY id`))
+	_, err = ib.PostEndpoint("/query", "DELETE FROM external WHERE id = 3")
+	require.NoError(t, err)
+	assert.Equal(t, "1,7", queryIDs(t, ib, `SELECT id FROM external WHERE "user" = 'odd_user' ORDER BY id`))
+
+	coldLog := NewLog(storageDir, "external")
+	defer coldLog.Close()
+	logDB, err := coldLog.getLogDBAfterImport()
+	require.NoError(t, err)
+	var path, partitionValues string
+	err = logDB.QueryRow(`
+		SELECT "add".path, "add".partitionValues::JSON
+		FROM log_json WHERE "add" IS NOT NULL AND version = 4`).Scan(&path, &partitionValues)
+	require.NoError(t, err)
+	assert.True(t, strings.HasPrefix(path, "data/user=even_user/"), path)
+	assert.JSONEq(t, `{"user": "even_user"}`, partitionValues)
+	rows, err := logDB.Query("SELECT name FROM parquet_schema($1) WHERE num_children IS NULL",
+		filepath.Join(storageDir, "external", path))
+	require.NoError(t, err)
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		require.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	assert.Equal(t, []string{"id", "message", "last_modified"}, names)
+}
+
+func TestAdoptExternalTableWithoutEarlyCommits(t *testing.T) {
+	storageDir := t.TempDir()
+	newExternalTable(t, storageDir, "external")
+	// log cleanup removed commits the checkpoint covers, and _last_checkpoint is only a hint
+	for _, name := range []string{"00000000000000000000.json", "00000000000000000001.json", "_last_checkpoint"} {
+		require.NoError(t, os.Remove(filepath.Join(storageDir, "external", "_delta_log", name)))
+	}
+	ib := newTestDB(t, WithStorageDir(storageDir))
+
+	assert.Equal(t, "1,3,4,5,7", queryIDs(t, ib, "SELECT id FROM external ORDER BY id"))
+}
+
+func TestCreateTableFromSchema(t *testing.T) {
+	createTable, err := createTableFromSchema("t", `{"type":"struct","fields":[
+		{"name":"id","type":"long","nullable":false,"metadata":{}},
+		{"name":"price","type":"decimal(10,2)","nullable":true,"metadata":{}},
+		{"name":"at","type":"timestamp","nullable":true,"metadata":{}},
+		{"name":"tags","type":{"type":"array","elementType":"string","containsNull":true},"nullable":true,"metadata":{}},
+		{"name":"attrs","type":{"type":"map","keyType":"string","valueType":"integer","valueContainsNull":true},"nullable":true,"metadata":{}},
+		{"name":"point","type":{"type":"struct","fields":[{"name":"x","type":"double","nullable":true,"metadata":{}}]},"nullable":true,"metadata":{}}]}`)
+	assert.NoError(t, err)
+	assert.Equal(t, `CREATE TABLE t ("id" BIGINT NOT NULL, "price" DECIMAL(10,2), "at" TIMESTAMP WITH TIME ZONE, `+
+		`"tags" VARCHAR[], "attrs" MAP(VARCHAR, INTEGER), "point" STRUCT("x" DOUBLE))`, createTable)
+
+	_, err = createTableFromSchema("t", `{"type":"struct","fields":[{"name":"v","type":"variant","nullable":true,"metadata":{}}]}`)
+	assert.ErrorContains(t, err, "no duckdb equivalent")
+}
+
+func TestCheckProtocol(t *testing.T) {
+	db, err := InitializeDuckDB()
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(deltaLakeInitSQL)
+	require.NoError(t, err)
+	l := &Log{tableName: "t"}
+
+	tests := []struct {
+		protocol string
+		metaData string
+		readErr  string
+		writeErr string
+	}{
+		{`{"minReaderVersion":1,"minWriterVersion":2}`, `{}`, "", ""},
+		{`{"minReaderVersion":3,"minWriterVersion":7,"readerFeatures":["deletionVectors"],"writerFeatures":["deletionVectors","domainMetadata"]}`,
+			`{}`, "", "domainMetadata"},
+		{`{"minReaderVersion":3,"minWriterVersion":7,"readerFeatures":["v2Checkpoint"],"writerFeatures":["v2Checkpoint"]}`,
+			`{}`, "v2Checkpoint", "v2Checkpoint"},
+		// legacy writer version 3 has checkConstraints, only a problem when the table has constraints
+		{`{"minReaderVersion":1,"minWriterVersion":3}`, `{}`, "", ""},
+		{`{"minReaderVersion":1,"minWriterVersion":3}`, `{"delta.constraints.positive": "id > 0"}`, "", "checkConstraints"},
+	}
+	for _, tt := range tests {
+		_, err := db.Exec("DELETE FROM log_json")
+		require.NoError(t, err)
+		_, err = db.Exec("INSERT INTO log_json (protocol, version) VALUES ($1, 0)", tt.protocol)
+		require.NoError(t, err)
+		_, err = db.Exec(`
+			INSERT INTO log_json (metaData, version)
+			SELECT {'id': NULL, 'format': NULL, 'schemaString': '{}', 'partitionColumns': [], 'createdTime': 0,
+				'duckpond': NULL, 'configuration': $1::JSON::MAP(VARCHAR, VARCHAR)}, 0`, tt.metaData)
+		require.NoError(t, err)
+		for write, expected := range map[bool]string{false: tt.readErr, true: tt.writeErr} {
+			err := l.checkProtocol(db, write)
+			if expected == "" {
+				assert.NoError(t, err, tt.protocol)
+			} else {
+				assert.ErrorContains(t, err, expected, tt.protocol)
+			}
+		}
+	}
+}
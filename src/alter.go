@@ -0,0 +1,359 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+//go:embed alter_table_event.sql
+var query_alter_table_event string
+
+// typeChange is an entry of delta.typeChanges in metadata of a widened field
+type typeChange struct {
+	FromType string `json:"fromType"`
+	ToType   string `json:"toType"`
+}
+
+// isUnsigned tells if a duckdb type is an unsigned integer
+func isUnsigned(dataType string) bool {
+	return strings.HasPrefix(dataType, "U") && dataType != "UUID"
+}
+
+// widening returns the typeChange of a column whose type changed from before to after
+// when values in files written before can be read as after, nil when they have to be rewritten
+func widening(before, after tableColumn) *typeChange {
+	from, err := deltaType(before.DataType)
+	if err != nil {
+		return nil
+	}
+	to, err := deltaType(after.DataType)
+	if err != nil {
+		return nil
+	}
+	fromType, fromPrimitive := from.(string)
+	toType, toPrimitive := to.(string)
+	// negative values don't cast to unsigned types
+	if !fromPrimitive || !toPrimitive || isUnsigned(after.DataType) && !isUnsigned(before.DataType) {
+		return nil
+	}
+	if !isTypeWidening(fromType, toType) {
+		return nil
+	}
+	return &typeChange{FromType: fromType, ToType: toType}
+}
+
+// renamedColumns maps the new name of a column ALTER TABLE renamed to its old one,
+// it's the only column whose name changed while its type and position stayed the same
+func renamedColumns(before, after []tableColumn) map[string]string {
+	renamed := map[string]string{}
+	if len(before) != len(after) {
+		return renamed
+	}
+	for i := range before {
+		if before[i].Name == after[i].Name {
+			continue
+		}
+		if before[i].DataType != after[i].DataType || len(renamed) > 0 {
+			return map[string]string{}
+		}
+		renamed[after[i].Name] = before[i].Name
+	}
+	return renamed
+}
+
+// schemaChanges compares columns of the table before and after ALTER TABLE.
+// Returns typeChanges of widened columns, and whether files have to be rewritten
+// for their rows to read as the new schema: types changed other than by widening,
+// columns becoming NOT NULL or added with a default, and unless the table maps columns
+// to physical names, columns dropped or renamed.
+func schemaChanges(before, after []tableColumn, columnMapping bool) (map[string]typeChange, bool) {
+	renamed := renamedColumns(before, after)
+	beforeByName := map[string]tableColumn{}
+	for _, column := range before {
+		beforeByName[column.Name] = column
+	}
+	widened := map[string]typeChange{}
+	for _, column := range after {
+		name := column.Name
+		if oldName, ok := renamed[name]; ok {
+			name = oldName
+		}
+		old, ok := beforeByName[name]
+		if !ok {
+			if !column.Nullable || column.Default.Valid {
+				return nil, true
+			}
+			continue
+		}
+		delete(beforeByName, name)
+		if old.Nullable && !column.Nullable {
+			return nil, true
+		}
+		if old.DataType == column.DataType {
+			continue
+		}
+		change := widening(old, column)
+		if change == nil {
+			return nil, true
+		}
+		widened[column.Name] = *change
+	}
+	dropped := len(beforeByName) > 0
+	return widened, !columnMapping && (dropped || len(renamed) > 0)
+}
+
+// AlterTable applies ALTER TABLE query to the table created by CreateTempTable and commits
+// the schema it results in as new metaData. Columns keep their ids and physical names
+// through renames, so renames, drops, adding nullable columns and widening types only
+// change metaData: reads fill columns missing from older files with NULL and cast their values.
+// Other changes rewrite every live file with query applied to its rows.
+func (l *Log) AlterTable(dataTx *sql.Tx, query string, operation commitOperation) error {
+	return l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		before, err := tableColumns(dataTx, l.tableName)
+		if err != nil {
+			return err
+		}
+		var createBefore string
+		if err := dataTx.QueryRow("SELECT sql FROM duckdb_tables() WHERE table_name = $1", l.tableName).Scan(&createBefore); err != nil {
+			return fmt.Errorf("failed to get CREATE TABLE of %s: %w", l.tableName, err)
+		}
+		// against the empty table first, so a bad statement fails before any file is read
+		if _, err := dataTx.Exec(query); err != nil {
+			return err
+		}
+		after, err := tableColumns(dataTx, l.tableName)
+		if err != nil {
+			return err
+		}
+		partitionBy, err := l.partitionBy(logDB)
+		if err != nil {
+			return err
+		}
+		if err := l.validatePartitionBy(dataTx, partitionBy); err != nil {
+			return err
+		}
+		maxColumnId, err := l.maxColumnId(logDB)
+		if err != nil {
+			return err
+		}
+
+		widened, rewrite := schemaChanges(before, after, maxColumnId >= 0)
+		if rewrite {
+			// rewritten files have the new types, earlier typeChanges no longer apply
+			widened = nil
+		}
+		previous, err := l.previousFields(logDB, before, after, partitionBy, rewrite)
+		if err != nil {
+			return err
+		}
+		for name, change := range widened {
+			field := previous[name]
+			if field.Metadata == nil {
+				field.Metadata = map[string]any{}
+			}
+			changes, _ := field.Metadata["delta.typeChanges"].([]any)
+			field.Metadata["delta.typeChanges"] = append(changes, change)
+			previous[name] = field
+		}
+
+		schema, err := deltaSchema(dataTx, l.tableName, partitionBy, previous)
+		if err != nil {
+			return fmt.Errorf("failed to map %s to a Delta Lake schema: %w", l.tableName, err)
+		}
+		schemaString, maxColumnId, err := renderSchemaString(schema, maxColumnId)
+		if err != nil {
+			return err
+		}
+		var createTable string
+		if err := dataTx.QueryRow("SELECT sql FROM duckdb_tables() WHERE table_name = $1", l.tableName).Scan(&createTable); err != nil {
+			return fmt.Errorf("failed to get CREATE TABLE of %s: %w", l.tableName, err)
+		}
+		configuration := map[string]string{}
+		if len(widened) > 0 {
+			configuration["delta.enableTypeWidening"] = "true"
+		}
+		if maxColumnId >= 0 {
+			configuration["delta.columnMapping.maxColumnId"] = strconv.FormatInt(maxColumnId, 10)
+		}
+		configurationJSON, err := json.Marshal(configuration)
+		if err != nil {
+			return err
+		}
+		if _, err := logDB.Exec(query_alter_table_event, schemaString, createTable, string(configurationJSON)); err != nil {
+			return fmt.Errorf("failed to record metaData of %s: %w", l.tableName, err)
+		}
+		if len(widened) > 0 {
+			if err := l.stageTableFeature(logDB, "typeWidening"); err != nil {
+				return err
+			}
+		}
+		if rewrite {
+			return l.rewriteAltered(dataTx, logDB, createBefore, query)
+		}
+		return nil
+	})
+}
+
+// SetTableProperties commits metaData with properties set in the table's configuration
+func (l *Log) SetTableProperties(properties map[string]string) error {
+	for key, value := range properties {
+		if strings.HasPrefix(key, "delta.columnMapping.") {
+			return fmt.Errorf("%s can't be changed", key)
+		}
+		if key == "delta.deletedFileRetentionDuration" {
+			if _, err := parseInterval(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+		if key == "delta.targetFileSize" {
+			if _, err := parseByteSize(value); err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	propertiesJSON, err := json.Marshal(properties)
+	if err != nil {
+		return err
+	}
+	operation := commitOperation{Name: "SET TBLPROPERTIES", Parameters: map[string]string{"properties": string(propertiesJSON)}}
+	return l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		if _, err := logDB.Exec(query_alter_table_event, nil, nil, string(propertiesJSON)); err != nil {
+			return fmt.Errorf("failed to record metaData of %s: %w", l.tableName, err)
+		}
+		return nil
+	})
+}
+
+// previousFields picks fields of the latest schema that columns after ALTER TABLE keep,
+// by their new name. Columns whose type changed get their type mapped anew.
+func (l *Log) previousFields(logDB *sql.DB, before, after []tableColumn, partitionBy []PartitionColumn, rewrite bool) (map[string]deltaStructField, error) {
+	fields, err := l.schemaFields(logDB, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+	fieldsByName := map[string]deltaStructField{}
+	for _, field := range fields {
+		if rewrite {
+			delete(field.Metadata, "delta.typeChanges")
+		}
+		fieldsByName[field.Name] = field
+	}
+	types := map[string]string{}
+	for _, column := range before {
+		types[column.Name] = column.DataType
+	}
+	renamed := renamedColumns(before, after)
+	previous := map[string]deltaStructField{}
+	for _, column := range after {
+		name := column.Name
+		if oldName, ok := renamed[name]; ok {
+			name = oldName
+		}
+		field, ok := fieldsByName[name]
+		if !ok {
+			continue
+		}
+		if types[name] != column.DataType {
+			field.Type = nil
+		}
+		previous[column.Name] = field
+	}
+	for _, column := range partitionBy {
+		if field, ok := fieldsByName[column.Name]; ok {
+			if _, ok := previous[column.Name]; !ok {
+				previous[column.Name] = field
+			}
+		}
+	}
+	return previous, nil
+}
+
+// rewriteAltered loads rows of every live file into the table as createBefore made it,
+// applies ALTER TABLE query to them and stages the rewritten files in place of the old ones
+func (l *Log) rewriteAltered(dataTx *sql.Tx, logDB *sql.DB, createBefore, query string) error {
+	if _, err := dataTx.Exec(fmt.Sprintf("DROP TABLE %s", l.tableName)); err != nil {
+		return err
+	}
+	if _, err := dataTx.Exec(createBefore); err != nil {
+		return err
+	}
+	columns, err := tableColumns(dataTx, l.tableName)
+	if err != nil {
+		return err
+	}
+	// files have the physical names of the latest commit, not of the staged metaData
+	version, err := l.currentVersion(logDB)
+	if err != nil {
+		return err
+	}
+	physical, err := l.physicalNames(logDB, version)
+	if err != nil {
+		return err
+	}
+	schema := tableSchema{columns: columns, physical: physical}
+
+	files, err := l.queryLiveFiles(sqlFilesListLive, latestVersion)
+	if err != nil {
+		return fmt.Errorf("failed to list files to rewrite: %w", err)
+	}
+	for _, file := range files {
+		err := l.WithDuckDBSecret(dataTx, func() error {
+			rowsSQL, err := l.liveRowsSQL(dataTx, file)
+			if err != nil {
+				return err
+			}
+			_, err = dataTx.Exec(fmt.Sprintf("INSERT INTO %s BY NAME %s", l.tableName, schema.rowsSQL(rowsSQL)))
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", file.Path, err)
+		}
+		if _, err := logDB.Exec(query_remove_file, file.Path, true, int64(latestVersion)); err != nil {
+			return fmt.Errorf("failed to record 'remove' of %s: %w", file.Path, err)
+		}
+	}
+	if _, err := dataTx.Exec(query); err != nil {
+		return err
+	}
+	var rows int64
+	if err := dataTx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", l.tableName)).Scan(&rows); err != nil {
+		return err
+	}
+	if rows == 0 {
+		return nil
+	}
+	return l.stageAddsOf(dataTx, logDB, l.tableName, true)
+}
+
+// stageTableFeature stages a protocol adding feature to the reader and writer features
+// of the table's latest protocol, unless it has it already
+func (l *Log) stageTableFeature(logDB *sql.DB, feature string) error {
+	protocol, err := l.protocol(logDB)
+	if err != nil || protocol == nil {
+		return err
+	}
+	if protocol.MinWriterVersion >= 7 && slices.Contains(protocol.WriterFeatures, feature) {
+		return nil
+	}
+	protocolJSON, err := json.Marshal(protocol.withFeature(feature))
+	if err != nil {
+		return err
+	}
+	if _, err := logDB.Exec("INSERT INTO log_json (protocol) VALUES ($1)", string(protocolJSON)); err != nil {
+		return fmt.Errorf("failed to stage protocol with %s: %w", feature, err)
+	}
+	return nil
+}
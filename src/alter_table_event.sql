@@ -0,0 +1,20 @@
+-- metaData replacing the table's latest one after ALTER TABLE, keeping its id:
+-- $1 is the new schemaString, $2 a CREATE TABLE of the altered table, both NULL to keep them,
+-- $3 a JSON object of configuration to set
+INSERT INTO log_json (metaData)
+SELECT struct_pack(
+    id := metaData.id,
+    format := metaData.format,
+    schemaString := coalesce($1, metaData.schemaString),
+    partitionColumns := metaData.partitionColumns,
+    createdTime := metaData.createdTime,
+    duckpond := struct_pack(
+        createTable := coalesce($2, metaData.duckpond.createTable),
+        partitionBy := metaData.duckpond.partitionBy
+    ),
+    "configuration" := map_concat(metaData."configuration", $3::JSON::MAP(VARCHAR, VARCHAR))
+)
+FROM log_json
+WHERE metaData IS NOT NULL
+ORDER BY version DESC NULLS FIRST, rowid DESC
+LIMIT 1;
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIsTypeWidening(t *testing.T) {
+	tests := []struct {
+		from, to string
+		widening bool
+	}{
+		{"integer", "long", true},
+		{"long", "integer", false},
+		{"byte", "double", true},
+		{"long", "double", false},
+		{"float", "double", true},
+		{"date", "timestamp_ntz", true},
+		{"date", "timestamp", false},
+		{"integer", "decimal(10,0)", true},
+		{"integer", "decimal(10,2)", false},
+		{"decimal(10,2)", "decimal(12,4)", true},
+		{"decimal(10,2)", "decimal(10,3)", false},
+		{"string", "long", false},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.widening, isTypeWidening(tt.from, tt.to), "%s to %s", tt.from, tt.to)
+	}
+}
+
+func TestSchemaChanges(t *testing.T) {
+	before := []tableColumn{
+		{Name: "id", DataType: "INTEGER", Nullable: false},
+		{Name: "name", DataType: "VARCHAR", Nullable: true},
+	}
+	tests := []struct {
+		name    string
+		after   []tableColumn
+		widened map[string]typeChange
+		rewrite bool
+	}{
+		{"add nullable", append(before, tableColumn{Name: "note", DataType: "VARCHAR", Nullable: true}), map[string]typeChange{}, false},
+		{"add with default", append(before, tableColumn{Name: "n", DataType: "INTEGER", Nullable: true, Default: sql.NullString{String: "1", Valid: true}}), nil, true},
+		{"widen", []tableColumn{{Name: "id", DataType: "BIGINT"}, before[1]}, map[string]typeChange{"id": {FromType: "integer", ToType: "long"}}, false},
+		{"to unsigned", []tableColumn{{Name: "id", DataType: "UINTEGER"}, before[1]}, nil, true},
+		{"narrow", []tableColumn{{Name: "id", DataType: "SMALLINT"}, before[1]}, nil, true},
+		{"rename", []tableColumn{before[0], {Name: "title", DataType: "VARCHAR", Nullable: true}}, map[string]typeChange{}, true},
+		{"drop", before[:1], map[string]typeChange{}, true},
+		{"set not null", []tableColumn{before[0], {Name: "name", DataType: "VARCHAR"}}, nil, true},
+	}
+	for _, tt := range tests {
+		widened, rewrite := schemaChanges(before, tt.after, false)
+		assert.Equal(t, tt.rewrite, rewrite, tt.name)
+		assert.Equal(t, tt.widened, widened, tt.name)
+	}
+
+	// columns mapped to physical names are renamed and dropped in metaData alone
+	for _, tt := range tests[5:7] {
+		widened, rewrite := schemaChanges(before, tt.after, true)
+		assert.False(t, rewrite, tt.name)
+		assert.Equal(t, tt.widened, widened, tt.name)
+	}
+}
+
+func TestAlterTableTypeWidening(t *testing.T) {
+	ib := newLogTestTable(t, 1)
+
+	_, err := ib.PostEndpoint("/query", "ALTER TABLE log_test ALTER COLUMN id TYPE BIGINT")
+	assert.NoError(t, err)
+
+	// a fresh log sees what was committed
+	coldLog := NewLog(ib.storageDir, "log_test")
+	defer coldLog.Close()
+	logDB, err := coldLog.getLogDBAfterImport()
+	assert.NoError(t, err)
+	var schemaString, createTable string
+	var widening bool
+	err = logDB.QueryRow(`
+		SELECT metaData.schemaString, metaData.duckpond.createTable,
+			map_extract(metaData.configuration, 'delta.enableTypeWidening')[1] = 'true'
+		FROM log_json WHERE metaData IS NOT NULL ORDER BY version DESC LIMIT 1`).Scan(&schemaString, &createTable, &widening)
+	assert.NoError(t, err)
+	assert.True(t, widening, "delta.enableTypeWidening isn't set")
+	assert.Contains(t, createTable, "id BIGINT")
+
+	var schema deltaStructType
+	assert.NoError(t, json.Unmarshal([]byte(schemaString), &schema))
+	assert.Equal(t, "long", schema.Fields[0].Type)
+	assert.Equal(t, []any{map[string]any{"fromType": "integer", "toType": "long"}}, schema.Fields[0].Metadata["delta.typeChanges"])
+
+	var features []any
+	err = logDB.QueryRow(`
+		SELECT json_extract_string(protocol, '$.readerFeatures[*]')
+		FROM log_json WHERE protocol IS NOT NULL ORDER BY version DESC LIMIT 1`).Scan(&features)
+	assert.NoError(t, err)
+	assert.Contains(t, features, "typeWidening")
+
+	// no file was rewritten, the row written as INTEGER reads as BIGINT
+	files, err := coldLog.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	resp, err := ib.PostEndpoint("/query", "SELECT typeof(id) AS t FROM log_test")
+	assert.NoError(t, err)
+	assert.Contains(t, resp, "BIGINT")
+}
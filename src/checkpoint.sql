@@ -0,0 +1,37 @@
+-- reconciled state of the table as of the latest commit, written as a delta lake checkpoint,
+-- $1 is latestVersion
+-- see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#checkpoints
+WITH latest_protocol AS (
+  SELECT protocol FROM log_json WHERE protocol IS NOT NULL ORDER BY version DESC, rowid DESC LIMIT 1
+),
+latest_metadata AS (
+  SELECT metaData FROM log_json WHERE metaData IS NOT NULL ORDER BY version DESC, rowid DESC LIMIT 1
+)
+SELECT
+  -- checkpoints store actions as structs, not json
+  json_transform(protocol, '{
+    "minReaderVersion": "INTEGER",
+    "minWriterVersion": "INTEGER",
+    "readerFeatures": ["VARCHAR"],
+    "writerFeatures": ["VARCHAR"]
+  }') AS protocol
+FROM latest_protocol
+UNION ALL BY NAME
+SELECT
+  struct_pack(
+    id := metaData.id::VARCHAR,
+    format := metaData.format,
+    schemaString := metaData.schemaString,
+    partitionColumns := metaData.partitionColumns,
+    createdTime := metaData.createdTime,
+    duckpond := metaData.duckpond,
+    configuration := metaData.configuration
+  ) AS metaData
+FROM latest_metadata
+UNION ALL BY NAME
+-- writers skip writes of an app up to its latest txn version
+SELECT txn FROM log_json WHERE txn IS NOT NULL
+QUALIFY row_number() OVER (PARTITION BY txn.appId ORDER BY version DESC, rowid DESC) = 1
+UNION ALL BY NAME
+-- only the newest action for each file matters
+SELECT "add", remove FROM file_actions_at($1)
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#column-mapping
+const (
+	columnMappingIdKey           = "delta.columnMapping.id"
+	columnMappingPhysicalNameKey = "delta.columnMapping.physicalName"
+)
+
+// assignColumnIds gives fields of a schema type decoded into maps, nested ones too, that don't
+// have one a column id and physical name. Ids count up from maxColumnId, returns the largest.
+// Top-level columns get random physical names, so a column added after another of the same
+// name was dropped doesn't read its values. Nested fields keep their names, duckdb can't rename them.
+func assignColumnIds(schemaType any, maxColumnId int64, topLevel bool) int64 {
+	t, ok := schemaType.(map[string]any)
+	if !ok {
+		return maxColumnId
+	}
+	switch t["type"] {
+	case "struct":
+		fields, _ := t["fields"].([]any)
+		for _, f := range fields {
+			field, ok := f.(map[string]any)
+			if !ok {
+				continue
+			}
+			metadata, ok := field["metadata"].(map[string]any)
+			if !ok {
+				metadata = map[string]any{}
+				field["metadata"] = metadata
+			}
+			if _, ok := metadata[columnMappingIdKey]; !ok {
+				maxColumnId++
+				metadata[columnMappingIdKey] = maxColumnId
+				metadata[columnMappingPhysicalNameKey] = field["name"]
+				if topLevel {
+					metadata[columnMappingPhysicalNameKey] = "col-" + uuid.NewString()
+				}
+			}
+			maxColumnId = assignColumnIds(field["type"], maxColumnId, false)
+		}
+	case "array":
+		maxColumnId = assignColumnIds(t["elementType"], maxColumnId, false)
+	case "map":
+		maxColumnId = assignColumnIds(t["keyType"], maxColumnId, false)
+		maxColumnId = assignColumnIds(t["valueType"], maxColumnId, false)
+	}
+	return maxColumnId
+}
+
+// columnMappedSchemaString renders schema as a schemaString with column ids and physical names
+// given to fields without them, as columnMapping mode 'name' needs. Returns the largest id.
+func columnMappedSchemaString(schema deltaStructType, maxColumnId int64) (string, int64, error) {
+	data, err := json.Marshal(schema)
+	if err != nil {
+		return "", 0, err
+	}
+	var decoded any
+	if err := json.Unmarshal(data, &decoded); err != nil {
+		return "", 0, err
+	}
+	maxColumnId = assignColumnIds(decoded, maxColumnId, true)
+	data, err = json.Marshal(decoded)
+	return string(data), maxColumnId, err
+}
+
+// schemaFields reads the top-level fields of the table's schemaString as of version,
+// staged metaData counts as the latest. None before the table is created.
+func (l *Log) schemaFields(logDB *sql.DB, version int64) ([]deltaStructField, error) {
+	var schemaString string
+	err := logDB.QueryRow(`
+		SELECT metaData.schemaString
+		FROM log_json
+		WHERE metaData IS NOT NULL AND (version <= $1 OR version IS NULL AND $1 = $2)
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`, version, int64(latestVersion)).Scan(&schemaString)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get schema of %s: %w", l.tableName, err)
+	}
+	var schema deltaStructType
+	if err := json.Unmarshal([]byte(schemaString), &schema); err != nil {
+		return nil, fmt.Errorf("bad schemaString of %s: %w", l.tableName, err)
+	}
+	return schema.Fields, nil
+}
+
+// physicalNames maps top-level columns of the table's schema as of version to the names
+// they have in parquet files, empty when the table doesn't map columns
+func (l *Log) physicalNames(logDB *sql.DB, version int64) (map[string]string, error) {
+	fields, err := l.schemaFields(logDB, version)
+	if err != nil {
+		return nil, err
+	}
+	physical := map[string]string{}
+	for _, field := range fields {
+		if name, ok := field.Metadata[columnMappingPhysicalNameKey].(string); ok {
+			physical[field.Name] = name
+		}
+	}
+	return physical, nil
+}
+
+// physicalName is the name column has in parquet files according to physical
+func physicalName(physical map[string]string, column string) string {
+	if name, ok := physical[column]; ok {
+		return name
+	}
+	return column
+}
+
+// maxColumnId reads delta.columnMapping.maxColumnId, -1 when the table doesn't map columns
+func (l *Log) maxColumnId(logDB *sql.DB) (int64, error) {
+	mode, err := l.tableProperty(logDB, "delta.columnMapping.mode")
+	if err != nil || mode != "name" {
+		return -1, err
+	}
+	value, err := l.tableProperty(logDB, "delta.columnMapping.maxColumnId")
+	if err != nil {
+		return -1, err
+	}
+	maxColumnId, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return -1, fmt.Errorf("bad delta.columnMapping.maxColumnId %q: %w", value, err)
+	}
+	return maxColumnId, nil
+}
+
+// tableSchema is the columns of a table and the names they have in parquet files
+type tableSchema struct {
+	columns  []tableColumn
+	physical map[string]string
+}
+
+// currentSchema is the schema of the table created in dataTx by CreateTempTable
+func (l *Log) currentSchema(dataTx *sql.Tx, logDB *sql.DB) (tableSchema, error) {
+	columns, err := tableColumns(dataTx, l.tableName)
+	if err != nil {
+		return tableSchema{}, err
+	}
+	physical, err := l.physicalNames(logDB, latestVersion)
+	if err != nil {
+		return tableSchema{}, err
+	}
+	return tableSchema{columns: columns, physical: physical}, nil
+}
+
+// rowsSQL reads rows, straight from parquet files, as the columns of s: physical names are
+// renamed, columns missing from files written before ALTER TABLE are NULL, narrower types
+// are cast and dropped columns left out. Columns in keep are passed through.
+func (s tableSchema) rowsSQL(rows string, keep ...string) string {
+	empty := make([]string, 0, len(s.columns))
+	project := make([]string, 0, len(s.columns)+len(keep))
+	for _, column := range s.columns {
+		physical := quoteIdentifier(physicalName(s.physical, column.Name))
+		empty = append(empty, fmt.Sprintf("NULL::%s AS %s", column.DataType, physical))
+		project = append(project, fmt.Sprintf("%s::%s AS %s", physical, column.DataType, quoteIdentifier(column.Name)))
+	}
+	project = append(project, keep...)
+	return fmt.Sprintf("SELECT %s FROM (SELECT %s WHERE false UNION ALL BY NAME %s)",
+		strings.Join(project, ", "), strings.Join(empty, ", "), rows)
+}
+
+// physicalSelect selects columns of s from table under their physical names, to be written to parquet
+func (s tableSchema) physicalSelect(table string) string {
+	columns := make([]string, len(s.columns))
+	for i, column := range s.columns {
+		value := quoteIdentifier(column.Name)
+		if strings.Contains(column.DataType, "UUID") {
+			value = fmt.Sprintf("%s::%s", value, parquetDataType(column.DataType))
+		}
+		columns[i] = fmt.Sprintf("%s AS %s", value, quoteIdentifier(physicalName(s.physical, column.Name)))
+	}
+	return fmt.Sprintf("SELECT %s FROM %s", strings.Join(columns, ", "), table)
+}
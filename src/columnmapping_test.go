@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAssignColumnIds(t *testing.T) {
+	structType, err := deltaType("STRUCT(a INTEGER, b VARCHAR[])")
+	assert.NoError(t, err)
+	schema := deltaStructType{Type: "struct", Fields: []deltaStructField{
+		{Name: "id", Type: "integer", Nullable: true, Metadata: map[string]any{
+			columnMappingIdKey: 1, columnMappingPhysicalNameKey: "col-id",
+		}},
+		{Name: "s", Type: structType, Nullable: true, Metadata: map[string]any{}},
+	}}
+	schemaString, maxColumnId, err := columnMappedSchemaString(schema, 1)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(4), maxColumnId)
+
+	var mapped deltaStructType
+	assert.NoError(t, json.Unmarshal([]byte(schemaString), &mapped))
+	// columns that have an id keep it
+	assert.Equal(t, "col-id", mapped.Fields[0].Metadata[columnMappingPhysicalNameKey])
+	assert.Equal(t, float64(2), mapped.Fields[1].Metadata[columnMappingIdKey])
+	assert.True(t, strings.HasPrefix(mapped.Fields[1].Metadata[columnMappingPhysicalNameKey].(string), "col-"))
+	// nested fields keep their names
+	nested := mapped.Fields[1].Type.(map[string]any)["fields"].([]any)
+	assert.Equal(t, "b", nested[1].(map[string]any)["metadata"].(map[string]any)[columnMappingPhysicalNameKey])
+}
+
+func TestColumnMappingPhysicalNames(t *testing.T) {
+	ib := newLogTestTable(t, 1)
+
+	coldLog := NewLog(ib.storageDir, "log_test")
+	defer coldLog.Close()
+	logDB, err := coldLog.getLogDBAfterImport()
+	assert.NoError(t, err)
+	var mode string
+	err = logDB.QueryRow(`
+		SELECT map_extract(metaData.configuration, 'delta.columnMapping.mode')[1]
+		FROM log_json WHERE metaData IS NOT NULL`).Scan(&mode)
+	assert.NoError(t, err)
+	assert.Equal(t, "name", mode)
+
+	physical, err := coldLog.physicalNames(logDB, latestVersion)
+	assert.NoError(t, err)
+	assert.Len(t, physical, 2)
+
+	// parquet files only know the physical names
+	files, err := coldLog.listFiles(filesLive)
+	assert.NoError(t, err)
+	if !assert.Len(t, files, 1) {
+		return
+	}
+	rows, err := logDB.Query("SELECT name FROM parquet_schema($1) WHERE num_children IS NULL",
+		filepath.Join(ib.storageDir, "log_test", files[0]))
+	assert.NoError(t, err)
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var name string
+		assert.NoError(t, rows.Scan(&name))
+		names = append(names, name)
+	}
+	assert.ElementsMatch(t, []string{physical["id"], physical["text"]}, names)
+
+	resp, err := ib.PostEndpoint("/query", "SELECT text FROM log_test WHERE id = 0")
+	assert.NoError(t, err)
+	assert.Contains(t, resp, "row 0")
+}
+
+func TestUUIDWrittenAsString(t *testing.T) {
+	ib := newTestDB(t)
+	_, err := ib.PostEndpoint("/query", "CREATE TABLE uuids (id UUID, s STRUCT(u UUID, \"UUID\" INTEGER))")
+	require.NoError(t, err)
+	_, err = ib.PostEndpoint("/query", `INSERT INTO uuids VALUES
+		('01947471-2ded-7812-cafe-34567000b33f', {'u': '01947471-2ded-7812-cafe-34567000b33e', 'UUID': 1})`)
+	require.NoError(t, err)
+
+	// delta has no uuid type, the schema says string so parquet files have strings
+	l := ib.logs["uuids"]
+	logDB, err := l.getLogDBAfterImport()
+	require.NoError(t, err)
+	files, err := l.listFiles(filesLive)
+	require.NoError(t, err)
+	require.Len(t, files, 1)
+	rows, err := logDB.Query("SELECT name, type FROM parquet_schema($1) WHERE num_children IS NULL",
+		filepath.Join(ib.storageDir, "uuids", files[0]))
+	require.NoError(t, err)
+	defer rows.Close()
+	types := map[string]string{}
+	for rows.Next() {
+		var name, parquetType string
+		assert.NoError(t, rows.Scan(&name, &parquetType))
+		types[name] = parquetType
+	}
+	physical, err := l.physicalNames(logDB, latestVersion)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{physical["id"]: "BYTE_ARRAY", "u": "BYTE_ARRAY", "UUID": "INT32"}, types)
+
+	// and are read back as uuids
+	assert.Equal(t, "UUID,UUID", queryIDs(t, ib, "SELECT typeof(id) || ',' || typeof(s.u) FROM uuids"))
+	assert.Equal(t, "01947471-2ded-7812-cafe-34567000b33e", queryIDs(t, ib,
+		"SELECT s.u::VARCHAR FROM uuids WHERE id = '01947471-2ded-7812-cafe-34567000b33f'"))
+}
@@ -0,0 +1,37 @@
+-- reasons actions staged on top of version $1 can't be committed after commits that happened since
+-- appends never conflict with each other, anything that removes files conflicts with concurrent changes to the files it read
+-- and unless it only moved rows to other files, like OPTIMIZE, with concurrent appends.
+-- writes of an app with a txn conflict with its concurrent writes.
+-- $2 tells the table has a primary key, then rows written conflict with concurrent appends that may have their keys.
+WITH staged AS (
+  SELECT * FROM log_json WHERE version IS NULL
+),
+concurrent AS (
+  SELECT * FROM log_json WHERE version > $1
+),
+conflicts AS (
+  SELECT 'concurrent protocol change' AS reason
+  FROM concurrent WHERE protocol IS NOT NULL
+  UNION ALL
+  SELECT 'concurrent metadata change'
+  FROM concurrent WHERE metaData IS NOT NULL
+  UNION ALL
+  SELECT 'metadata change raced with a concurrent commit'
+  FROM staged WHERE metaData IS NOT NULL AND EXISTS (FROM concurrent)
+  UNION ALL
+  SELECT 'concurrent remove of ' || remove.path
+  FROM concurrent WHERE remove.path IN (SELECT remove.path FROM staged WHERE remove IS NOT NULL)
+  UNION ALL
+  -- the staged write may be a retry of the concurrent one, only one of them may commit
+  SELECT 'concurrent transaction of app ' || txn.appId
+  FROM concurrent WHERE txn.appId IN (SELECT txn.appId FROM staged WHERE txn IS NOT NULL)
+  UNION ALL
+  -- eg UPDATE rewrote the files it read, rows added meanwhile weren't part of that
+  SELECT 'concurrent add of ' || "add".path
+  FROM concurrent WHERE "add" IS NOT NULL AND EXISTS (SELECT 1 FROM staged WHERE remove.dataChange)
+  UNION ALL
+  -- keys were only checked against rows committed before, like INSERT racing an INSERT of the same key
+  SELECT 'concurrent add of ' || "add".path || ' may have the same keys'
+  FROM concurrent WHERE "add" IS NOT NULL AND $2 AND EXISTS (SELECT 1 FROM staged WHERE "add".dataChange)
+)
+SELECT reason FROM conflicts LIMIT 1;
@@ -0,0 +1,24 @@
+-- stages commitInfo describing the actions staged for the next commit
+-- nothing is staged when there is nothing to commit
+INSERT INTO log_json (commitInfo)
+SELECT json_object(
+    'timestamp', epoch_ms(CURRENT_TIMESTAMP),
+    'operation', $1::VARCHAR,
+    'operationParameters', $2::JSON,
+    'readVersion', nullif($3::BIGINT, -1),
+    'isBlindAppend', count(remove) = 0 AND count(metaData) = 0,
+    -- delta lake writes metrics as strings
+    'operationMetrics', json_object(
+        'numFiles', count("add")::VARCHAR,
+        'numOutputBytes', coalesce(sum("add".size), 0)::VARCHAR,
+        -- rows a deletion vector marks deleted aren't output
+        'numOutputRows', coalesce(sum(CASE WHEN json_valid("add".stats) THEN ("add".stats->>'numRecords')::BIGINT END
+            - coalesce("add".deletionVector.cardinality, 0)), 0)::VARCHAR,
+        'numRemovedFiles', count(remove)::VARCHAR,
+        'numRemovedBytes', coalesce(sum(remove.size), 0)::VARCHAR
+    ),
+    'engineInfo', $4::VARCHAR
+)
+FROM log_json
+WHERE version IS NULL AND commitInfo IS NULL
+HAVING count(*) > 0;
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Delta lake deletion vectors mark rows of a parquet file as deleted without rewriting it,
+// see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#deletion-vectors
+type deletionVector struct {
+	StorageType    string `json:"storageType"` // u: file next to the table's data, i: inline, p: absolute path
+	PathOrInlineDv string `json:"pathOrInlineDv"`
+	Offset         *int32 `json:"offset"`
+	SizeInBytes    int32  `json:"sizeInBytes"`
+	Cardinality    int64  `json:"cardinality"`
+}
+
+const (
+	// RoaringBitmapArray magic number delta lake prefixes serialized deletion vectors with
+	deletionVectorMagic = 1681511377
+	// format version, the first byte of deletion vector files
+	deletionVectorFileVersion = 1
+
+	// cookies of the portable roaring bitmap serialization format,
+	// see https://github.com/RoaringBitmap/RoaringFormatSpec
+	roaringSerialCookieNoRuns = 12346
+	roaringSerialCookie       = 12347
+	roaringNoOffsetThreshold  = 4
+	roaringMaxArraySize       = 4096
+)
+
+var errBadDeletionVector = errors.New("malformed deletion vector")
+
+// relativePath is where a deletion vector with storageType u lives relative to the table
+func (dv *deletionVector) relativePath() (string, error) {
+	if dv.StorageType != "u" || len(dv.PathOrInlineDv) < 20 {
+		return "", fmt.Errorf("%w: no relative path in %+v", errBadDeletionVector, dv)
+	}
+	// random prefix followed by z85 encoded uuid
+	split := len(dv.PathOrInlineDv) - 20
+	id, err := z85Decode(dv.PathOrInlineDv[split:])
+	if err != nil {
+		return "", err
+	}
+	u, err := uuid.FromBytes(id)
+	if err != nil {
+		return "", fmt.Errorf("%w: %v", errBadDeletionVector, err)
+	}
+	return filepath.Join(dv.PathOrInlineDv[:split], fmt.Sprintf("deletion_vector_%s.bin", u)), nil
+}
+
+// encodeDeletionVector serializes sorted row numbers as a RoaringBitmapArray:
+// magic, number of 32-bit bitmaps, then key and portable serialization of each bitmap
+func encodeDeletionVector(rows []uint64) []byte {
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(deletionVectorMagic))
+
+	var keys []uint32
+	bitmaps := map[uint32][]uint32{}
+	for _, row := range rows {
+		key := uint32(row >> 32)
+		if _, ok := bitmaps[key]; !ok {
+			keys = append(keys, key)
+		}
+		bitmaps[key] = append(bitmaps[key], uint32(row))
+	}
+	binary.Write(&buf, binary.LittleEndian, uint64(len(keys)))
+	for _, key := range keys {
+		binary.Write(&buf, binary.LittleEndian, key)
+		buf.Write(encodeRoaring32(bitmaps[key]))
+	}
+	return buf.Bytes()
+}
+
+// encodeRoaring32 writes sorted values in the portable roaring format without run containers
+func encodeRoaring32(values []uint32) []byte {
+	var keys []uint16
+	containers := map[uint16][]uint16{}
+	for _, v := range values {
+		key := uint16(v >> 16)
+		if _, ok := containers[key]; !ok {
+			keys = append(keys, key)
+		}
+		containers[key] = append(containers[key], uint16(v))
+	}
+
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(roaringSerialCookieNoRuns))
+	binary.Write(&buf, binary.LittleEndian, uint32(len(keys)))
+	for _, key := range keys {
+		binary.Write(&buf, binary.LittleEndian, key)
+		binary.Write(&buf, binary.LittleEndian, uint16(len(containers[key])-1))
+	}
+	offset := buf.Len() + 4*len(keys)
+	for _, key := range keys {
+		binary.Write(&buf, binary.LittleEndian, uint32(offset))
+		if len(containers[key]) > roaringMaxArraySize {
+			offset += 8192
+		} else {
+			offset += 2 * len(containers[key])
+		}
+	}
+	for _, key := range keys {
+		container := containers[key]
+		if len(container) > roaringMaxArraySize {
+			bitmap := make([]uint64, 1024)
+			for _, v := range container {
+				bitmap[v/64] |= 1 << (v % 64)
+			}
+			binary.Write(&buf, binary.LittleEndian, bitmap)
+		} else {
+			binary.Write(&buf, binary.LittleEndian, container)
+		}
+	}
+	return buf.Bytes()
+}
+
+// decodeDeletionVector reads row numbers out of a serialized RoaringBitmapArray
+func decodeDeletionVector(data []byte) ([]uint64, error) {
+	r := bytes.NewReader(data)
+	var magic uint32
+	var count uint64
+	if err := binary.Read(r, binary.LittleEndian, &magic); err != nil || magic != deletionVectorMagic {
+		return nil, fmt.Errorf("%w: bad magic number", errBadDeletionVector)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &count); err != nil {
+		return nil, fmt.Errorf("%w: %v", errBadDeletionVector, err)
+	}
+	var rows []uint64
+	for i := uint64(0); i < count; i++ {
+		var key uint32
+		if err := binary.Read(r, binary.LittleEndian, &key); err != nil {
+			return nil, fmt.Errorf("%w: %v", errBadDeletionVector, err)
+		}
+		values, err := decodeRoaring32(r)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range values {
+			rows = append(rows, uint64(key)<<32|uint64(v))
+		}
+	}
+	return rows, nil
+}
+
+// decodeRoaring32 reads one bitmap in the portable roaring format, with or without run containers
+func decodeRoaring32(r *bytes.Reader) ([]uint32, error) {
+	fail := func(err error) ([]uint32, error) {
+		return nil, fmt.Errorf("%w: %v", errBadDeletionVector, err)
+	}
+	var cookie uint32
+	if err := binary.Read(r, binary.LittleEndian, &cookie); err != nil {
+		return fail(err)
+	}
+	var size uint32
+	var runs []byte
+	hasOffsets := true
+	switch {
+	case cookie == roaringSerialCookieNoRuns:
+		if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+			return fail(err)
+		}
+	case cookie&0xFFFF == roaringSerialCookie:
+		size = cookie>>16 + 1
+		runs = make([]byte, (size+7)/8)
+		if _, err := r.Read(runs); err != nil {
+			return fail(err)
+		}
+		hasOffsets = size >= roaringNoOffsetThreshold
+	default:
+		return fail(fmt.Errorf("unknown cookie %d", cookie))
+	}
+
+	header := make([]uint16, 2*size)
+	if err := binary.Read(r, binary.LittleEndian, header); err != nil {
+		return fail(err)
+	}
+	if hasOffsets {
+		// containers follow each other, offsets are only needed for random access
+		if _, err := r.Seek(int64(4*size), io.SeekCurrent); err != nil {
+			return fail(err)
+		}
+	}
+
+	var values []uint32
+	for i := uint32(0); i < size; i++ {
+		high := uint32(header[2*i]) << 16
+		cardinality := int(header[2*i+1]) + 1
+		switch {
+		case runs != nil && runs[i/8]&(1<<(i%8)) != 0:
+			var numRuns uint16
+			if err := binary.Read(r, binary.LittleEndian, &numRuns); err != nil {
+				return fail(err)
+			}
+			pairs := make([]uint16, 2*int(numRuns))
+			if err := binary.Read(r, binary.LittleEndian, pairs); err != nil {
+				return fail(err)
+			}
+			for j := 0; j < len(pairs); j += 2 {
+				for v := uint32(pairs[j]); v <= uint32(pairs[j])+uint32(pairs[j+1]); v++ {
+					values = append(values, high|v)
+				}
+			}
+		case cardinality > roaringMaxArraySize:
+			bitmap := make([]uint64, 1024)
+			if err := binary.Read(r, binary.LittleEndian, bitmap); err != nil {
+				return fail(err)
+			}
+			for word, bits := range bitmap {
+				for bit := 0; bits != 0; bit, bits = bit+1, bits>>1 {
+					if bits&1 != 0 {
+						values = append(values, high|uint32(word*64+bit))
+					}
+				}
+			}
+		default:
+			array := make([]uint16, cardinality)
+			if err := binary.Read(r, binary.LittleEndian, array); err != nil {
+				return fail(err)
+			}
+			for _, v := range array {
+				values = append(values, high|uint32(v))
+			}
+		}
+	}
+	return values, nil
+}
+
+// deletionVectorFile is the content of a deletion vector file holding a single serialized vector
+// at offset 1: version byte, big-endian size, the vector, big-endian crc32 of it
+func deletionVectorFile(serialized []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(deletionVectorFileVersion)
+	binary.Write(&buf, binary.BigEndian, uint32(len(serialized)))
+	buf.Write(serialized)
+	binary.Write(&buf, binary.BigEndian, crc32.ChecksumIEEE(serialized))
+	return buf.Bytes()
+}
+
+// deletionVectorFromFile extracts the serialized vector dv points to in a deletion vector file
+func deletionVectorFromFile(data []byte, dv *deletionVector) ([]byte, error) {
+	offset := 1
+	if dv.Offset != nil {
+		offset = int(*dv.Offset)
+	}
+	end := offset + 4 + int(dv.SizeInBytes) + 4
+	if len(data) == 0 || data[0] != deletionVectorFileVersion || offset < 1 || end > len(data) {
+		return nil, fmt.Errorf("%w: bad file", errBadDeletionVector)
+	}
+	if size := binary.BigEndian.Uint32(data[offset:]); size != uint32(dv.SizeInBytes) {
+		return nil, fmt.Errorf("%w: size %d doesn't match %d", errBadDeletionVector, size, dv.SizeInBytes)
+	}
+	serialized := data[offset+4 : end-4]
+	if crc32.ChecksumIEEE(serialized) != binary.BigEndian.Uint32(data[end-4:]) {
+		return nil, fmt.Errorf("%w: checksum mismatch", errBadDeletionVector)
+	}
+	return serialized, nil
+}
+
+// mergeRows unions sorted row numbers
+func mergeRows(a, b []uint64) []uint64 {
+	rows := slices.Concat(a, b)
+	slices.Sort(rows)
+	return slices.Compact(rows)
+}
+
+const z85Alphabet = "0123456789abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ.-:+=^!/*?&<>()[]{}@%$#"
+
+// z85Encode encodes data the way delta lake does, padding it with zeros to a multiple of 4 bytes
+func z85Encode(data []byte) string {
+	padded := append(slices.Clone(data), make([]byte, (4-len(data)%4)%4)...)
+	var sb strings.Builder
+	for i := 0; i < len(padded); i += 4 {
+		value := binary.BigEndian.Uint32(padded[i:])
+		var chunk [5]byte
+		for j := 4; j >= 0; j-- {
+			chunk[j] = z85Alphabet[value%85]
+			value /= 85
+		}
+		sb.Write(chunk[:])
+	}
+	return sb.String()
+}
+
+// z85Decode decodes a z85 string, including any zero padding z85Encode added
+func z85Decode(s string) ([]byte, error) {
+	if len(s)%5 != 0 {
+		return nil, fmt.Errorf("%w: z85 length %d", errBadDeletionVector, len(s))
+	}
+	data := make([]byte, 0, len(s)/5*4)
+	for i := 0; i < len(s); i += 5 {
+		var value uint64
+		for _, c := range []byte(s[i : i+5]) {
+			digit := strings.IndexByte(z85Alphabet, c)
+			if digit < 0 {
+				return nil, fmt.Errorf("%w: z85 character %q", errBadDeletionVector, c)
+			}
+			value = value*85 + uint64(digit)
+		}
+		if value > 0xFFFFFFFF {
+			return nil, fmt.Errorf("%w: z85 overflow", errBadDeletionVector)
+		}
+		data = binary.BigEndian.AppendUint32(data, uint32(value))
+	}
+	return data, nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeletionVectorRelativePath(t *testing.T) {
+	// example from the delta lake protocol
+	dv := &deletionVector{StorageType: "u", PathOrInlineDv: "ab^-aqEH.-t@S}K{vb[*k^"}
+	path, err := dv.relativePath()
+	assert.NoError(t, err)
+	assert.Equal(t, "ab/deletion_vector_d2c639aa-8816-431a-aaf6-d3fe2512ff61.bin", path)
+
+	_, err = (&deletionVector{StorageType: "i", PathOrInlineDv: "wi5b=000010000siXQKl0rr91000f55c8Xg0@@D72lkbi5=-{L"}).relativePath()
+	assert.ErrorIs(t, err, errBadDeletionVector)
+}
+
+func TestZ85(t *testing.T) {
+	// example from the z85 spec
+	data := []byte{0x86, 0x4F, 0xD2, 0x6F, 0xB5, 0x59, 0xF7, 0x5B}
+	assert.Equal(t, "HelloWorld", z85Encode(data))
+	decoded, err := z85Decode("HelloWorld")
+	assert.NoError(t, err)
+	assert.Equal(t, data, decoded)
+
+	// padded to a multiple of 4 bytes
+	decoded, err = z85Decode(z85Encode([]byte{1, 2, 3}))
+	assert.NoError(t, err)
+	assert.Equal(t, []byte{1, 2, 3, 0}, decoded)
+}
+
+func TestDeletionVectorRoundTrip(t *testing.T) {
+	// array containers, a bitmap container and a second 32-bit bitmap
+	rows := []uint64{0, 3, 65536, 1<<32 + 7}
+	for i := uint64(0); i < 5000; i++ {
+		rows = append(rows, 200000+i*2)
+	}
+	rows = mergeRows(rows, nil)
+
+	decoded, err := decodeDeletionVector(encodeDeletionVector(rows))
+	assert.NoError(t, err)
+	assert.Equal(t, rows, decoded)
+
+	file := deletionVectorFile(encodeDeletionVector(rows))
+	offset := int32(1)
+	dv := &deletionVector{StorageType: "u", Offset: &offset, SizeInBytes: int32(len(file) - 9)}
+	serialized, err := deletionVectorFromFile(file, dv)
+	assert.NoError(t, err)
+	assert.Equal(t, encodeDeletionVector(rows), serialized)
+
+	file[len(file)-1] ^= 0xFF
+	_, err = deletionVectorFromFile(file, dv)
+	assert.ErrorIs(t, err, errBadDeletionVector)
+}
+
+func TestDeletionVectorRunContainer(t *testing.T) {
+	// other writers run-optimize their bitmaps, here one run container of 5..7
+	var buf bytes.Buffer
+	binary.Write(&buf, binary.LittleEndian, uint32(deletionVectorMagic))
+	binary.Write(&buf, binary.LittleEndian, uint64(1))
+	binary.Write(&buf, binary.LittleEndian, uint32(0))
+	binary.Write(&buf, binary.LittleEndian, uint32(roaringSerialCookie))
+	buf.WriteByte(1)
+	binary.Write(&buf, binary.LittleEndian, []uint16{0, 2, 1, 5, 2})
+
+	rows, err := decodeDeletionVector(buf.Bytes())
+	assert.NoError(t, err)
+	assert.Equal(t, []uint64{5, 6, 7}, rows)
+}
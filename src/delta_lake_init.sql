@@ -5,38 +5,88 @@ CREATE TABLE log_json(
     protocol JSON,
     metaData STRUCT(
         id UUID,
-        format STRUCT(provider VARCHAR, "options" MAP(VARCHAR, JSON)),
+        format STRUCT(provider VARCHAR, "options" MAP(VARCHAR, VARCHAR)),
         schemaString VARCHAR,
-        partitionColumns JSON[],
+        partitionColumns VARCHAR[],
         createdTime BIGINT,
-        duckpond STRUCT(createTable VARCHAR),
-        "configuration" MAP(VARCHAR, JSON)
+        duckpond STRUCT(createTable VARCHAR, partitionBy STRUCT(name VARCHAR, expression VARCHAR)[]),
+        "configuration" MAP(VARCHAR, VARCHAR)
     ),
     "add" STRUCT(
         path VARCHAR,
-        partitionValues MAP(VARCHAR, JSON),
+        partitionValues MAP(VARCHAR, VARCHAR),
         size BIGINT,
         modificationTime BIGINT,
         dataChange BOOLEAN,
-        stats VARCHAR
+        stats VARCHAR,
+        deletionVector STRUCT(storageType VARCHAR, pathOrInlineDv VARCHAR, "offset" INTEGER, sizeInBytes INTEGER, cardinality BIGINT)
     ),
     remove STRUCT(
         path VARCHAR,
         dataChange BOOLEAN,
         deletionTimestamp BIGINT,
         extendedFileMetadata BOOLEAN,
-        partitionValues MAP(VARCHAR, JSON),
-        size BIGINT
-    )
+        partitionValues MAP(VARCHAR, VARCHAR),
+        size BIGINT,
+        deletionVector STRUCT(storageType VARCHAR, pathOrInlineDv VARCHAR, "offset" INTEGER, sizeInBytes INTEGER, cardinality BIGINT)
+    ),
+    -- idempotent write of an application, see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#transaction-identifiers
+    txn STRUCT(appId VARCHAR, version BIGINT, lastUpdated BIGINT),
+    commitInfo JSON,
+    -- not a delta lake action: commit the row was read from, NULL while staged for the next commit
+    version BIGINT
 );
 
-SET VARIABLE log_json_etag = '';
+-- latest commit imported into or exported from log_json, -1 when table has no commits
+SET VARIABLE log_version = -1;
 
--- Initial protocol version entry
-INSERT INTO log_json (protocol)
-VALUES (struct_pack(
+-- Initial protocol version entry, staged with the first commit of a table
+CREATE MACRO delta_protocol() AS
+    struct_pack(
         minReaderVersion := 3,
         minWriterVersion := 7,
-        readerFeatures := ['timestampNtz'],
-        writerFeatures := ['timestampNtz']
-        )::json);
+        readerFeatures := ['deletionVectors', 'timestampNtz', 'columnMapping'],
+        writerFeatures := ['deletionVectors', 'timestampNtz', 'columnMapping']
+        )::json;
+
+-- newest action for each file as of version v, staged actions count as newer than any commit
+-- live files end with an add, tombstones with a remove. Within a commit an add wins over a remove,
+-- staged actions, maybe of several statements of BEGIN ... COMMIT, go by the order they were staged in
+CREATE MACRO file_actions_at(v) AS TABLE
+    SELECT coalesce("add".path, remove.path) AS path, "add", remove, version
+    FROM log_json
+    WHERE ("add" IS NOT NULL OR remove IS NOT NULL)
+        AND coalesce(version, 9223372036854775807) <= v
+    QUALIFY row_number() OVER (
+        PARTITION BY coalesce("add".path, remove.path)
+        ORDER BY version DESC NULLS FIRST, CASE WHEN version IS NULL THEN rowid END DESC NULLS LAST,
+            "add" IS NOT NULL DESC, rowid DESC
+    ) = 1;
+
+-- when each version was committed, in epoch ms, from its commitInfo
+-- or judging by timestamps of its actions for commits without one
+CREATE VIEW commit_timestamps AS
+    SELECT version, coalesce(
+        max((commitInfo->>'timestamp')::BIGINT),
+        max(greatest("add".modificationTime, remove.deletionTimestamp, metaData.createdTime))
+    ) AS timestamp
+    FROM log_json
+    WHERE version IS NOT NULL
+    GROUP BY version;
+
+-- min/max of column col as text according to add.stats, NULL when unknown.
+-- stats are minValues/maxValues keyed by column, or a list of col_name/min/max
+-- in files written before duckpond followed delta's format
+CREATE MACRO stats_column(stats, col) AS
+    list_filter(
+        json_extract(CASE WHEN json_valid(stats) THEN stats END::VARCHAR, '$.stats[*]')::JSON[],
+        s -> json_extract_string(s, 'col_name') = col
+    )[1];
+CREATE MACRO stats_value(stats, kind, col) AS
+    (CASE WHEN json_valid(stats) THEN stats END::VARCHAR::JSON -> kind) ->> col;
+CREATE MACRO stats_min(stats, col) AS coalesce(
+    stats_value(stats, 'minValues', col),
+    json_extract_string(stats_column(stats, col), 'min'));
+CREATE MACRO stats_max(stats, col) AS coalesce(
+    stats_value(stats, 'maxValues', col),
+    json_extract_string(stats_column(stats, col), 'max'));
@@ -0,0 +1,33 @@
+-- DESCRIBE HISTORY: what each commit in log_json did, newest first
+-- commits replaced by a checkpoint show up as a single version
+WITH file_rows AS (
+    -- rows in each file according to stats of its add
+    SELECT "add".path AS path, any_value(CASE WHEN json_valid("add".stats) THEN ("add".stats->>'numRecords')::BIGINT END) AS num_records
+    FROM log_json
+    WHERE "add" IS NOT NULL
+    GROUP BY "add".path
+)
+SELECT
+    l.version,
+    epoch_ms(any_value(t.timestamp)) AS timestamp,
+    -- commits written before commitInfo was recorded get an operation guessed from their actions
+    coalesce(any_value(l.commitInfo->>'operation'), CASE
+        WHEN count(l.metaData) > 0 THEN 'CREATE TABLE'
+        WHEN count(l.remove) > 0 THEN 'VACUUM'
+        ELSE 'INSERT'
+    END) AS operation,
+    any_value(l.commitInfo->'operationParameters') AS operation_parameters,
+    count(l."add") AS files_added,
+    count(l.remove) AS files_removed,
+    coalesce(sum(l."add".size), 0)::BIGINT AS bytes_added,
+    coalesce(sum(l.remove.size), 0)::BIGINT AS bytes_removed,
+    -- without rows deletion vectors mark deleted
+    coalesce(sum(added.num_records - coalesce(l."add".deletionVector.cardinality, 0)), 0)::BIGINT AS rows_added,
+    coalesce(sum(removed.num_records - coalesce(l.remove.deletionVector.cardinality, 0)), 0)::BIGINT AS rows_removed
+FROM log_json l
+JOIN commit_timestamps t ON t.version = l.version
+LEFT JOIN file_rows added ON added.path = l."add".path
+LEFT JOIN file_rows removed ON removed.path = l.remove.path
+WHERE l.version IS NOT NULL
+GROUP BY l.version
+ORDER BY l.version DESC;
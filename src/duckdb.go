@@ -65,19 +65,12 @@ func ProcessExtensions(db *sql.DB, install bool) error {
 //go:embed duckdb-uuidv7/uuidv7.sql
 var uuid_v7_macro string
 
-//go:embed delta_stats.sql
-var delta_stats string
-
 // loadMacros loads all required DuckDB macros
 func loadMacros(db *sql.DB) error {
 	// Load uuid_v7_macro
 	if _, err := db.Exec(uuid_v7_macro); err != nil {
 		return fmt.Errorf("failed to load UUIDv7 macro: %w", err)
 	}
-	// Load delta_stats
-	if _, err := db.Exec(delta_stats); err != nil {
-		return fmt.Errorf("failed to load delta_stats macro: %w", err)
-	}
 	return nil
 }
 
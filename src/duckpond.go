@@ -8,7 +8,10 @@ import (
 	"io"
 	"net/http"
 	"os"
+	"slices"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
@@ -40,10 +43,41 @@ type QueryResponse struct {
 	Data       [][]interface{} `json:"data"` // Always initialized as []
 	Rows       int             `json:"rows"`
 	Statistics struct {
-		Elapsed float64 `json:"elapsed"` // in seconds
+		Elapsed     float64 `json:"elapsed"`      // in seconds
+		FilesPruned int     `json:"files_pruned"` // parquet files SELECT skipped by their stats
 	} `json:"statistics"`
 }
 
+// StatementResult is the result of one statement of a request with results=all
+type StatementResult struct {
+	Statement int    `json:"statement"` // index of the statement in the request
+	Query     string `json:"query"`
+	QueryResponse
+	// rows INSERT, MERGE, DELETE or UPDATE changed
+	AffectedRows *int64 `json:"affected_rows,omitempty"`
+}
+
+// StatementError is the failure of a request with results=all
+type StatementError struct {
+	Statement int    `json:"statement"` // index of the failing statement
+	Message   string `json:"message"`
+}
+
+// StatementResults is the response of a request with results=all,
+// results of the statements that ran before the one that failed when Error is set
+type StatementResults struct {
+	Results []StatementResult `json:"results"`
+	Error   *StatementError   `json:"error,omitempty"`
+}
+
+// QueryOptions are per request options of /query
+type QueryOptions struct {
+	// makes writes idempotent, see SET duckpond.txn
+	Txn *Txn
+	// respond with StatementResults instead of the last statement's result
+	AllResults bool
+}
+
 type IceBaseOptions struct {
 	storageDir           string
 	enableQuerySplitting bool
@@ -64,6 +98,9 @@ func WithQuerySplittingEnabled() IceBaseOption {
 }
 
 type DuckpondDB struct {
+	// requests take turns, they share DATA and the logs map. Background maintenance only holds it
+	// to pick a table, whose Log.mu it holds while maintaining it.
+	mu         sync.Mutex
 	dataDB     *sql.DB
 	parser     *Parser
 	logs       map[string]*Log
@@ -72,7 +109,12 @@ type DuckpondDB struct {
 	authToken  string
 }
 
-func (ib *DuckpondDB) ExecuteQuery(query string, dataTx *sql.Tx) (*QueryResponse, error) {
+// queryer is what ExecuteQuery runs queries on: a DATA transaction or a LOG database
+type queryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+func (ib *DuckpondDB) ExecuteQuery(query string, dataTx queryer) (*QueryResponse, error) {
 	start := time.Now()
 
 	// Initialize response with empty data slice
@@ -305,7 +347,12 @@ func SplitNonEmptyQueries(body string) []string {
 	return filtered
 }
 
-func (ib *DuckpondDB) handleQuery(body string) (string, error) {
+// handleQuery runs the queries of body, INSERTs and MERGEs are made idempotent by txn when given
+// or by a preceding `SET duckpond.txn = 'appId:version'`
+func (ib *DuckpondDB) handleQuery(body string, options QueryOptions) (string, error) {
+	ib.mu.Lock()
+	defer ib.mu.Unlock()
+
 	// Concise logging for query splitting and storage dir
 	log.Info().
 		Bool("query_splitting", ib.options.enableQuerySplitting).
@@ -318,6 +365,19 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 	var response *QueryResponse
 	var filteredQueries []string
 	var err error
+	txn := options.Txn
+	var results []StatementResult
+	// within BEGIN ... COMMIT, logs of the tables used so far, their writes are committed by COMMIT
+	inTransaction := false
+	var transaction []*Log
+	beganAt := 0
+	// logs of the tables used so far, locked until the request ends
+	var locked []*Log
+	defer func() {
+		for _, l := range locked {
+			l.mu.Unlock()
+		}
+	}()
 
 	if ib.options.enableQuerySplitting {
 		filteredQueries = SplitNonEmptyQueries(body)
@@ -327,8 +387,16 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 	}
 
 	log.Debug().Strs("filteredQueries", filteredQueries).Int("total_queries", len(filteredQueries)).Msg("handleQuery")
+	if i, err := ib.checkTxnReuse(filteredQueries, txn); err != nil {
+		if options.AllResults {
+			return statementResultsJSON(nil, &StatementError{Statement: i, Message: err.Error()}, err)
+		}
+		return "", err
+	}
 	for i, q := range filteredQueries {
 		query := q // Already trimmed and filtered
+		start := time.Now()
+		op := OpUnknown
 
 		var handlerErr error
 		func() {
@@ -345,7 +413,64 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 				}
 			}()
 
-			op, table := ib.parser.Parse(query)
+			setTxn, err := ib.parser.ParseSetTxn(query)
+			if err != nil {
+				handlerErr = err
+				return
+			}
+			if setTxn != nil {
+				txn = setTxn
+				response = &QueryResponse{Data: make([][]interface{}, 0)}
+				return
+			}
+
+			query, timeTravel := ib.parser.ParseTimeTravel(query)
+			var table string
+			op, table = ib.parser.Parse(query)
+			var merge *Merge
+			if op == OpMerge {
+				// duckdb can't run MERGE, it runs the equivalent INSERT instead
+				if merge, handlerErr = ib.parser.ParseMerge(query); handlerErr != nil {
+					return
+				}
+				query, op = merge.Insert, OpInsert
+			}
+			var partitionBy []PartitionColumn
+			if op == OpCreateTable {
+				if query, partitionBy, handlerErr = ib.parser.ParsePartitionBy(query); handlerErr != nil {
+					return
+				}
+			}
+			if timeTravel != nil && op != OpSelect {
+				handlerErr = fmt.Errorf("VERSION/TIMESTAMP AS OF is only supported in SELECT")
+				return
+			}
+			switch op {
+			case OpBegin, OpCommit, OpRollback:
+				response = &QueryResponse{Data: make([][]interface{}, 0)}
+				if op == OpBegin && inTransaction {
+					handlerErr = fmt.Errorf("BEGIN within a transaction")
+					return
+				}
+				if op != OpBegin && !inTransaction {
+					handlerErr = fmt.Errorf("%s without BEGIN", strings.ToUpper(op.String()))
+					return
+				}
+				inTransaction = op == OpBegin
+				beganAt = i
+				if op == OpCommit {
+					handlerErr = ib.commitTransaction(transaction)
+				} else if op == OpRollback {
+					ib.abortTransaction(transaction)
+				}
+				transaction = nil
+				return
+			case OpCreateTable, OpAlterTable, OpDropTable, OpVacuum, OpOptimize, OpRestore:
+				if inTransaction {
+					handlerErr = fmt.Errorf("%s isn't supported within BEGIN ... COMMIT", strings.ToUpper(strings.ReplaceAll(op.String(), "_", " ")))
+					return
+				}
+			}
 			log.Info().
 				Int("i", i).
 				Str("op", op.String()).
@@ -357,12 +482,23 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 			response = &QueryResponse{Data: make([][]interface{}, 0)}
 
 			var dblog *Log
+			filesPruned := 0
 			if table != "" {
 				dblog, handlerErr = ib.logByName(table)
 				if handlerErr != nil {
 					log.Error().Err(handlerErr).Str("table", table).Msg("Failed to get table log")
 					return
 				}
+				if !slices.Contains(locked, dblog) {
+					dblog.mu.Lock()
+					locked = append(locked, dblog)
+				}
+				if inTransaction && dblog.pending == nil {
+					if handlerErr = dblog.begin(); handlerErr != nil {
+						return
+					}
+					transaction = append(transaction, dblog)
+				}
 			}
 			if op == OpDropTable {
 				dblog, err := ib.logByName(table)
@@ -383,12 +519,70 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 				return
 			}
 
+			if op == OpDescribeHistory {
+				logDB, err := dblog.importedLogDB()
+				if err != nil {
+					handlerErr = fmt.Errorf("DESCRIBE HISTORY failed for %s: %w", table, err)
+					return
+				}
+				// history comes from the LOG database, DATA isn't involved
+				response, handlerErr = ib.ExecuteQuery(query_describe_history, logDB)
+				return
+			}
+
+			if op == OpRestore {
+				target := ib.parser.ParseRestore(query)
+				if target == nil {
+					handlerErr = fmt.Errorf("RESTORE requires TO VERSION AS OF n or TO TIMESTAMP AS OF '...'")
+					return
+				}
+				if handlerErr = dblog.Restore(target); handlerErr != nil {
+					handlerErr = fmt.Errorf("RESTORE failed for %s: %w", table, handlerErr)
+				}
+				return
+			}
+
+			// Duckdb doesn't actually support vacuum yet, so fake it
+			if op == OpVacuum {
+				if table == "" {
+					handlerErr = fmt.Errorf("VACUUM requires a table name")
+					return
+				}
+				vacuum, err := ib.parser.ParseVacuum(query)
+				if err != nil {
+					handlerErr = err
+					return
+				}
+				if vacuum.DryRun {
+					files, err := dblog.VacuumDryRun(vacuum.Retain)
+					if err != nil {
+						handlerErr = fmt.Errorf("VACUUM failed: %w", err)
+						return
+					}
+					paths := make([]string, len(files))
+					for i, file := range files {
+						paths[i] = quoteSQLString(file)
+					}
+					response, handlerErr = ib.ExecuteQuery(fmt.Sprintf("SELECT unnest([%s]::VARCHAR[]) AS path", strings.Join(paths, ", ")), dataTx)
+					return
+				}
+				if handlerErr = dblog.Vacuum(vacuum.Retain); handlerErr != nil {
+					handlerErr = fmt.Errorf("VACUUM failed: %w", handlerErr)
+				}
+				return
+			}
+
 			if dblog != nil {
-				opExpectsTableToExist := op == OpSelect || op == OpVacuum
+				opExpectsTableToExist := op == OpSelect
 				tableIsEmpty := false
 				if opExpectsTableToExist {
 					// Recreate view using LOG database's file list in DATA transaction
-					if handlerErr = dblog.CreateViewOfParquet(dataTx); handlerErr != nil {
+					// SELECT only reads files that can have rows it selects
+					selectQuery := ""
+					if op == OpSelect {
+						selectQuery = query
+					}
+					if filesPruned, handlerErr = dblog.CreateViewOfParquet(dataTx, timeTravel, selectQuery); handlerErr != nil {
 						isErrNoParquetFilesInTable := errors.Is(handlerErr, ErrNoParquetFilesInTable)
 						if isErrNoParquetFilesInTable {
 							tableIsEmpty = true
@@ -409,27 +603,55 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 				}
 			}
 
-			// Duckdb doesn't actually support vacuum yet, so fake it
-			if op == OpVacuum {
-				if table == "" {
-					handlerErr = fmt.Errorf("VACUUM requires a table name")
+			if op == OpAlterTable && dblog != nil {
+				properties, err := ib.parser.ParseTableProperties(query)
+				if err != nil {
+					handlerErr = err
 					return
 				}
-
-				dblog, handlerErr = ib.logByName(table)
-				if handlerErr != nil {
-					handlerErr = fmt.Errorf("failed to get log for VACUUM: %w", handlerErr)
+				if properties != nil {
+					if handlerErr = dblog.SetTableProperties(properties); handlerErr != nil {
+						handlerErr = fmt.Errorf("ALTER TABLE failed for %s: %w", table, handlerErr)
+					}
 					return
 				}
-
-				// Call merge on the log with table name
-				if handlerErr = dblog.Merge(table, dataTx); handlerErr != nil {
-					handlerErr = fmt.Errorf("VACUUM failed: %w", handlerErr)
+				name, err := ib.parser.ParseAlterTable(query)
+				if err != nil {
+					handlerErr = err
+					return
+				}
+				if handlerErr = dblog.AlterTable(dataTx, query, commitOperation{Name: name}); handlerErr != nil {
+					handlerErr = fmt.Errorf("ALTER TABLE failed for %s: %w", table, handlerErr)
 					return
 				}
-
-				// Return empty response since VACUUM doesn't produce data
 				response = &QueryResponse{Data: make([][]interface{}, 0)}
+			} else if op == OpOptimize && dblog != nil {
+				optimize, err := ib.parser.ParseOptimize(query)
+				if err != nil {
+					handlerErr = err
+					return
+				}
+				metrics, err := dblog.Optimize(dataTx, optimize)
+				if err != nil {
+					handlerErr = fmt.Errorf("OPTIMIZE failed for %s: %w", table, err)
+					return
+				}
+				response, handlerErr = ib.ExecuteQuery(fmt.Sprintf(
+					`SELECT %d::BIGINT AS "numFilesAdded", %d::BIGINT AS "numFilesRemoved"`, metrics.FilesAdded, metrics.FilesRemoved), dataTx)
+			} else if op == OpDelete || op == OpUpdate {
+				statement := strings.ToUpper(op.String())
+				if dblog == nil {
+					handlerErr = fmt.Errorf("%s requires a table name", statement)
+					return
+				}
+				operation := commitOperation{Name: statement, Parameters: map[string]string{"predicate": topLevelWhere(query)}}
+				affected, err := dblog.RewriteFiles(dataTx, query, operation)
+				if err != nil {
+					handlerErr = fmt.Errorf("%s failed for %s: %w", statement, table, err)
+					return
+				}
+				// same shape of response as duckdb gives for DML
+				response, handlerErr = ib.ExecuteQuery(fmt.Sprintf(`SELECT %d::BIGINT AS "Count"`, affected), dataTx)
 			} else {
 				// Execute query against DATA database
 				response, handlerErr = ib.ExecuteQuery(query, dataTx)
@@ -437,28 +659,71 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 					log.Error().Err(handlerErr).Str("query", query).Msg("Query execution failed")
 					return
 				}
+				response.Statistics.FilesPruned = filesPruned
 			}
 			if op == OpCreateTable && dblog != nil {
 				// Log schema change to LOG database
-				if handlerErr = dblog.logDDL(dataTx, query); handlerErr != nil {
+				if handlerErr = dblog.logDDL(dataTx, query, partitionBy); handlerErr != nil {
 					log.Error().Err(handlerErr).Str("table", table).Msg("Failed to log table creation")
 					return
 				}
 			}
 
 			if op == OpInsert && dblog != nil {
+				conflict := ib.parser.ParseOnConflict(query)
+				operation := commitOperation{Name: "INSERT", Parameters: map[string]string{"mode": conflict.String()}}
+				if merge != nil {
+					keys, err := primaryKeyColumns(dataTx, table)
+					if err != nil {
+						handlerErr = err
+						return
+					}
+					if !slices.Equal(lowered(keys), lowered(merge.Keys)) {
+						handlerErr = fmt.Errorf("MERGE INTO %s has to match rows by its primary key (%s)", table, strings.Join(keys, ", "))
+						return
+					}
+					operation = commitOperation{Name: "MERGE", Parameters: map[string]string{"predicate": merge.Predicate}}
+				}
 				// Log insert to LOG database while executing in DATA transaction
-				if handlerErr = dblog.Insert(dataTx, table); handlerErr != nil {
+				inserted, err := dblog.Insert(dataTx, table, conflict, operation, txn)
+				if err != nil {
+					handlerErr = err
 					log.Error().Err(handlerErr).Str("table", table).Msg("Failed to log insert")
 					return
 				}
+				if affectedRows(op, response) != nil {
+					// duckdb counted rows inserted in memory, rows ignored for persisted keys or by a committed txn weren't
+					response, handlerErr = ib.ExecuteQuery(fmt.Sprintf(`SELECT %d::BIGINT AS "Count"`, inserted), dataTx)
+				}
 			}
 			// No commit because log handles data persistence above
 		}()
 
 		if handlerErr != nil {
+			if inTransaction {
+				ib.abortTransaction(transaction)
+			}
+			if options.AllResults {
+				return statementResultsJSON(results, &StatementError{Statement: i, Message: handlerErr.Error()}, handlerErr)
+			}
 			return "", handlerErr
 		}
+		if options.AllResults {
+			result := StatementResult{Statement: i, Query: q, QueryResponse: *response, AffectedRows: affectedRows(op, response)}
+			result.Statistics.Elapsed = time.Since(start).Seconds()
+			results = append(results, result)
+		}
+	}
+	if inTransaction {
+		ib.abortTransaction(transaction)
+		err := fmt.Errorf("BEGIN without COMMIT, the transaction was rolled back")
+		if options.AllResults {
+			return statementResultsJSON(results, &StatementError{Statement: beganAt, Message: err.Error()}, err)
+		}
+		return "", err
+	}
+	if options.AllResults {
+		return statementResultsJSON(results, nil, nil)
 	}
 
 	jsonData, err := json.Marshal(response)
@@ -470,6 +735,65 @@ func (ib *DuckpondDB) handleQuery(body string) (string, error) {
 	return string(jsonData), nil
 }
 
+// checkTxnReuse fails when a write of a table would be skipped as a retry of an earlier write of
+// the request: one with a txn of the same app and the same or a later version. It runs before any
+// statement, so such a request writes nothing and a retry of it can't end up half done.
+// Returns the index of the statement reusing the txn.
+func (ib *DuckpondDB) checkTxnReuse(queries []string, txn *Txn) (int, error) {
+	type appTable struct{ appID, table string }
+	// latest version of each app used for each table
+	used := map[appTable]int64{}
+	for i, query := range queries {
+		setTxn, err := ib.parser.ParseSetTxn(query)
+		if err != nil {
+			return i, err
+		}
+		if setTxn != nil {
+			txn = setTxn
+			continue
+		}
+		op, table := ib.parser.Parse(query)
+		if txn == nil || (op != OpInsert && op != OpMerge) {
+			continue
+		}
+		key := appTable{txn.AppID, table}
+		if version, ok := used[key]; ok && version >= txn.Version {
+			return i, fmt.Errorf("duckpond.txn %s:%d was already used for %s, SET a later version for each write of a table",
+				txn.AppID, version, table)
+		}
+		used[key] = txn.Version
+	}
+	return -1, nil
+}
+
+// statementResultsJSON marshals the response of a request with results=all, returning it along with
+// the error of the failed statement
+func statementResultsJSON(results []StatementResult, failed *StatementError, err error) (string, error) {
+	if results == nil {
+		results = []StatementResult{}
+	}
+	jsonData, marshalErr := json.Marshal(StatementResults{Results: results, Error: failed})
+	if marshalErr != nil {
+		return "", fmt.Errorf("failed to marshal JSON: %w", marshalErr)
+	}
+	return string(jsonData), err
+}
+
+// affectedRows is the row count of DML, duckdb, Insert and RewriteFiles respond with it as a single "Count" column
+func affectedRows(op Operation, response *QueryResponse) *int64 {
+	if op != OpInsert && op != OpDelete && op != OpUpdate {
+		return nil
+	}
+	if len(response.Meta) != 1 || response.Meta[0].Name != "Count" || len(response.Data) != 1 {
+		return nil
+	}
+	count, err := strconv.ParseInt(fmt.Sprint(response.Data[0][0]), 10, 64)
+	if err != nil {
+		return nil
+	}
+	return &count
+}
+
 func (ib *DuckpondDB) handleParse(body string) (string, error) {
 	op, table := ib.parser.Parse(body)
 
@@ -489,9 +813,15 @@ func (ib *DuckpondDB) handleParse(body string) (string, error) {
 }
 
 func (ib *DuckpondDB) PostEndpoint(endpoint string, body string) (string, error) {
+	return ib.PostEndpointWithOptions(endpoint, body, QueryOptions{})
+}
+
+// PostEndpointWithOptions is PostEndpoint with options of /query. With options.AllResults,
+// a failing statement's error comes with the StatementResults JSON saying which one it was.
+func (ib *DuckpondDB) PostEndpointWithOptions(endpoint string, body string, options QueryOptions) (string, error) {
 	switch endpoint {
 	case "/query":
-		return ib.handleQuery(body)
+		return ib.handleQuery(body, options)
 	case "/parse":
 		return ib.handleParse(body)
 	default:
@@ -533,7 +863,7 @@ func (ib *DuckpondDB) RequestHandler() http.HandlerFunc {
 		// Set CORS headers
 		lrw.Header().Set("Access-Control-Allow-Origin", "*")
 		lrw.Header().Set("Access-Control-Allow-Methods", "POST, GET, OPTIONS")
-		lrw.Header().Set("Access-Control-Allow-Headers", "Content-Type")
+		lrw.Header().Set("Access-Control-Allow-Headers", "Content-Type, Idempotency-Key")
 
 		// If BEARER_TOKEN is set, enforce auth checking
 		if ib.authToken != "" {
@@ -562,7 +892,23 @@ func (ib *DuckpondDB) RequestHandler() http.HandlerFunc {
 			return
 		}
 
-		jsonResponse, err := ib.PostEndpoint(r.URL.Path, string(body))
+		// retries of a request with the same key don't write again
+		var txn *Txn
+		if key := r.Header.Get("Idempotency-Key"); key != "" {
+			txn = IdempotencyKeyTxn(key)
+		}
+
+		// results=all responds with the result of every statement instead of the last one
+		options := QueryOptions{Txn: txn, AllResults: r.URL.Query().Get("results") == "all"}
+		jsonResponse, err := ib.PostEndpointWithOptions(r.URL.Path, string(body), options)
+		if err != nil && jsonResponse != "" {
+			lrw.Header().Set("Content-Type", "application/json")
+			lrw.WriteHeader(http.StatusBadRequest)
+			if _, err := lrw.Write([]byte(jsonResponse)); err != nil {
+				log.Error().Err(err).Msg("Failed to write response")
+			}
+			return
+		}
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
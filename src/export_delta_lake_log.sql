@@ -1,7 +1,20 @@
-WITH json_data AS (
-    -- first convert struct columns to json so all columns have same type
-    select data::json as data from (SELECT * from log_json) data
+WITH staged AS (
+    -- actions staged since the last commit, each as a single-key json object
+    SELECT rowid, CASE
+        WHEN commitInfo IS NOT NULL THEN 0
+        WHEN protocol IS NOT NULL THEN 1
+        ELSE 2
+    END AS ordinal, CASE
+        WHEN commitInfo IS NOT NULL THEN json_object('commitInfo', commitInfo)
+        WHEN protocol IS NOT NULL THEN json_object('protocol', protocol)
+        WHEN metaData IS NOT NULL THEN json_object('metaData', metaData)
+        WHEN "add" IS NOT NULL THEN json_object('add', "add")
+        WHEN remove IS NOT NULL THEN json_object('remove', remove)
+        WHEN txn IS NOT NULL THEN json_object('txn', txn)
+    END AS action
+    FROM log_json
+    WHERE version IS NULL
 )
--- only one of the columns in table has non-null value, use it
--- then create jsonl by joining with \n
-SELECT string_agg(data, E'\n') FROM json_data;
\ No newline at end of file
+-- commitInfo and protocol go first like in other writers, then create jsonl by joining with \n
+-- NULL when nothing is staged
+SELECT string_agg(action, E'\n' ORDER BY ordinal, rowid) FROM staged;
@@ -1,15 +1,4 @@
-WITH files AS (
-  SELECT 
-    add.path AS added, 
-    remove.path AS removed 
-  FROM log_json
-)
-SELECT added
-FROM files
-WHERE 
-  added is NOT NULL
-  AND added NOT IN (
-    SELECT removed 
-    FROM files 
-    WHERE removed IS NOT NULL
-  )
+-- files live as of version $1 with deletion vectors of rows deleted from them
+SELECT path, "add".deletionVector::JSON AS deletion_vector, "add".partitionValues::JSON AS partition_values
+FROM file_actions_at($1)
+WHERE "add" IS NOT NULL
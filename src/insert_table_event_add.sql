@@ -1,10 +1,12 @@
--- adds parquet files to delta lake log
+-- adds parquet files to delta lake log, $4 is a json object of its partition values,
+-- $5 is false when its rows were only moved from other files
 INSERT INTO log_json (add)
 VALUES (struct_pack(
     path:=$1,
-    partitionValues:='{}'::json,
+    partitionValues:=$4::json,
     size:=$2,
     modificationTime:=epoch_ms(CURRENT_TIMESTAMP),
-    dataChange:=true,
-    stats:=$3
+    dataChange:=$5,
+    stats:=$3,
+    deletionVector:=NULL
   )::json);
@@ -3,31 +3,66 @@ package main
 import (
 	"database/sql"
 	_ "embed"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
+	"math/rand/v2"
+	"net/url"
 	"os"
 	"path/filepath"
+	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
+	"time"
 
+	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
 )
 
 var ErrNoParquetFilesInTable = errors.New("no parquet files associated with table")
 
+// ErrCommitConflict means a concurrent commit changed files our staged actions depend on
+var ErrCommitConflict = errors.New("commit conflicts with a concurrent commit")
+
+const (
+	// commits that lost a race are retried this many times
+	maxCommitRetries = 10
+	// backoff between retries starts here and doubles every attempt
+	commitRetryBackoff    = 25 * time.Millisecond
+	maxCommitRetryBackoff = 2 * time.Second
+)
+
+// commitOperation is recorded in the commitInfo action of the commit it makes
+type commitOperation struct {
+	Name       string
+	Parameters map[string]string
+}
+
 type CopyToLoggedPaquetResult struct {
-	ParquetPath string
-	Size        int64
-	DeltaStats  string
+	ParquetPath     string
+	Size            int64
+	DeltaStats      string
+	PartitionValues string // json object of partition column values
 }
 
 type Log struct {
-	logDB          *sql.DB
-	tableName      string
-	storageDir     string
-	delta_log_json string
-	storage        Storage
-	ttl_seconds    int // TTL in seconds (default 0)
+	logDB         *sql.DB
+	tableName     string
+	storageDir    string
+	delta_log_dir string
+	storage       Storage
+	// how long VACUUM keeps removed files of tables without delta.deletedFileRetentionDuration (default 0)
+	ttl_seconds int
+	// files the log doesn't refer to are only deleted once they're this old (default 1 hour)
+	orphan_grace_seconds int
+	// writes of BEGIN ... COMMIT staged so far, nil outside of one
+	pending *pendingCommit
+	// held by a request from its first statement on the table until it ends, and by background
+	// maintenance of the table. Taken with DuckpondDB.mu held.
+	mu sync.Mutex
 }
 
 //go:embed delta_lake_init.sql
@@ -36,6 +71,26 @@ var deltaLakeInitSQL string
 //go:embed export_delta_lake_log.sql
 var exportDeltaLakeLogSQL string
 
+//go:embed checkpoint.sql
+var checkpointSQL string
+
+// matches delta lake's default for delta.checkpointInterval
+const defaultCheckpointInterval = 10
+
+// size writers split the parquet files they write at, without delta.targetFileSize
+const defaultTargetFileSize = 128 << 20
+
+// long enough for any write in progress to have committed or given up
+const defaultOrphanGraceSeconds = 60 * 60
+
+// lastCheckpoint is the content of _delta_log/_last_checkpoint
+type lastCheckpoint struct {
+	Version int64 `json:"version"`
+	Size    int64 `json:"size"`
+	// number of files of a multi-part checkpoint, other writers write those
+	Parts int `json:"parts,omitempty"`
+}
+
 func NewLog(storageDir, tableName string) *Log {
 	ttlSeconds := 0
 	if ttlStr := os.Getenv("TTL_SECONDS"); ttlStr != "" {
@@ -44,13 +99,54 @@ func NewLog(storageDir, tableName string) *Log {
 		}
 	}
 
+	orphanGraceSeconds := defaultOrphanGraceSeconds
+	if graceStr := os.Getenv("ORPHAN_GRACE_SECONDS"); graceStr != "" {
+		if parsed, err := strconv.Atoi(graceStr); err == nil {
+			orphanGraceSeconds = max(parsed, 0)
+		}
+	}
+
 	return &Log{
-		tableName:      tableName,
-		storageDir:     storageDir,
-		storage:        NewStorage(storageDir),
-		delta_log_json: filepath.Join(tableName, "_delta_log/00000000000000000000.json"),
-		ttl_seconds:    ttlSeconds,
+		tableName:            tableName,
+		storageDir:           storageDir,
+		storage:              NewStorage(storageDir),
+		delta_log_dir:        filepath.Join(tableName, "_delta_log"),
+		ttl_seconds:          ttlSeconds,
+		orphan_grace_seconds: orphanGraceSeconds,
+	}
+}
+
+// commitPath returns path of the delta lake commit file for version
+func (l *Log) commitPath(version int64) string {
+	return filepath.Join(l.delta_log_dir, fmt.Sprintf("%020d.json", version))
+}
+
+// checkpointPath returns path of the single-file checkpoint for version
+func (l *Log) checkpointPath(version int64) string {
+	return filepath.Join(l.delta_log_dir, fmt.Sprintf("%020d.checkpoint.parquet", version))
+}
+
+// checkpointPaths returns paths of the files checkpoint consists of
+func (l *Log) checkpointPaths(checkpoint lastCheckpoint) []string {
+	if checkpoint.Parts <= 1 {
+		return []string{l.checkpointPath(checkpoint.Version)}
+	}
+	paths := make([]string, checkpoint.Parts)
+	for i := range paths {
+		paths[i] = filepath.Join(l.delta_log_dir,
+			fmt.Sprintf("%020d.checkpoint.%010d.%010d.parquet", checkpoint.Version, i+1, checkpoint.Parts))
+	}
+	return paths
+}
+
+// currentVersion returns the latest commit present in log_json, -1 for a table without commits
+func (l *Log) currentVersion(db *sql.DB) (int64, error) {
+	var version int64
+	err := db.QueryRow("SELECT getvariable('log_version')").Scan(&version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to get log_version: %w", err)
 	}
+	return version, nil
 }
 
 func (l *Log) WithDuckDBSecret(dataTx *sql.Tx, cb func() error) error {
@@ -118,375 +214,1791 @@ func (l *Log) getLogDBAfterImport() (*sql.DB, error) {
 	return db, nil
 }
 
-// Exports log state to a JSON file and returns the current etag
+// importedLogDB returns the log database after importing commits made since the last import,
+// for queries about the log itself like DESCRIBE HISTORY
+func (l *Log) importedLogDB() (*sql.DB, error) {
+	if err := l.importPersistedLog(); err != nil {
+		return nil, err
+	}
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %w", err)
+	}
+	version, err := l.currentVersion(db)
+	if err != nil {
+		return nil, err
+	}
+	if version < 0 {
+		return nil, fmt.Errorf("table %s does not exist", l.tableName)
+	}
+	return db, nil
+}
+
+// Exports actions staged in log_json as the next commit file in _delta_log.
+// Commit files are written create-only, so a concurrent writer that got
+// the same version first makes Export fail instead of overwriting its commit.
 func (l *Log) Export() error {
 	db, err := l.getLogDBAfterImport()
 	if err != nil {
 		return fmt.Errorf("failed to get database: %w", err)
 	}
 
-	// Get and log etag in one operation
-	var etag string
-	err = db.QueryRow("SELECT COALESCE(getvariable('log_json_etag'), '')").Scan(&etag)
-	log.Debug().Str("etag", etag).Err(err).Msgf("log.Export")
-
+	version, err := l.currentVersion(db)
 	if err != nil {
-		etag = ""
+		return err
+	}
+
+	var staged int
+	if err := db.QueryRow("SELECT count(*) FROM log_json WHERE version IS NULL").Scan(&staged); err != nil {
+		return fmt.Errorf("failed to count staged actions: %w", err)
+	}
+	if staged == 0 {
+		log.Debug().Int64("version", version).Msgf("log.Export: nothing to commit")
+		return nil
+	}
+
+	// first commit of a table has to carry the protocol
+	if version < 0 {
+		_, err = db.Exec(`
+			INSERT INTO log_json (protocol)
+			SELECT delta_protocol()
+			WHERE NOT EXISTS (SELECT 1 FROM log_json WHERE protocol IS NOT NULL)`)
+		if err != nil {
+			return fmt.Errorf("failed to stage protocol: %w", err)
+		}
 	}
 
-	// Get delta lake events as a single string
+	// Get staged delta lake events as a single string
 	var dl_events string
 	err = db.QueryRow(exportDeltaLakeLogSQL).Scan(&dl_events)
 	if err != nil {
 		return fmt.Errorf("failed to get delta lake events: %w", err)
 	}
 
-	// Write the new state to storage
-	writeErr := l.storage.Write(l.delta_log_json, []byte(dl_events), WithIfMatch(etag))
-
-	if writeErr != nil {
-		return fmt.Errorf("failed to write %s: %w", l.delta_log_json, writeErr)
+	commitVersion := version + 1
+	commitPath := l.commitPath(commitVersion)
+	log.Debug().Int64("version", commitVersion).Msgf("log.Export")
+	if writeErr := l.storage.Write(commitPath, []byte(dl_events), WithIfNoneMatch()); writeErr != nil {
+		return fmt.Errorf("failed to write %s: %w", commitPath, writeErr)
 	}
 
-	return nil
-}
-
-// Runs callback that does SQL while properly persisting it via log
-func (l *Log) withPersistedLog(op func() error) error {
-	// Import any existing persisted log data
-	if err := l.importPersistedLog(); err != nil {
-		return err
+	if _, err := db.Exec("UPDATE log_json SET version = $1 WHERE version IS NULL", commitVersion); err != nil {
+		return fmt.Errorf("failed to mark actions as committed: %w", err)
+	}
+	if _, err := db.Exec(fmt.Sprintf("SET VARIABLE log_version = %d", commitVersion)); err != nil {
+		return fmt.Errorf("failed to set log_version: %w", err)
 	}
 
-	// Execute the operation
-	if err := op(); err != nil {
+	interval, err := l.checkpointInterval(db)
+	if err != nil {
 		return err
 	}
-
-	return l.Export()
-}
-
-//go:embed json_from_create_table_event.sql
-var query_json_from_create_table_event string
-
-// Logs a DDL statement to the schema_log table
-func (l *Log) logDDL(dataTx *sql.Tx, rawCreateTable string) error {
-	return l.withPersistedLog(func() error {
-		db, err := l.getLogDBAfterImport()
-		if err != nil {
-			return fmt.Errorf("failed to get database: %w", err)
-		}
-
-		// Execute the fancy query to create delta lake table metadata event
-		// and get the JSON result.
-		// This needs to be on data connection since it's needs access to data table metadata
-		var stringOfJson string
-		err = dataTx.QueryRow(query_json_from_create_table_event, l.tableName, rawCreateTable).Scan(&stringOfJson)
-		if err != nil {
-			return fmt.Errorf("failed to generate create table event JSON: %w", err)
-		}
-
-		// Insert the JSON into delta_lake_log
-		_, err = db.Exec(`INSERT INTO log_json(metaData) VALUES ($1::json)`, stringOfJson)
-		if err != nil {
-			return fmt.Errorf("failed to insert create table event into delta lake events: %w", err)
+	if commitVersion > 0 && commitVersion%interval == 0 {
+		// commit already succeeded, a missing checkpoint only makes the next cold start slower
+		if err := l.writeCheckpoint(db, commitVersion); err != nil {
+			log.Warn().Err(err).Msgf("failed to checkpoint %s at version %d", l.tableName, commitVersion)
 		}
+	}
+	return nil
+}
 
-		return nil
-	})
+// tableProperty reads key from the configuration of the table's latest metaData, "" when unset
+func (l *Log) tableProperty(db *sql.DB, key string) (string, error) {
+	var value sql.NullString
+	err := db.QueryRow(`
+		SELECT map_extract(metaData.configuration, $1)[1]
+		FROM log_json
+		WHERE metaData IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`, key).Scan(&value)
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to get %s: %w", key, err)
+	}
+	return value.String, nil
 }
 
-// Commits in-memory data table to log and parquet files
-func (l *Log) Insert(dataTx *sql.Tx, table string) error {
-	return l.withPersistedLog(func() error {
-		logDB, err := l.getLogDBAfterImport()
-		if err != nil {
-			return fmt.Errorf("failed to open database: %w", err)
-		}
-		res, err := l.CopyToLoggedPaquet(dataTx, table, table)
-		if err != nil {
-			return fmt.Errorf("failed to copy to parquet: %w", err)
-		}
-		_, err = logDB.Exec(query_insert_table_event_add, res.ParquetPath, res.Size, table, res.DeltaStats)
-		if err != nil {
-			return fmt.Errorf("failed to record 'add' event: %w", err)
-		}
+// intervals as delta writes table properties like delta.deletedFileRetentionDuration, e.g. "interval 1 week"
+var intervalRe = regexp.MustCompile(`(?i)^\s*(?:interval\s+)?(\d+)\s+(second|minute|hour|day|week)s?\s*$`)
 
-		return err
-	})
+var intervalUnits = map[string]time.Duration{
+	"second": time.Second,
+	"minute": time.Minute,
+	"hour":   time.Hour,
+	"day":    24 * time.Hour,
+	"week":   7 * 24 * time.Hour,
 }
 
-//go:embed insert_table_event_add.sql
-var query_insert_table_event_add string
-
-// Commits writes from <table> (accessed via dataTx param) to log + parquet files
-// They are then persisted to a parquet file and tracked in the insert_log table
-// TODO:
-// - persist log for parquet files we gonna upload first
-// - Then modify reading code to detect missing parquet files and to tombstone them in log
-// - This way we wont end up with orphaned parquet files
-func (l *Log) CopyToLoggedPaquet(dataTx *sql.Tx, dstTable string, srcSQL string) (*CopyToLoggedPaquetResult, error) {
-	logDB, err := l.getLogDBAfterImport()
+// parseInterval reads an interval table property
+func parseInterval(value string) (time.Duration, error) {
+	matches := intervalRe.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("bad interval %q, expected e.g. 'interval 7 days'", value)
+	}
+	n, err := strconv.ParseInt(matches[1], 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("failed to open database: %w", err)
+		return 0, fmt.Errorf("bad interval %q: %w", value, err)
 	}
+	return time.Duration(n) * intervalUnits[strings.ToLower(matches[2])], nil
+}
 
-	var uuidOfNewFile string
-	err = logDB.QueryRow(`select uuidv7()::text`).Scan(&uuidOfNewFile)
+// deletedFileRetention is how long VACUUM keeps files after they're removed by default:
+// delta.deletedFileRetentionDuration of the table, TTL_SECONDS when it's unset
+func (l *Log) deletedFileRetention(db *sql.DB) (time.Duration, bool, error) {
+	value, err := l.tableProperty(db, "delta.deletedFileRetentionDuration")
 	if err != nil {
-		return nil, fmt.Errorf("failed to call uuidv7(): %w", err)
+		return 0, false, err
 	}
-
-	fname := uuidOfNewFile + ".parquet"
-	parquetPath := filepath.Join("data", fname)
-	parquetPathWithTable := filepath.Join(dstTable, parquetPath)
-
-	// create data directory for parquet files(when on localfs)
-	dataDir := filepath.Join(dstTable, "data")
-	if err := l.storage.CreateDir(dataDir); err != nil {
-		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	if value == "" {
+		return time.Duration(l.ttl_seconds) * time.Second, false, nil
 	}
-
-	// Get delta stats
-	var stats string
-	err = dataTx.QueryRow("SELECT delta_stats($1)", dstTable).Scan(&stats)
+	retention, err := parseInterval(value)
 	if err != nil {
-		return nil, fmt.Errorf("delta_stats(%s) failed: %w", dstTable, err)
+		return 0, false, fmt.Errorf("delta.deletedFileRetentionDuration of %s: %w", l.tableName, err)
 	}
+	return retention, true, nil
+}
 
-	var copyErr error
-	err = l.WithDuckDBSecret(dataTx, func() error {
-		copyQuery := fmt.Sprintf(`COPY %s TO '%s' (FORMAT PARQUET);`,
-			dstTable, l.storage.ToDuckDBWritePath(parquetPathWithTable))
+// vacuumRetention is how long VACUUM keeps removed files: retain when given, the table's
+// retention otherwise. retain can't be shorter than delta.deletedFileRetentionDuration,
+// readers of versions within it may still use the files.
+func (l *Log) vacuumRetention(db *sql.DB, retain *time.Duration) (time.Duration, error) {
+	retention, configured, err := l.deletedFileRetention(db)
+	if err != nil || retain == nil {
+		return retention, err
+	}
+	if configured && *retain < retention {
+		return 0, fmt.Errorf("RETAIN %s is shorter than delta.deletedFileRetentionDuration of %s, %s, readers may still use files it would delete",
+			*retain, l.tableName, retention)
+	}
+	return *retain, nil
+}
 
-		_, copyErr = dataTx.Exec(copyQuery)
-		if copyErr != nil {
-			log.Error().Msgf("%s err: %v", copyQuery, copyErr)
-			return fmt.Errorf("failed to copy to parquet: %w", copyErr)
-		}
-		return nil
-	})
+// checkpointInterval reads delta.checkpointInterval from table configuration
+func (l *Log) checkpointInterval(db *sql.DB) (int64, error) {
+	value, err := l.tableProperty(db, "delta.checkpointInterval")
 	if err != nil {
-		return nil, err
+		return 0, err
 	}
-
-	meta, copyErr := l.storage.Stat(parquetPathWithTable)
-	if copyErr != nil {
-		return nil, fmt.Errorf("failed to get file size: %w", copyErr)
+	interval, err := strconv.ParseInt(value, 10, 64)
+	if err != nil || interval <= 0 {
+		return defaultCheckpointInterval, nil
 	}
-
-	return &CopyToLoggedPaquetResult{
-		ParquetPath: parquetPath,
-		Size:        meta.Size(),
-		DeltaStats:  stats,
-	}, nil
+	return interval, nil
 }
 
-//go:embed merge.sql
-var query_merge string
-
-// Merge combines all active parquet files into a single file and tombstones the old ones
-//
-// dataTx is the transaction for the main data database operations
-func (l *Log) Merge(table string, dataTx *sql.Tx) error {
-	return l.withPersistedLog(func() error {
-		// Get logDB connection once at the start
-		logDB, err := l.getLogDBAfterImport()
-		if err != nil {
-			return fmt.Errorf("failed to get database: %w", err)
-		}
-
-		// Phase 1: Delete tombstoned files
-		files, err := l.listFiles(filesMarkedRemove)
-		if err != nil {
-			return fmt.Errorf("failed to list deleted files: %w", err)
-		}
-		// we try to not be transactional here
-		// so delete files before we remove them from the log
-		if len(files) > 0 {
-			// delete tombstoned files
-			for _, file := range files {
-				// delete the file
-				err := l.storage.Delete(filepath.Join(l.tableName, file))
-				if err != nil {
-					log.Warn().Msgf("Failed to delete tombstoned file %s: %v. Possibly already deleted?", file, err)
-					continue
-				}
-			}
-			log.Info().Msgf("VACUUM: Deleted %d files previously marked for deletion, issue VACUUM again to merge remaining files", len(files))
-			return nil
-		}
+var byteSizeRe = regexp.MustCompile(`(?i)^\s*(\d+)\s*(b|kb|mb|gb)?\s*$`)
 
-		// Phase 2: Merge active files
-
-		result, err := l.CopyToLoggedPaquet(dataTx, table, table)
-		if err != nil {
-			return fmt.Errorf("failed to create merged parquet: %w", err)
-		}
-		_, err = logDB.Exec(query_merge, result.ParquetPath, result.Size, result.DeltaStats)
-		if err != nil {
-			return fmt.Errorf("merge: failed to record 'deleted', 'add': %w", err)
-		}
+var byteSizeUnits = map[string]int64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30}
 
-		return nil
-	})
+// parseByteSize reads a size table property, bytes or e.g. '128mb'
+func parseByteSize(value string) (int64, error) {
+	matches := byteSizeRe.FindStringSubmatch(value)
+	if matches == nil {
+		return 0, fmt.Errorf("bad size %q, expected bytes or e.g. '128mb'", value)
+	}
+	n, err := strconv.ParseInt(matches[1], 10, 64)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("bad size %q, expected a positive size", value)
+	}
+	return n * byteSizeUnits[strings.ToLower(matches[2])], nil
 }
 
-type filesFilter int
-
-const (
-	filesAll filesFilter = iota
-	filesLive
-	filesMarkedRemove
-)
+// targetFileSize reads delta.targetFileSize from table configuration, the size INSERTs,
+// rewrites and OPTIMIZE split the parquet files they write at
+func (l *Log) targetFileSize(db *sql.DB) (int64, error) {
+	value, err := l.tableProperty(db, "delta.targetFileSize")
+	if err != nil {
+		return 0, err
+	}
+	size, err := parseByteSize(value)
+	if err != nil {
+		return defaultTargetFileSize, nil
+	}
+	return size, nil
+}
 
-//go:embed files_list_live.sql
-var sqlFilesListLive string
+// deletionVectorsEnabled tells whether DELETE may mark rows deleted instead of rewriting files:
+// delta.enableDeletionVectors is set and the table's protocol has the feature
+func (l *Log) deletionVectorsEnabled(db *sql.DB) (bool, error) {
+	enabled, err := l.tableProperty(db, "delta.enableDeletionVectors")
+	if err != nil || !strings.EqualFold(enabled, "true") {
+		return false, err
+	}
+	var supported bool
+	err = db.QueryRow(`
+		SELECT list_contains(json_extract_string(protocol, '$.writerFeatures[*]'), 'deletionVectors')
+		FROM log_json
+		WHERE protocol IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`).Scan(&supported)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to check protocol for deletionVectors: %w", err)
+	}
+	return supported, nil
+}
 
-//go:embed files_list_all.sql
-var sqlFilesListAll string
+// writeCheckpoint writes reconciled log state at version as a parquet checkpoint
+// and points _last_checkpoint at it, so imports don't have to replay every commit
+func (l *Log) writeCheckpoint(db *sql.DB, version int64) error {
+	tmpDir, err := os.MkdirTemp("", "dl-checkpoint-*")
+	if err != nil {
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
 
-// Lists parquet files managed by insert_log table
-func (l *Log) listFiles(filter filesFilter) ([]string, error) {
-	db, err := l.getLogDBAfterImport()
+	tmpFile := filepath.Join(tmpDir, "checkpoint.parquet")
+	if _, err := db.Exec(fmt.Sprintf("COPY (%s) TO '%s' (FORMAT PARQUET)", checkpointSQL, tmpFile), int64(latestVersion)); err != nil {
+		return fmt.Errorf("failed to write checkpoint: %w", err)
+	}
+	var size int64
+	if err := db.QueryRow("SELECT count(*) FROM read_parquet($1)", tmpFile).Scan(&size); err != nil {
+		return fmt.Errorf("failed to count checkpoint actions: %w", err)
+	}
+	data, err := os.ReadFile(tmpFile)
 	if err != nil {
-		return nil, err
+		return fmt.Errorf("failed to read checkpoint: %w", err)
 	}
 
-	var query string
-	switch filter {
-	case filesLive:
-		query = sqlFilesListLive
-	case filesMarkedRemove:
-		query = fmt.Sprintf(`SELECT remove.path AS path FROM log_json WHERE remove.deletionTimestamp <= (epoch_ms(CURRENT_TIMESTAMP) - %d * 1000)`, l.ttl_seconds)
-	case filesAll:
-		query = sqlFilesListAll
+	checkpointPath := l.checkpointPath(version)
+	if err := l.storage.Write(checkpointPath, data); err != nil {
+		return fmt.Errorf("failed to write %s: %w", checkpointPath, err)
 	}
 
-	rows, err := db.Query("COPY (select * from duckdb_tables() where table_name = 'log_json') TO '/tmp/foo.json';" + query)
+	lastCheckpointJSON, err := json.Marshal(lastCheckpoint{Version: version, Size: size})
 	if err != nil {
-		log.Error().Msgf("listFiles(%d) failed `%s`: %v", filter, query, err)
-		return nil, err
+		return err
 	}
-	defer rows.Close()
+	lastCheckpointPath := filepath.Join(l.delta_log_dir, "_last_checkpoint")
+	if err := l.storage.Write(lastCheckpointPath, lastCheckpointJSON); err != nil {
+		return fmt.Errorf("failed to write %s: %w", lastCheckpointPath, err)
+	}
+	log.Debug().Int64("version", version).Int64("size", size).Msgf("wrote checkpoint for %s", l.tableName)
+	return nil
+}
 
-	var files []string
-	for rows.Next() {
-		var file string
-		err := rows.Scan(&file)
-		if err != nil {
-			return nil, err
+// readLastCheckpoint returns nil when the table has no checkpoint yet
+func (l *Log) readLastCheckpoint() (*lastCheckpoint, error) {
+	data, _, err := l.storage.Read(filepath.Join(l.delta_log_dir, "_last_checkpoint"))
+	if err != nil {
+		if IsNotExist(err) {
+			return nil, nil
 		}
-		files = append(files, file)
+		return nil, err
 	}
-	log.Debug().Msgf("listFiles %d: %v", filter, files)
-	return files, rows.Err()
+	var checkpoint lastCheckpoint
+	if err := json.Unmarshal(data, &checkpoint); err != nil {
+		return nil, fmt.Errorf("failed to parse _last_checkpoint: %w", err)
+	}
+	return &checkpoint, nil
 }
 
-// Fake a table for reading by creating a view of live parquet files
-func (l *Log) CreateViewOfParquet(dataTx *sql.Tx) error {
-	// Create permanent secret for the view operation
-	// TODO: would be better to wrap this around select-style operations :(
-	secretSQL := l.storage.ToDuckDBSecret("duckpond_view_s3_secret")
-	if secretSQL != "" {
-		if _, err := dataTx.Exec(secretSQL); err != nil {
-			return fmt.Errorf("failed to create view secret: %w", err)
+// stageCheckpoint converts checkpoint parquet into jsonl named after its version in commitDir,
+// so Import can load it like a commit with all reconciled actions
+func (l *Log) stageCheckpoint(db *sql.DB, commitDir string, checkpoint lastCheckpoint) error {
+	var tmpFiles, quoted []string
+	defer func() {
+		for _, tmpFile := range tmpFiles {
+			os.Remove(tmpFile)
 		}
-		// Note we don't drop secret here as the view lifetime persists past this function
+	}()
+	for i, checkpointPath := range l.checkpointPaths(checkpoint) {
+		data, _, err := l.storage.Read(checkpointPath)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", checkpointPath, err)
+		}
+		tmpFile := filepath.Join(commitDir, fmt.Sprintf("checkpoint.%d.parquet", i))
+		if err := os.WriteFile(tmpFile, data, 0644); err != nil {
+			return fmt.Errorf("failed to write temp file: %w", err)
+		}
+		tmpFiles = append(tmpFiles, tmpFile)
+		quoted = append(quoted, quoteSQLString(tmpFile))
 	}
 
-	parquetFiles, err := l.listFiles(filesLive)
+	// parts of a checkpoint may not all have the same columns
+	_, err := db.Exec(fmt.Sprintf("COPY (SELECT * FROM read_parquet([%s], union_by_name=true)) TO '%s' (FORMAT JSON)",
+		strings.Join(quoted, ", "), filepath.Join(commitDir, fmt.Sprintf("%020d.json", checkpoint.Version))))
 	if err != nil {
-		return fmt.Errorf("failed to list live parquet files: %w", err)
+		return fmt.Errorf("failed to convert checkpoint %d of %s: %w", checkpoint.Version, l.tableName, err)
 	}
-	if len(parquetFiles) == 0 {
-		log.Debug().Msgf("CreateViewOfParquet: ErrNoParquetFilesInTable")
-		return ErrNoParquetFilesInTable
-	}
-	// delta extension requires _last_checkpoint which requires a parquet ver of log
-	duckPath := l.storage.ToDuckDBWritePath(l.tableName)
-	// load delta ext here in case it wasn't loaded yet
-	// can do this read without delta lake using read_parquet(parquetFiles)
-	// but then we wont benefit from deltalake/duckdb filter pushdowns
-	createView := fmt.Sprintf("LOAD delta; CREATE VIEW %s AS SELECT * FROM delta_scan('%s');", l.tableName, duckPath)
-	log.Debug().Str("duckPath", duckPath).Msgf("createView: %s", createView)
-	_, err = dataTx.Exec(createView)
-	return err
+	return nil
 }
 
-// This creates an inmemory table that we COPY (l.tableName) TO ...parquet
-func (l *Log) CreateTempTable(dataTx *sql.Tx) error {
+// discardStaged drops actions staged for a commit that is not going to happen
+func (l *Log) discardStaged() {
+	if l.logDB == nil {
+		return
+	}
+	if _, err := l.logDB.Exec("DELETE FROM log_json WHERE version IS NULL"); err != nil {
+		log.Error().Err(err).Msgf("failed to discard staged actions for %s", l.tableName)
+	}
+}
 
-	logDB, err := l.getLogDBAfterImport()
+// abandonStaged discards actions staged for a commit known not to have been written,
+// deleting files and deletion vectors its adds wrote, since no commit refers to them.
+// When it's unknown whether the commit was written, discardStaged leaves files for VACUUM.
+func (l *Log) abandonStaged() {
+	if l.logDB == nil {
+		return
+	}
+	files, err := l.queryFiles(`
+		SELECT "add".path FROM log_json s
+		WHERE version IS NULL AND "add" IS NOT NULL AND NOT EXISTS (
+			SELECT 1 FROM log_json c
+			WHERE c.version IS NOT NULL AND s."add".path IN (c."add".path, c.remove.path))`)
 	if err != nil {
-		return fmt.Errorf("failed to get log database: %w", err)
+		log.Error().Err(err).Msgf("failed to list staged files of %s", l.tableName)
 	}
-
-	var createQuery string
-	err = logDB.QueryRow(`
-		select metaData.duckpond.createTable::TEXT as text 
-		from log_json 
-		where metaData is not null;
-	`).Scan(&createQuery)
+	dvs, err := l.queryFiles(`
+		SELECT DISTINCT "add".deletionVector::JSON FROM log_json s
+		WHERE version IS NULL AND "add".deletionVector.storageType = 'u' AND NOT EXISTS (
+			SELECT 1 FROM log_json c
+			WHERE c.version IS NOT NULL AND s."add".deletionVector IN (c."add".deletionVector, c.remove.deletionVector))`)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			log.Debug().Msgf("CreateTempTable:  table hasn't been initialized yet")
-
-			// table hasn't been initialized yet
-			return nil
+		log.Error().Err(err).Msgf("failed to list staged deletion vectors of %s", l.tableName)
+	}
+	dvPaths, err := deletionVectorPaths(dvs)
+	if err != nil {
+		log.Error().Err(err).Msgf("failed to list staged deletion vectors of %s", l.tableName)
+	}
+	for _, file := range append(files, dvPaths...) {
+		if err := l.storage.Delete(filepath.Join(l.tableName, file)); err != nil {
+			log.Warn().Err(err).Msgf("failed to delete %s of an abandoned commit, VACUUM will", file)
 		}
-		return fmt.Errorf("failed to query schema_log: %w", err)
 	}
+	l.discardStaged()
+}
 
-	// Decode the JSON string
-	// var decodedQuery string
-	// if err := json.Unmarshal([]byte(createQuery), &decodedQuery); err != nil {
-	// return fmt.Errorf("failed to decode create table query: %w", err)
-	// }
-
-	log.Debug().Msgf("CreateTempTable: %s", createQuery)
-
-	// Execute the create table statement
-	if _, err := dataTx.Exec(createQuery); err != nil {
-		return fmt.Errorf("failed to execute schema_log query `%s`: %w", createQuery, err)
-	}
+//go:embed commit_conflicts.sql
+var query_commit_conflicts string
 
-	return nil
-}
+//go:embed commit_info.sql
+var query_commit_info string
 
-// Restores db state from a JSON file
-// passing JSON to keep all logic in DB
-// TODO: pass it in via arrow to reduce overhead
-func (l *Log) Import(tmpFilename string, etag string) error {
+//go:embed describe_history.sql
+var query_describe_history string
 
-	logdb, err := l.initLogDB()
-	if err != nil {
-		return err
+// stageCommitInfo stages commitInfo for operation when it staged any actions
+func (l *Log) stageCommitInfo(db *sql.DB, operation commitOperation, readVersion int64) error {
+	parameters := operation.Parameters
+	if parameters == nil {
+		parameters = map[string]string{}
 	}
-
-	// Set and log etag in one operation
-	log.Debug().Msgf("Import: setting etag=%v (err=%v)", etag, err)
-	_, err = logdb.Exec("SET VARIABLE log_json_etag = $1", etag)
+	parametersJSON, err := json.Marshal(parameters)
 	if err != nil {
-		return fmt.Errorf("failed to set log_json_etag: %w", err)
+		return fmt.Errorf("failed to marshal operation parameters: %w", err)
 	}
-
-	_, err = logdb.Exec(`
-		DELETE FROM log_json;
-		INSERT INTO log_json (SELECT * FROM read_json($1, auto_detect=true));
-    `, tmpFilename)
+	_, err = db.Exec(query_commit_info, operation.Name, string(parametersJSON), readVersion, "duckpond/"+Version)
 	if err != nil {
-		return fmt.Errorf("failed to create json_data table: %w", err)
+		return fmt.Errorf("failed to stage commitInfo: %w", err)
 	}
 	return nil
 }
 
-func (l *Log) Close() error {
-	if l.logDB != nil {
-		return l.logDB.Close()
+// Runs callback that does SQL while properly persisting it via log.
+// When another writer commits first, the log is re-imported and staged actions
+// are committed on top of it unless they conflict with what was committed meanwhile.
+// operation describes the commit in its commitInfo.
+// Within BEGIN ... COMMIT actions are only staged, see commitPending.
+func (l *Log) withPersistedLog(operation commitOperation, op func() error) error {
+	if l.pending != nil {
+		if err := op(); err != nil {
+			return err
+		}
+		l.pending.operations = append(l.pending.operations, operation.Name)
+		return nil
 	}
-	return nil
-}
+
+	// Import any existing persisted log data
+	if err := l.importPersistedLog(); err != nil {
+		return err
+	}
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return fmt.Errorf("failed to get database: %w", err)
+	}
+	readVersion, err := l.currentVersion(db)
+	if err != nil {
+		return err
+	}
+	if err := l.checkProtocol(db, true); err != nil {
+		return err
+	}
+
+	// Execute the operation
+	if err := op(); err != nil {
+		l.abandonStaged()
+		return err
+	}
+	if err := l.checkAppendOnly(db); err != nil {
+		l.abandonStaged()
+		return err
+	}
+	if err := l.stageCommitInfo(db, operation, readVersion); err != nil {
+		l.abandonStaged()
+		return err
+	}
+	return l.exportStaged(db, readVersion)
+}
+
+// exportStaged commits staged actions read at readVersion, retrying on top of
+// concurrent commits they don't conflict with. They're discarded when it fails.
+func (l *Log) exportStaged(db *sql.DB, readVersion int64) error {
+	for attempt := 0; ; attempt++ {
+		err := l.Export()
+		if err == nil {
+			return nil
+		}
+		if !errors.Is(err, ErrPreconditionFailed) {
+			// the commit may have been written after all
+			l.discardStaged()
+			return err
+		}
+		if attempt >= maxCommitRetries {
+			l.abandonStaged()
+			return err
+		}
+		log.Info().Int("attempt", attempt).Err(err).Msgf("commit to %s lost a race, retrying", l.tableName)
+
+		if err := l.importPersistedLog(); err != nil {
+			l.abandonStaged()
+			return err
+		}
+		keyed, err := l.hasPrimaryKey(db)
+		if err != nil {
+			l.abandonStaged()
+			return err
+		}
+		var reason string
+		err = db.QueryRow(query_commit_conflicts, readVersion, keyed).Scan(&reason)
+		if err == nil {
+			l.abandonStaged()
+			return fmt.Errorf("%w: %s", ErrCommitConflict, reason)
+		}
+		if err != sql.ErrNoRows {
+			l.abandonStaged()
+			return fmt.Errorf("failed to check for commit conflicts: %w", err)
+		}
+
+		backoff := min(commitRetryBackoff<<attempt, maxCommitRetryBackoff)
+		time.Sleep(backoff/2 + rand.N(backoff/2))
+	}
+}
+
+//go:embed json_from_create_table_event.sql
+var query_json_from_create_table_event string
+
+// Logs a DDL statement to the schema_log table
+func (l *Log) logDDL(dataTx *sql.Tx, rawCreateTable string, partitionBy []PartitionColumn) error {
+	return l.withPersistedLog(commitOperation{Name: "CREATE TABLE"}, func() error {
+		db, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+
+		if err := l.validatePartitionBy(dataTx, partitionBy); err != nil {
+			return err
+		}
+		partitionByJSON, err := json.Marshal(partitionBy)
+		if err != nil {
+			return err
+		}
+		if partitionBy == nil {
+			partitionByJSON = []byte("[]")
+		}
+
+		// This needs to be on data connection since it's needs access to data table metadata
+		schema, err := deltaSchema(dataTx, l.tableName, partitionBy, nil)
+		if err != nil {
+			return fmt.Errorf("failed to map %s to a Delta Lake schema: %w", l.tableName, err)
+		}
+		// new tables map columns, so renames and drops don't rewrite files
+		schemaString, maxColumnId, err := renderSchemaString(schema, 0)
+		if err != nil {
+			return err
+		}
+		var stringOfJson string
+		err = db.QueryRow(query_json_from_create_table_event, schemaString, rawCreateTable, string(partitionByJSON), maxColumnId).Scan(&stringOfJson)
+		if err != nil {
+			return fmt.Errorf("failed to generate create table event JSON: %w", err)
+		}
+
+		// Insert the JSON into delta_lake_log
+		_, err = db.Exec(`INSERT INTO log_json(metaData) VALUES ($1::json)`, stringOfJson)
+		if err != nil {
+			return fmt.Errorf("failed to insert create table event into delta lake events: %w", err)
+		}
+
+		return nil
+	})
+}
+
+// Commits in-memory data table to log and parquet files.
+// Rows with the primary key of persisted rows are handled according to conflict,
+// files with replaced rows are rewritten in the same commit.
+// With txn, nothing is written when txn is already committed, it's committed with the rows otherwise.
+// Returns the number of rows inserted, ignored ones and those of rewritten files left out.
+func (l *Log) Insert(dataTx *sql.Tx, table string, conflict OnConflict, operation commitOperation, txn *Txn) (int64, error) {
+	var inserted int64
+	err := l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to open database: %w", err)
+		}
+		if txn != nil {
+			committed, err := l.txnCommitted(logDB, txn)
+			if err != nil {
+				return err
+			}
+			if committed {
+				log.Info().Msgf("skipping write of %s, txn %s:%d is already committed", l.tableName, txn.AppID, txn.Version)
+				return nil
+			}
+			_, err = logDB.Exec(`
+				INSERT INTO log_json (txn)
+				SELECT struct_pack(appId := $1::VARCHAR, version := $2::BIGINT, lastUpdated := epoch_ms(CURRENT_TIMESTAMP))`,
+				txn.AppID, txn.Version)
+			if err != nil {
+				return fmt.Errorf("failed to record txn: %w", err)
+			}
+		}
+		countRows := func() error {
+			return dataTx.QueryRow(fmt.Sprintf("SELECT count(*) FROM %s", table)).Scan(&inserted)
+		}
+		if err := countRows(); err != nil {
+			return err
+		}
+		removed, err := l.resolveConflicts(dataTx, logDB, conflict)
+		if err != nil {
+			return err
+		}
+		// replacing only adds rows of rewritten files to the table, ignoring deletes rows
+		if conflict == ConflictIgnore {
+			if err := countRows(); err != nil {
+				return err
+			}
+		}
+		if inserted == 0 && removed == 0 {
+			// every row was ignored
+			return nil
+		}
+		return l.stageAddsOf(dataTx, logDB, table, true)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return inserted, nil
+}
+
+// txnCommitted tells if the table has a committed txn of txn's app with its version or a later one
+func (l *Log) txnCommitted(logDB *sql.DB, txn *Txn) (bool, error) {
+	var committed bool
+	err := logDB.QueryRow(`
+		SELECT coalesce(max(txn.version) >= $2, false)
+		FROM log_json
+		WHERE version IS NOT NULL AND txn.appId = $1`, txn.AppID, txn.Version).Scan(&committed)
+	if err != nil {
+		return false, fmt.Errorf("failed to check txn of %s: %w", l.tableName, err)
+	}
+	return committed, nil
+}
+
+//go:embed insert_table_event_add.sql
+var query_insert_table_event_add string
+
+// stageAddsOf copies rows of table to new parquet files of the log's table, one per partition,
+// and stages their adds. dataChange is false when the rows were only moved from other files.
+func (l *Log) stageAddsOf(dataTx *sql.Tx, logDB *sql.DB, table string, dataChange bool) error {
+	results, err := l.CopyToLoggedPaquet(dataTx, l.tableName, table)
+	if err != nil {
+		return fmt.Errorf("failed to copy to parquet: %w", err)
+	}
+	for _, res := range results {
+		_, err = logDB.Exec(query_insert_table_event_add, res.ParquetPath, res.Size, res.DeltaStats, res.PartitionValues, dataChange)
+		if err != nil {
+			return fmt.Errorf("failed to record 'add' event: %w", err)
+		}
+	}
+	return nil
+}
+
+//go:embed remove_file.sql
+var query_remove_file string
+
+// listLiveFilesMatching lists live files whose stats don't rule out rows statement,
+// a DELETE or UPDATE, changes
+func (l *Log) listLiveFilesMatching(dataTx *sql.Tx, statement string) ([]liveFile, error) {
+	logDB, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %w", err)
+	}
+	predicates, err := statsPredicates(logDB, l.tableName, statement)
+	if err != nil {
+		return nil, err
+	}
+	return l.listLiveFilesWithStats(dataTx, predicates)
+}
+
+// listLiveFilesWithStats lists live files whose stats don't rule out rows matching all predicates
+func (l *Log) listLiveFilesWithStats(dataTx *sql.Tx, predicates []statsPredicate) ([]liveFile, error) {
+	logDB, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get database: %w", err)
+	}
+	columns, err := tableColumnTypes(dataTx, l.tableName)
+	if err != nil {
+		return nil, err
+	}
+	partitionBy, err := l.partitionBy(logDB)
+	if err != nil {
+		return nil, err
+	}
+	physical, err := l.physicalNames(logDB, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+	condition := statsCondition(logDB, predicates, columns, physical) + " AND " + partitionCondition(logDB, partitionBy, predicates, columns, physical)
+	return l.queryLiveFiles(sqlFilesListLive+" AND "+condition, int64(latestVersion))
+}
+
+//go:embed add_deletion_vector.sql
+var query_add_deletion_vector string
+
+// readDeletionVector returns the row numbers a deletion vector marks as deleted
+func (l *Log) readDeletionVector(dv *deletionVector) ([]uint64, error) {
+	var serialized []byte
+	switch dv.StorageType {
+	case "i":
+		data, err := z85Decode(dv.PathOrInlineDv)
+		if err != nil {
+			return nil, err
+		}
+		if len(data) < int(dv.SizeInBytes) {
+			return nil, fmt.Errorf("%w: inline vector shorter than %d bytes", errBadDeletionVector, dv.SizeInBytes)
+		}
+		serialized = data[:dv.SizeInBytes]
+	case "u":
+		path, err := dv.relativePath()
+		if err != nil {
+			return nil, err
+		}
+		data, _, err := l.storage.Read(filepath.Join(l.tableName, path))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read deletion vector %s: %w", path, err)
+		}
+		if serialized, err = deletionVectorFromFile(data, dv); err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+	default:
+		return nil, fmt.Errorf("deletion vectors with storageType %q are not supported", dv.StorageType)
+	}
+	return decodeDeletionVector(serialized)
+}
+
+// writeDeletionVector writes sorted row numbers to a new deletion vector file in the table's directory
+func (l *Log) writeDeletionVector(rows []uint64) (*deletionVector, error) {
+	id, err := uuid.NewRandom()
+	if err != nil {
+		return nil, err
+	}
+	serialized := encodeDeletionVector(rows)
+	offset := int32(1)
+	dv := &deletionVector{
+		StorageType:    "u",
+		PathOrInlineDv: z85Encode(id[:]),
+		Offset:         &offset,
+		SizeInBytes:    int32(len(serialized)),
+		Cardinality:    int64(len(rows)),
+	}
+	path, err := dv.relativePath()
+	if err != nil {
+		return nil, err
+	}
+	if err := l.storage.Write(filepath.Join(l.tableName, path), deletionVectorFile(serialized), WithIfNoneMatch()); err != nil {
+		return nil, fmt.Errorf("failed to write deletion vector %s: %w", path, err)
+	}
+	return dv, nil
+}
+
+// liveRowsSQL is a query for rows of file that its deletion vector doesn't mark deleted,
+// with their file_row_number. Deleted rows are looked up in duckpond_deleted_rows of dataTx.
+func (l *Log) liveRowsSQL(dataTx *sql.Tx, file liveFile) (string, error) {
+	path := l.storage.ToDuckDBReadPath(filepath.Join(l.tableName, file.Path))
+	query := readParquetSQL([]string{quoteSQLString(path)}, file.PartitionValues, "file_row_number=true, hive_partitioning=false")
+	if file.DeletionVector == nil {
+		return query, nil
+	}
+
+	rows, err := l.readDeletionVector(file.DeletionVector)
+	if err != nil {
+		return "", err
+	}
+	deleted := make([]string, len(rows))
+	for i, row := range rows {
+		deleted[i] = strconv.FormatUint(row, 10)
+	}
+	if _, err := dataTx.Exec("CREATE TABLE IF NOT EXISTS duckpond_deleted_rows (path VARCHAR, file_row_number BIGINT)"); err != nil {
+		return "", err
+	}
+	if _, err := dataTx.Exec("DELETE FROM duckpond_deleted_rows WHERE path = $1", path); err != nil {
+		return "", err
+	}
+	if len(deleted) > 0 {
+		_, err = dataTx.Exec("INSERT INTO duckpond_deleted_rows SELECT $1, unnest(string_split($2, ','))::BIGINT", path, strings.Join(deleted, ","))
+		if err != nil {
+			return "", fmt.Errorf("failed to load deleted rows of %s: %w", file.Path, err)
+		}
+	}
+	return query + fmt.Sprintf(" WHERE file_row_number NOT IN (SELECT file_row_number FROM duckpond_deleted_rows WHERE path = %s)", quoteSQLString(path)), nil
+}
+
+// RewriteFiles applies a DELETE or UPDATE by running it once against all candidate live files
+// loaded into the table created by CreateTempTable, so subqueries on the table see all of them.
+// Files with rows it changed are rewritten copy-on-write: remove of the old file and add of
+// the new one, all in a single commit. Rows that got new rowids, like ones with an updated
+// primary key, are written to files of their own.
+// With deletion vectors enabled, DELETE re-adds the same file with a deletion vector instead.
+// Files whose stats rule out rows matching the WHERE clause are not read.
+// Returns the number of rows the statement affected.
+func (l *Log) RewriteFiles(dataTx *sql.Tx, query string, operation commitOperation) (int64, error) {
+	var affected int64
+	err := l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		// against the empty table first, so a bad statement fails before any file is read
+		if _, err := dataTx.Exec(query); err != nil {
+			return err
+		}
+		useDeletionVectors := false
+		if operation.Name == "DELETE" {
+			if useDeletionVectors, err = l.deletionVectorsEnabled(logDB); err != nil {
+				return err
+			}
+		}
+
+		files, err := l.listLiveFilesMatching(dataTx, query)
+		if err != nil {
+			return fmt.Errorf("failed to list files to rewrite: %w", err)
+		}
+		log.Debug().Msgf("RewriteFiles candidates: %v", files)
+		if err := l.loadFiles(dataTx, logDB, files); err != nil {
+			return err
+		}
+
+		res, err := dataTx.Exec(query)
+		if err != nil {
+			return err
+		}
+		if affected, err = res.RowsAffected(); err != nil {
+			return err
+		}
+		if affected == 0 {
+			return nil
+		}
+
+		changed, err := l.changedFiles(dataTx)
+		if err != nil {
+			return err
+		}
+		for _, i := range changed {
+			file := files[i]
+			if _, err := logDB.Exec(query_remove_file, file.Path, true, int64(latestVersion)); err != nil {
+				return fmt.Errorf("failed to record 'remove' of %s: %w", file.Path, err)
+			}
+			_, err := dataTx.Exec(fmt.Sprintf(`
+				CREATE OR REPLACE TABLE duckpond_rewritten AS
+				SELECT * FROM %s WHERE rowid IN (
+					SELECT id FROM duckpond_loaded_rows JOIN duckpond_file_rowids USING (n) WHERE file = $1
+				) ORDER BY rowid`, l.tableName), i)
+			if err != nil {
+				return err
+			}
+			var remaining int64
+			if err := dataTx.QueryRow("SELECT count(*) FROM duckpond_rewritten").Scan(&remaining); err != nil {
+				return err
+			}
+			if remaining == 0 {
+				continue
+			}
+
+			if useDeletionVectors {
+				if err := l.stageDeletionVector(dataTx, logDB, file, i); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := l.stageAddsOf(dataTx, logDB, "duckpond_rewritten", true); err != nil {
+				return fmt.Errorf("failed to rewrite %s: %w", file.Path, err)
+			}
+		}
+
+		// rows that got new rowids no longer tell their file, they come from files rewritten above
+		_, err = dataTx.Exec(fmt.Sprintf(`
+			CREATE OR REPLACE TABLE duckpond_rewritten AS
+			SELECT * FROM %s WHERE rowid NOT IN (SELECT id FROM duckpond_file_rowids) ORDER BY rowid`, l.tableName))
+		if err != nil {
+			return err
+		}
+		var moved int64
+		if err := dataTx.QueryRow("SELECT count(*) FROM duckpond_rewritten").Scan(&moved); err != nil {
+			return err
+		}
+		if moved == 0 {
+			return nil
+		}
+		return l.stageAddsOf(dataTx, logDB, "duckpond_rewritten", true)
+	})
+	return affected, err
+}
+
+// loadFiles loads live rows of files into the table. duckpond_loaded_rows tells the file (index in files)
+// and file_row_number of the n-th loaded row, duckpond_file_rowids the rowid it got,
+// duckpond_rows_before has the rows as loaded to tell which ones a statement changed.
+func (l *Log) loadFiles(dataTx *sql.Tx, logDB *sql.DB, files []liveFile) error {
+	schema, err := l.currentSchema(dataTx, logDB)
+	if err != nil {
+		return err
+	}
+	if _, err := dataTx.Exec(fmt.Sprintf("DELETE FROM %s", l.tableName)); err != nil {
+		return err
+	}
+	if _, err := dataTx.Exec("CREATE OR REPLACE TABLE duckpond_loaded_rows (file INTEGER, file_row_number BIGINT, n BIGINT)"); err != nil {
+		return err
+	}
+	for i, file := range files {
+		err := l.WithDuckDBSecret(dataTx, func() error {
+			rowsSQL, err := l.liveRowsSQL(dataTx, file)
+			if err != nil {
+				return err
+			}
+			// rows are kept in file order, so the n-th rowid of the table is the n-th loaded row
+			_, err = dataTx.Exec(fmt.Sprintf("CREATE OR REPLACE TABLE duckpond_file_rows AS %s ORDER BY file_row_number",
+				schema.rowsSQL(rowsSQL, "file_row_number")))
+			if err != nil {
+				return err
+			}
+			_, err = dataTx.Exec(fmt.Sprintf("INSERT INTO %s BY NAME SELECT * EXCLUDE (file_row_number) FROM duckpond_file_rows ORDER BY file_row_number", l.tableName))
+			if err != nil {
+				return err
+			}
+			_, err = dataTx.Exec(`
+				INSERT INTO duckpond_loaded_rows
+				SELECT $1, file_row_number, (SELECT count(*) FROM duckpond_loaded_rows) + row_number() OVER (ORDER BY file_row_number)
+				FROM duckpond_file_rows`, i)
+			return err
+		})
+		if err != nil {
+			return fmt.Errorf("failed to load %s: %w", file.Path, err)
+		}
+	}
+	_, err = dataTx.Exec(fmt.Sprintf(`
+		CREATE OR REPLACE TABLE duckpond_file_rowids AS
+		SELECT row_number() OVER (ORDER BY rowid) AS n, rowid AS id FROM %s`, l.tableName))
+	if err != nil {
+		return err
+	}
+	_, err = dataTx.Exec(fmt.Sprintf("CREATE OR REPLACE TABLE duckpond_rows_before AS SELECT rowid AS duckpond_rowid, * FROM %s", l.tableName))
+	return err
+}
+
+// changedFiles lists indexes of files loaded by loadFiles that have rows the statement since deleted or changed
+func (l *Log) changedFiles(dataTx *sql.Tx) ([]int, error) {
+	rows, err := dataTx.Query(fmt.Sprintf(`
+		SELECT DISTINCT file
+		FROM duckpond_loaded_rows JOIN duckpond_file_rowids USING (n)
+		WHERE id IN (
+			SELECT duckpond_rowid FROM (SELECT * FROM duckpond_rows_before EXCEPT ALL SELECT rowid, * FROM %s)
+		)
+		ORDER BY file`, l.tableName))
+	if err != nil {
+		return nil, fmt.Errorf("failed to find changed files: %w", err)
+	}
+	defer rows.Close()
+	var files []int
+	for rows.Next() {
+		var file int
+		if err := rows.Scan(&file); err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// stageDeletionVector re-adds file, the i-th one loadFiles loaded, with a deletion vector of
+// rows the statement RewriteFiles ran deleted from the table, in addition to rows deleted before
+func (l *Log) stageDeletionVector(dataTx *sql.Tx, logDB *sql.DB, file liveFile, i int) error {
+	rows, err := dataTx.Query(fmt.Sprintf(`
+		SELECT file_row_number
+		FROM duckpond_loaded_rows JOIN duckpond_file_rowids USING (n)
+		WHERE file = $1 AND id NOT IN (SELECT rowid FROM %s)
+		ORDER BY file_row_number`, l.tableName), i)
+	if err != nil {
+		return fmt.Errorf("failed to find deleted rows of %s: %w", file.Path, err)
+	}
+	defer rows.Close()
+	var deleted []uint64
+	for rows.Next() {
+		var row uint64
+		if err := rows.Scan(&row); err != nil {
+			return err
+		}
+		deleted = append(deleted, row)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	if file.DeletionVector != nil {
+		previous, err := l.readDeletionVector(file.DeletionVector)
+		if err != nil {
+			return err
+		}
+		deleted = mergeRows(previous, deleted)
+	}
+	dv, err := l.writeDeletionVector(deleted)
+	if err != nil {
+		return err
+	}
+	dvJSON, err := json.Marshal(dv)
+	if err != nil {
+		return err
+	}
+	if _, err := logDB.Exec(query_add_deletion_vector, file.Path, string(dvJSON)); err != nil {
+		return fmt.Errorf("failed to record deletion vector of %s: %w", file.Path, err)
+	}
+	return nil
+}
+
+// Commits writes from <table> (accessed via dataTx param) to log + parquet files
+// They are then persisted to a parquet file per partition and tracked in the insert_log table
+// Files of commits that are abandoned get deleted, VACUUM deletes those of writes that died
+// before they could commit, see listOrphanedFiles
+func (l *Log) CopyToLoggedPaquet(dataTx *sql.Tx, dstTable string, srcSQL string) ([]CopyToLoggedPaquetResult, error) {
+	logDB, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open database: %w", err)
+	}
+	partitionBy, err := l.partitionBy(logDB)
+	if err != nil {
+		return nil, err
+	}
+	if len(partitionBy) == 0 {
+		return l.copyToParquet(dataTx, logDB, dstTable, srcSQL, "data", "{}")
+	}
+	physical, err := l.physicalNames(logDB, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	expressions := make([]string, len(partitionBy))
+	for i, column := range partitionBy {
+		expressions[i] = fmt.Sprintf("(%s)::VARCHAR", column.Expression)
+	}
+	rows, err := dataTx.Query(fmt.Sprintf("SELECT DISTINCT %s FROM %s", strings.Join(expressions, ", "), srcSQL))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitions of %s: %w", srcSQL, err)
+	}
+	var partitions [][]sql.NullString
+	for rows.Next() {
+		values := make([]sql.NullString, len(partitionBy))
+		pointers := make([]any, len(values))
+		for i := range values {
+			pointers[i] = &values[i]
+		}
+		if err := rows.Scan(pointers...); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		partitions = append(partitions, values)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	var results []CopyToLoggedPaquetResult
+	for _, values := range partitions {
+		conditions := make([]string, len(partitionBy))
+		args := make([]any, len(partitionBy))
+		for i := range partitionBy {
+			conditions[i] = fmt.Sprintf("%s IS NOT DISTINCT FROM $%d", expressions[i], i+1)
+			args[i] = values[i]
+		}
+		_, err := dataTx.Exec(fmt.Sprintf("CREATE OR REPLACE TABLE duckpond_partition_rows AS SELECT * FROM %s WHERE %s",
+			srcSQL, strings.Join(conditions, " AND ")), args...)
+		if err != nil {
+			return nil, fmt.Errorf("failed to split %s into partitions: %w", srcSQL, err)
+		}
+		partitionValues, err := partitionValuesJSON(partitionBy, values, physical)
+		if err != nil {
+			return nil, err
+		}
+		res, err := l.copyToParquet(dataTx, logDB, dstTable, "duckpond_partition_rows",
+			filepath.Join("data", partitionDir(partitionBy, values)), partitionValues)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, res...)
+	}
+	return results, nil
+}
+
+// copyToParquet copies srcTable to new parquet files in dir of dstTable's directory, one per
+// delta.targetFileSize of rows. DuckDB only splits files between row groups, so they may be larger.
+func (l *Log) copyToParquet(dataTx *sql.Tx, logDB *sql.DB, dstTable, srcTable, dir, partitionValues string) ([]CopyToLoggedPaquetResult, error) {
+	var uuidOfNewFile string
+	err := logDB.QueryRow(`select uuidv7()::text`).Scan(&uuidOfNewFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to call uuidv7(): %w", err)
+	}
+	targetFileSize, err := l.targetFileSize(logDB)
+	if err != nil {
+		return nil, err
+	}
+
+	// create data directory for parquet files(when on localfs)
+	dataDir := filepath.Join(dstTable, dir)
+	if err := l.storage.CreateDir(dataDir); err != nil {
+		return nil, fmt.Errorf("failed to create data directory: %w", err)
+	}
+
+	// columns are written under their physical names, stats are keyed by them too
+	columns, err := tableColumns(dataTx, srcTable)
+	if err != nil {
+		return nil, err
+	}
+	external, err := l.externalPartitionColumns(logDB)
+	if err != nil {
+		return nil, err
+	}
+	columns = slices.DeleteFunc(columns, func(column tableColumn) bool {
+		return slices.Contains(external, column.Name)
+	})
+	physical, err := l.physicalNames(logDB, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+	schema := tableSchema{columns: columns, physical: physical}
+
+	// Get delta stats
+	statsSQL, err := deltaStatsSQL(dataTx, srcTable, physical)
+	if err != nil {
+		return nil, err
+	}
+	var stats string
+	if err := dataTx.QueryRow(statsSQL).Scan(&stats); err != nil {
+		return nil, fmt.Errorf("stats of %s failed: %w", srcTable, err)
+	}
+
+	var written []any
+	err = l.WithDuckDBSecret(dataTx, func() error {
+		copyQuery := fmt.Sprintf(`COPY (%s) TO '%s' (FORMAT PARQUET, FILE_SIZE_BYTES %d, FILENAME_PATTERN '%s_{i}', OVERWRITE_OR_IGNORE true, RETURN_FILES true);`,
+			schema.physicalSelect(srcTable), l.storage.ToDuckDBWritePath(dataDir), targetFileSize, uuidOfNewFile)
+
+		var count int64
+		var files any
+		if err := dataTx.QueryRow(copyQuery).Scan(&count, &files); err != nil {
+			log.Error().Msgf("%s err: %v", copyQuery, err)
+			return fmt.Errorf("failed to copy to parquet: %w", err)
+		}
+		written, _ = files.([]any)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]CopyToLoggedPaquetResult, 0, len(written))
+	for _, file := range written {
+		name, _ := file.(string)
+		parquetPath := filepath.Join(dir, filepath.Base(name))
+		parquetPathWithTable := filepath.Join(dstTable, parquetPath)
+		meta, err := l.storage.Stat(parquetPathWithTable)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get file size: %w", err)
+		}
+		fileStats := stats
+		if len(written) > 1 {
+			if fileStats, err = l.writtenFileStats(dataTx, schema, parquetPathWithTable); err != nil {
+				return nil, err
+			}
+		}
+		results = append(results, CopyToLoggedPaquetResult{
+			ParquetPath:     parquetPath,
+			Size:            meta.Size(),
+			DeltaStats:      fileStats,
+			PartitionValues: partitionValues,
+		})
+	}
+	return results, nil
+}
+
+// writtenFileStats reads back one of several files copyToParquet wrote for its delta stats
+func (l *Log) writtenFileStats(dataTx *sql.Tx, schema tableSchema, parquetPathWithTable string) (string, error) {
+	var stats string
+	err := l.WithDuckDBSecret(dataTx, func() error {
+		rows := readParquetSQL([]string{quoteSQLString(l.storage.ToDuckDBReadPath(parquetPathWithTable))}, nil, "hive_partitioning=false")
+		if _, err := dataTx.Exec("CREATE OR REPLACE TEMP VIEW duckpond_written_rows AS " + schema.rowsSQL(rows)); err != nil {
+			return err
+		}
+		statsSQL, err := deltaStatsSQL(dataTx, "duckpond_written_rows", schema.physical)
+		if err != nil {
+			return err
+		}
+		return dataTx.QueryRow(statsSQL).Scan(&stats)
+	})
+	if err != nil {
+		return "", fmt.Errorf("stats of %s failed: %w", parquetPathWithTable, err)
+	}
+	return stats, nil
+}
+
+//go:embed restore.sql
+var query_restore string
+
+// Restore commits the table back to what it was at target by re-adding and removing files,
+// no data is copied. Files vacuumed since target can't be re-added.
+func (l *Log) Restore(target *TimeTravel) error {
+	operation := commitOperation{Name: "RESTORE", Parameters: map[string]string{}}
+	if target.Timestamp != "" {
+		operation.Parameters["timestamp"] = target.Timestamp
+	} else {
+		operation.Parameters["version"] = strconv.FormatInt(target.Version, 10)
+	}
+	return l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		version, err := l.resolveVersion(target)
+		if err != nil {
+			return err
+		}
+
+		readded, err := l.queryFiles(`
+			SELECT path FROM file_actions_at($1) WHERE "add" IS NOT NULL
+			EXCEPT
+			SELECT path FROM file_actions_at($2) WHERE "add" IS NOT NULL`, version, int64(latestVersion))
+		if err != nil {
+			return fmt.Errorf("failed to list files to re-add: %w", err)
+		}
+		for _, file := range readded {
+			if _, err := l.storage.Stat(filepath.Join(l.tableName, file)); err != nil {
+				return fmt.Errorf("can't restore %s to version %d, %s is gone (vacuumed?): %w", l.tableName, version, file, err)
+			}
+		}
+
+		if _, err := logDB.Exec(query_restore, version, int64(latestVersion)); err != nil {
+			return fmt.Errorf("failed to stage restore to version %d: %w", version, err)
+		}
+		log.Info().Int64("version", version).Int("readded", len(readded)).Msgf("RESTORE %s", l.tableName)
+		return nil
+	})
+}
+
+// Vacuum deletes files removed longer than retain ago, or the table's retention when nil,
+// that nothing live uses anymore, along with orphaned files. It doesn't commit anything,
+// files are removed from the table by the commits that remove them, see Optimize to compact files.
+func (l *Log) Vacuum(retain *time.Duration) error {
+	return l.withPersistedLog(commitOperation{Name: "VACUUM"}, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		retention, err := l.vacuumRetention(logDB, retain)
+		if err != nil {
+			return err
+		}
+		files, err := l.listVacuumFiles(retention)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if err := l.storage.Delete(filepath.Join(l.tableName, file)); err != nil {
+				log.Warn().Msgf("Failed to delete tombstoned file %s: %v. Possibly already deleted?", file, err)
+			}
+		}
+		log.Info().Msgf("VACUUM: Deleted %d files previously marked for deletion or orphaned", len(files))
+		return nil
+	})
+}
+
+// VacuumDryRun lists the files VACUUM with retain would delete
+func (l *Log) VacuumDryRun(retain *time.Duration) ([]string, error) {
+	logDB, err := l.importedLogDB()
+	if err != nil {
+		return nil, err
+	}
+	retention, err := l.vacuumRetention(logDB, retain)
+	if err != nil {
+		return nil, err
+	}
+	return l.listVacuumFiles(retention)
+}
+
+// listVacuumFiles lists files VACUUM deletes: files and deletion vectors removed longer than
+// retention ago that nothing live uses, and orphaned files
+func (l *Log) listVacuumFiles(retention time.Duration) ([]string, error) {
+	// files re-added after their remove, e.g. by RESTORE, are live again
+	files, err := l.queryFiles(`
+		SELECT path FROM file_actions_at($1)
+		WHERE remove IS NOT NULL AND remove.deletionTimestamp <= epoch_ms(CURRENT_TIMESTAMP) - $2`,
+		int64(latestVersion), retention.Milliseconds())
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deleted files: %w", err)
+	}
+	dvFiles, err := l.listRemovedDeletionVectors(retention)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deleted deletion vectors: %w", err)
+	}
+	files = append(files, dvFiles...)
+	orphans, err := l.listOrphanedFiles()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list orphaned files: %w", err)
+	}
+	return append(files, orphans...), nil
+}
+
+// countExpiredTombstones counts files removed longer than retention ago that were still kept
+// by a VACUUM at since
+func (l *Log) countExpiredTombstones(logDB *sql.DB, retention time.Duration, since time.Time) (int64, error) {
+	var n int64
+	err := logDB.QueryRow(`
+		SELECT count(*) FROM file_actions_at($1)
+		WHERE remove IS NOT NULL
+			AND remove.deletionTimestamp <= epoch_ms(CURRENT_TIMESTAMP) - $2
+			AND remove.deletionTimestamp > $3 - $2`,
+		int64(latestVersion), retention.Milliseconds(), since.UnixMilli()).Scan(&n)
+	if err != nil {
+		return 0, fmt.Errorf("failed to count expired tombstones of %s: %w", l.tableName, err)
+	}
+	return n, nil
+}
+
+type filesFilter int
+
+const (
+	filesAll filesFilter = iota
+	filesLive
+)
+
+//go:embed files_list_live.sql
+var sqlFilesListLive string
+
+// version to list files at to include everything committed or staged
+const latestVersion = math.MaxInt64
+
+//go:embed files_list_all.sql
+var sqlFilesListAll string
+
+// Lists parquet files managed by insert_log table
+func (l *Log) listFiles(filter filesFilter) ([]string, error) {
+	var query string
+	var args []any
+	switch filter {
+	case filesLive:
+		query, args = "SELECT path FROM ("+sqlFilesListLive+")", []any{latestVersion}
+	case filesAll:
+		query = sqlFilesListAll
+	}
+
+	files, err := l.queryFiles(query, args...)
+	if err != nil {
+		log.Error().Msgf("listFiles(%d) failed `%s`: %v", filter, query, err)
+		return nil, err
+	}
+	log.Debug().Msgf("listFiles %d: %v", filter, files)
+	return files, nil
+}
+
+// listRemovedDeletionVectors lists deletion vector files that only tombstones older than retention refer to
+func (l *Log) listRemovedDeletionVectors(retention time.Duration) ([]string, error) {
+	dvs, err := l.queryFiles(`
+		SELECT DISTINCT remove.deletionVector::JSON
+		FROM log_json
+		WHERE remove.deletionVector.storageType = 'u'
+			AND remove.deletionTimestamp <= epoch_ms(CURRENT_TIMESTAMP) - $2
+			AND remove.deletionVector NOT IN (
+				SELECT "add".deletionVector FROM file_actions_at($1) WHERE "add".deletionVector IS NOT NULL
+			)`, int64(latestVersion), retention.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	return deletionVectorPaths(dvs)
+}
+
+// deletionVectorPaths maps deletion vectors stored in files, as json, to their paths
+func deletionVectorPaths(dvs []string) ([]string, error) {
+	paths := make([]string, 0, len(dvs))
+	for _, dvJSON := range dvs {
+		var dv deletionVector
+		if err := json.Unmarshal([]byte(dvJSON), &dv); err != nil {
+			return nil, fmt.Errorf("bad deletion vector %s: %w", dvJSON, err)
+		}
+		path, err := dv.relativePath()
+		if err != nil {
+			return nil, err
+		}
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+// listOrphanedFiles lists files in the table's directory the log doesn't refer to, written more
+// than orphan_grace_seconds ago. Writes that failed before their commit leave these behind,
+// newer ones may be of a commit in progress. Like other readers, directories and files
+// starting with _ or . are skipped, other than partition directories.
+func (l *Log) listOrphanedFiles() ([]string, error) {
+	paths, err := l.queryFiles(sqlFilesListAll)
+	if err != nil {
+		return nil, err
+	}
+	dvs, err := l.queryFiles(`
+		SELECT DISTINCT dv::JSON FROM (
+			SELECT "add".deletionVector AS dv FROM log_json
+			UNION ALL
+			SELECT remove.deletionVector FROM log_json)
+		WHERE dv.storageType = 'u'`)
+	if err != nil {
+		return nil, err
+	}
+	dvPaths, err := deletionVectorPaths(dvs)
+	if err != nil {
+		return nil, err
+	}
+	referenced := map[string]bool{}
+	for _, path := range append(paths, dvPaths...) {
+		referenced[path] = true
+		// paths in the log are URIs, other writers escape them
+		if unescaped, err := url.PathUnescape(path); err == nil {
+			referenced[unescaped] = true
+		}
+	}
+
+	files, err := l.storage.List(l.tableName + "/")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files of %s: %w", l.tableName, err)
+	}
+	var orphans []string
+	for _, file := range files {
+		path, ok := strings.CutPrefix(file, l.tableName+"/")
+		if !ok || referenced[path] || isHiddenPath(path) {
+			continue
+		}
+		info, err := l.storage.Stat(file)
+		if err != nil {
+			if IsNotExist(err) {
+				continue
+			}
+			return nil, fmt.Errorf("failed to stat %s: %w", file, err)
+		}
+		if time.Since(info.ModTime()) < time.Duration(l.orphan_grace_seconds)*time.Second {
+			continue
+		}
+		orphans = append(orphans, path)
+	}
+	return orphans, nil
+}
+
+// isHiddenPath tells if path, relative to the table's directory, is in _delta_log or another
+// directory readers skip: any part of it starting with _ or . unless it's a col=value directory
+func isHiddenPath(path string) bool {
+	for _, part := range strings.Split(filepath.ToSlash(path), "/") {
+		if (strings.HasPrefix(part, "_") || strings.HasPrefix(part, ".")) && !strings.Contains(part, "=") {
+			return true
+		}
+	}
+	return false
+}
+
+// liveFile is a live parquet file with the deletion vector of rows deleted from it, if any
+type liveFile struct {
+	Path           string
+	DeletionVector *deletionVector
+	// values of partition columns kept out of the file, by physical name, see externalPartitionColumns
+	PartitionValues map[string]*string
+}
+
+// liveFilesQuery lists files live as of its $1 version that rows selectQuery selects can be in,
+// judging by their stats and partition values. columns are the table's as of version.
+func (l *Log) liveFilesQuery(logDB *sql.DB, selectQuery string, columns []tableColumn, version int64) (string, error) {
+	if selectQuery == "" {
+		return sqlFilesListLive, nil
+	}
+	predicates, err := selectPredicates(logDB, l.tableName, selectQuery)
+	if err != nil || len(predicates) == 0 {
+		return sqlFilesListLive, err
+	}
+	partitionBy, err := l.partitionBy(logDB)
+	if err != nil {
+		return "", err
+	}
+	physical, err := l.physicalNames(logDB, version)
+	if err != nil {
+		return "", err
+	}
+	types := columnTypes(columns)
+	condition := statsCondition(logDB, predicates, types, physical) + " AND " + partitionCondition(logDB, partitionBy, predicates, types, physical)
+	return sqlFilesListLive + " AND " + condition, nil
+}
+
+// queryLiveFiles runs a query returning paths and deletion vectors as json
+func (l *Log) queryLiveFiles(query string, args ...any) ([]liveFile, error) {
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, err
+	}
+
+	external, err := l.externalPartitionColumns(db)
+	if err != nil {
+		return nil, err
+	}
+	physical, err := l.physicalNames(db, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []liveFile
+	for rows.Next() {
+		var file liveFile
+		var dv, partitionValues sql.NullString
+		if err := rows.Scan(&file.Path, &dv, &partitionValues); err != nil {
+			return nil, err
+		}
+		if dv.Valid {
+			if err := json.Unmarshal([]byte(dv.String), &file.DeletionVector); err != nil {
+				return nil, fmt.Errorf("bad deletion vector of %s: %w", file.Path, err)
+			}
+		}
+		if len(external) > 0 {
+			values := map[string]*string{}
+			if partitionValues.Valid {
+				if err := json.Unmarshal([]byte(partitionValues.String), &values); err != nil {
+					return nil, fmt.Errorf("bad partitionValues of %s: %w", file.Path, err)
+				}
+			}
+			file.PartitionValues = map[string]*string{}
+			for _, column := range external {
+				name := physicalName(physical, column)
+				file.PartitionValues[name] = values[name]
+			}
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// queryFiles runs a query returning file paths against the log
+func (l *Log) queryFiles(query string, args ...any) ([]string, error) {
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var files []string
+	for rows.Next() {
+		var file string
+		err := rows.Scan(&file)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, rows.Err()
+}
+
+// resolveVersion finds the committed version of the table a TimeTravel refers to
+func (l *Log) resolveVersion(timeTravel *TimeTravel) (int64, error) {
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database: %w", err)
+	}
+	current, err := l.currentVersion(db)
+	if err != nil {
+		return 0, err
+	}
+
+	if timeTravel.Timestamp != "" {
+		var version sql.NullInt64
+		err := db.QueryRow(`
+			SELECT max(version) FROM commit_timestamps WHERE timestamp <= epoch_ms($1::TIMESTAMP)
+		`, timeTravel.Timestamp).Scan(&version)
+		if err != nil {
+			return 0, fmt.Errorf("failed to resolve TIMESTAMP AS OF '%s': %w", timeTravel.Timestamp, err)
+		}
+		if !version.Valid {
+			return 0, fmt.Errorf("%s has no version committed at or before '%s'", l.tableName, timeTravel.Timestamp)
+		}
+		return version.Int64, nil
+	}
+
+	if timeTravel.Version < 0 || timeTravel.Version > current {
+		return 0, fmt.Errorf("version %d of %s does not exist, latest version is %d", timeTravel.Version, l.tableName, current)
+	}
+	// commits before the checkpoint log was imported from are not in log_json
+	var oldest int64
+	if err := db.QueryRow("SELECT min(version) FROM log_json").Scan(&oldest); err != nil {
+		return 0, fmt.Errorf("failed to get oldest version: %w", err)
+	}
+	if timeTravel.Version < oldest {
+		return 0, fmt.Errorf("version %d of %s is older than checkpoint %d the log was loaded from", timeTravel.Version, l.tableName, oldest)
+	}
+	return timeTravel.Version, nil
+}
+
+// Fake a table for reading by creating a view of parquet files live at the latest version,
+// or at the version picked by timeTravel.
+// When selectQuery is a SELECT of the table, files it can't select rows from are left out.
+// Returns the number of files left out, when that's all of them the error is ErrNoParquetFilesInTable.
+func (l *Log) CreateViewOfParquet(dataTx *sql.Tx, timeTravel *TimeTravel, selectQuery string) (int, error) {
+	// Create permanent secret for the view operation
+	// TODO: would be better to wrap this around select-style operations :(
+	secretSQL := l.storage.ToDuckDBSecret("duckpond_view_s3_secret")
+	if secretSQL != "" {
+		if _, err := dataTx.Exec(secretSQL); err != nil {
+			return 0, fmt.Errorf("failed to create view secret: %w", err)
+		}
+		// Note we don't drop secret here as the view lifetime persists past this function
+	}
+
+	version := int64(latestVersion)
+	if timeTravel != nil {
+		var err error
+		if version, err = l.resolveVersion(timeTravel); err != nil {
+			return 0, err
+		}
+	}
+
+	logDB, err := l.getLogDBAfterImport()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get database: %w", err)
+	}
+	columns, err := l.columnsAt(dataTx, logDB, version)
+	if err != nil {
+		return 0, err
+	}
+	query, err := l.liveFilesQuery(logDB, selectQuery, columns, version)
+	if err != nil {
+		return 0, err
+	}
+	parquetFiles, err := l.queryLiveFiles(query, version)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list live parquet files: %w", err)
+	}
+	if err := l.checkProtocol(logDB, false); err != nil {
+		return 0, err
+	}
+	var liveCount int
+	if err := logDB.QueryRow("SELECT count(*) FROM ("+sqlFilesListLive+")", version).Scan(&liveCount); err != nil {
+		return 0, fmt.Errorf("failed to count live parquet files: %w", err)
+	}
+	pruned := liveCount - len(parquetFiles)
+	log.Debug().Int("pruned", pruned).Int("files", len(parquetFiles)).Msgf("CreateViewOfParquet: data skipping")
+	if len(parquetFiles) == 0 {
+		log.Debug().Msgf("CreateViewOfParquet: ErrNoParquetFilesInTable")
+		return pruned, ErrNoParquetFilesInTable
+	}
+
+	// read_parquet over the files from our log rather than delta_scan,
+	// so the view can be of any version and not only the one delta extension sees.
+	// Files are read together when they have the same values of partition columns kept out of them.
+	var groups, selects []string
+	paths := map[string][]string{}
+	partitionValues := map[string]map[string]*string{}
+	for _, file := range parquetFiles {
+		if file.DeletionVector == nil {
+			data, err := json.Marshal(file.PartitionValues)
+			if err != nil {
+				return 0, err
+			}
+			group := string(data)
+			if _, ok := paths[group]; !ok {
+				groups = append(groups, group)
+				partitionValues[group] = file.PartitionValues
+			}
+			paths[group] = append(paths[group], quoteSQLString(l.storage.ToDuckDBReadPath(filepath.Join(l.tableName, file.Path))))
+			continue
+		}
+		// files with deleted rows are read one by one to filter them out
+		rowsSQL, err := l.liveRowsSQL(dataTx, file)
+		if err != nil {
+			return 0, fmt.Errorf("failed to apply deletion vector of %s: %w", file.Path, err)
+		}
+		selects = append(selects, fmt.Sprintf("SELECT * EXCLUDE (file_row_number) FROM (%s)", rowsSQL))
+	}
+	for i, group := range groups {
+		read := readParquetSQL(paths[group], partitionValues[group], "union_by_name=true, hive_partitioning=false")
+		selects = slices.Insert(selects, i, read)
+	}
+	rows := strings.Join(selects, " UNION ALL BY NAME ")
+	if len(columns) > 0 {
+		physical, err := l.physicalNames(logDB, version)
+		if err != nil {
+			return 0, err
+		}
+		rows = tableSchema{columns: columns, physical: physical}.rowsSQL(rows)
+	}
+	createView := fmt.Sprintf("CREATE VIEW %s AS %s;", l.tableName, rows)
+	log.Debug().Int64("version", version).Msgf("createView: %s", createView)
+	_, err = dataTx.Exec(createView)
+	return pruned, err
+}
+
+// columnsAt lists columns of the table's schema as of version, none before it's created
+func (l *Log) columnsAt(dataTx *sql.Tx, logDB *sql.DB, version int64) ([]tableColumn, error) {
+	createQuery, err := l.createTableAt(logDB, version)
+	if err != nil || createQuery == "" {
+		return nil, err
+	}
+	// the table is only going to be a view, create it for a moment to know its columns
+	if _, err := dataTx.Exec(createQuery); err != nil {
+		return nil, fmt.Errorf("failed to execute schema_log query `%s`: %w", createQuery, err)
+	}
+	columns, err := tableColumns(dataTx, l.tableName)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := dataTx.Exec(fmt.Sprintf("DROP TABLE %s", l.tableName)); err != nil {
+		return nil, err
+	}
+	return columns, nil
+}
+
+// quoteSQLString renders s as a single-quoted SQL string literal
+func quoteSQLString(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", "''") + "'"
+}
+
+// createTableAt is the CREATE TABLE of the table's schema as of version, "" before it's created.
+// Tables other writers created have it derived from their schemaString.
+func (l *Log) createTableAt(logDB *sql.DB, version int64) (string, error) {
+	var createQuery sql.NullString
+	var schemaString string
+	err := logDB.QueryRow(`
+		SELECT metaData.duckpond.createTable::TEXT, metaData.schemaString
+		FROM log_json
+		WHERE metaData IS NOT NULL AND (version <= $1 OR version IS NULL AND $1 = $2)
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`, version, int64(latestVersion)).Scan(&createQuery, &schemaString)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to query schema_log: %w", err)
+	}
+	if !createQuery.Valid {
+		return createTableFromSchema(l.tableName, schemaString)
+	}
+	return createQuery.String, nil
+}
+
+// This creates an inmemory table that we COPY (l.tableName) TO ...parquet
+func (l *Log) CreateTempTable(dataTx *sql.Tx) error {
+
+	logDB, err := l.getLogDBAfterImport()
+	if err != nil {
+		return fmt.Errorf("failed to get log database: %w", err)
+	}
+
+	createQuery, err := l.createTableAt(logDB, latestVersion)
+	if err != nil {
+		return err
+	}
+	if createQuery == "" {
+		log.Debug().Msgf("CreateTempTable:  table hasn't been initialized yet")
+
+		// table hasn't been initialized yet
+		return nil
+	}
+
+	log.Debug().Msgf("CreateTempTable: %s", createQuery)
+
+	// Execute the create table statement
+	if _, err := dataTx.Exec(createQuery); err != nil {
+		return fmt.Errorf("failed to execute schema_log query `%s`: %w", createQuery, err)
+	}
+
+	return nil
+}
+
+// Imports commit files found in commitDir into log_json.
+// Each file is named after its version like in _delta_log.
+// passing JSON to keep all logic in DB
+// TODO: pass it in via arrow to reduce overhead
+func (l *Log) Import(commitDir string, version int64) error {
+
+	logdb, err := l.initLogDB()
+	if err != nil {
+		return err
+	}
+
+	columns, err := logJSONColumns(logdb)
+	if err != nil {
+		return err
+	}
+
+	// columns= makes read_json tolerate actions and fields log_json doesn't track
+	_, err = logdb.Exec(fmt.Sprintf(`
+		INSERT INTO log_json BY NAME
+		SELECT
+			* EXCLUDE (filename),
+			regexp_extract(filename, '(\d+)\.json$', 1)::BIGINT AS version
+		FROM read_json($1, format='newline_delimited', filename=true, columns=%s)
+	`, columns), filepath.Join(commitDir, "*.json"))
+	if err != nil {
+		return fmt.Errorf("failed to import commits: %w", err)
+	}
+
+	log.Debug().Msgf("Import: setting log_version=%d", version)
+	if _, err := logdb.Exec(fmt.Sprintf("SET VARIABLE log_version = %d", version)); err != nil {
+		return fmt.Errorf("failed to set log_version: %w", err)
+	}
+	return nil
+}
+
+// logJSONColumns renders log_json's action columns as a read_json columns= struct
+func logJSONColumns(db *sql.DB) (string, error) {
+	rows, err := db.Query(`
+		SELECT column_name, data_type
+		FROM duckdb_columns()
+		WHERE table_name = 'log_json' AND column_name != 'version'
+		ORDER BY column_index`)
+	if err != nil {
+		return "", fmt.Errorf("failed to get log_json columns: %w", err)
+	}
+	defer rows.Close()
+
+	var columns []string
+	for rows.Next() {
+		var name, dataType string
+		if err := rows.Scan(&name, &dataType); err != nil {
+			return "", err
+		}
+		columns = append(columns, fmt.Sprintf(`"%s": '%s'`, name, strings.ReplaceAll(dataType, "'", "''")))
+	}
+	return "{" + strings.Join(columns, ", ") + "}", rows.Err()
+}
+
+func (l *Log) Close() error {
+	if l.logDB != nil {
+		return l.logDB.Close()
+	}
+	return nil
+}
 
 func (l *Log) tigrisStaleCacheWorkaround() bool {
 	return strings.Contains(strings.ToLower(l.storage.GetEndpoint()), "tigris")
@@ -511,7 +2023,7 @@ func (l *Log) Destroy() error {
 	// deal with stale tigris cache by writing a blank log, so after when reading stale cache(while recreating table with same name), we don't have table metadata in it
 	if l.logDB != nil && l.tigrisStaleCacheWorkaround() {
 		log.Debug().Msgf("Writing a blank log to deal with tigris bug that likes to return stale read cache")
-		l.storage.Write(l.delta_log_json, []byte(`{}`))
+		l.storage.Write(l.commitPath(0), []byte(`{}`))
 	}
 
 	// Close database connection if open
@@ -522,52 +2034,162 @@ func (l *Log) Destroy() error {
 		l.logDB = nil
 	}
 
-	// Delete JSON log file
-	if err := l.storage.Delete(l.delta_log_json); err != nil {
-		return fmt.Errorf("failed to delete log.json: %w", err)
+	// Delete commit files
+	logFiles, err := l.storage.List(l.delta_log_dir)
+	if err != nil {
+		return fmt.Errorf("failed to list %s: %w", l.delta_log_dir, err)
+	}
+	for _, file := range logFiles {
+		if err := l.storage.Delete(file); err != nil {
+			return fmt.Errorf("failed to delete %s: %w", file, err)
+		}
 	}
 
 	return nil
 }
 
-// importPersistedLog reads the delta log from storage, writes it to a temp file,
-// and imports it into the log database
-func (l *Log) importPersistedLog() (err error) {
-	data, fileInfo, err := l.storage.Read(l.delta_log_json)
+var (
+	commitFileRe     = regexp.MustCompile(`^(\d{20})\.json$`)
+	checkpointFileRe = regexp.MustCompile(`^(\d{20})\.checkpoint(?:\.(\d{10})\.(\d{10}))?\.parquet$`)
+)
+
+// listCommitVersions lists versions of commit files present in _delta_log, sorted
+func (l *Log) listCommitVersions() ([]int64, error) {
+	versions, _, err := l.listLog()
+	return versions, err
+}
+
+// listLog lists versions of commit files present in _delta_log, sorted,
+// and finds the latest checkpoint with all of its parts present, nil when there is none
+func (l *Log) listLog() ([]int64, *lastCheckpoint, error) {
+	files, err := l.storage.List(l.delta_log_dir)
 	if err != nil {
-		// If the log file isn't present, skip import
-		log.Debug().Msgf("importPersistedLog(%s) assuming empty table '%s': %v", l.delta_log_json, l.tableName, err)
-		return nil
+		return nil, nil, err
+	}
+	var versions []int64
+	// parts present of each checkpoint, by version and number of parts
+	parts := map[lastCheckpoint]int{}
+	var checkpoint *lastCheckpoint
+	for _, file := range files {
+		if matches := commitFileRe.FindStringSubmatch(filepath.Base(file)); matches != nil {
+			version, err := strconv.ParseInt(matches[1], 10, 64)
+			if err != nil {
+				return nil, nil, err
+			}
+			versions = append(versions, version)
+			continue
+		}
+		matches := checkpointFileRe.FindStringSubmatch(filepath.Base(file))
+		if matches == nil {
+			continue
+		}
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, nil, err
+		}
+		found := lastCheckpoint{Version: version}
+		if matches[3] != "" {
+			found.Parts, _ = strconv.Atoi(matches[3])
+		}
+		parts[found]++
+		if parts[found] >= max(found.Parts, 1) && (checkpoint == nil || version > checkpoint.Version) {
+			checkpoint = &found
+		}
 	}
+	slices.Sort(versions)
+	return versions, checkpoint, nil
+}
 
-	if fileInfo.Size() <= 2 && l.tigrisStaleCacheWorkaround() {
-		log.Debug().Msgf("importPersistedLog(%s) empty or invalid json, assuming empty table on tigris", l.delta_log_json)
-		return nil
+// importPersistedLog reads commits newer than log_json's version from storage,
+// writes them to a temp dir and imports them into the log database.
+// Only the first import has to list _delta_log, afterwards we probe for the next version.
+func (l *Log) importPersistedLog() (err error) {
+	db, err := l.initLogDB()
+	if err != nil {
+		return err
+	}
+	version, err := l.currentVersion(db)
+	if err != nil {
+		return err
 	}
 
 	defer func() {
 		if err != nil {
-			log.Error().Msgf("importPersistedLog(%s) failed: %v", l.delta_log_json, err)
+			log.Error().Msgf("importPersistedLog(%s) failed: %v", l.delta_log_dir, err)
 		} else {
-			log.Debug().Msgf("importPersistedLog succeeded(%s)", l.delta_log_json)
+			log.Debug().Msgf("importPersistedLog succeeded(%s)", l.delta_log_dir)
 		}
 	}()
 
-	tmpFile, err := os.CreateTemp("", "dl-log-import-*.jsonl")
+	tmpDir, err := os.MkdirTemp("", "dl-log-import-*")
 	if err != nil {
-		return fmt.Errorf("failed to create temp file: %w", err)
+		return fmt.Errorf("failed to create temp dir: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	imported := version
+	var versions []int64
+	if version < 0 {
+		// start from the latest checkpoint and probe for commits after it
+		checkpoint, err := l.readLastCheckpoint()
+		if err != nil {
+			return fmt.Errorf("failed to read _last_checkpoint: %w", err)
+		}
+		if checkpoint == nil {
+			// _last_checkpoint is optional, other writers' checkpoints can be found by listing
+			versions, checkpoint, err = l.listLog()
+			if err != nil {
+				// If the log dir isn't present, skip import
+				log.Debug().Msgf("importPersistedLog(%s) assuming empty table '%s': %v", l.delta_log_dir, l.tableName, err)
+				return nil
+			}
+			if len(versions) == 0 && checkpoint == nil {
+				log.Debug().Msgf("importPersistedLog(%s) no commits, assuming empty table '%s'", l.delta_log_dir, l.tableName)
+				return nil
+			}
+		}
+		if checkpoint != nil {
+			if err := l.stageCheckpoint(db, tmpDir, *checkpoint); err != nil {
+				return err
+			}
+			imported = checkpoint.Version
+		}
+	}
+
+	for next := imported + 1; ; next++ {
+		if len(versions) > 0 {
+			if next > versions[len(versions)-1] {
+				break
+			}
+			if !slices.Contains(versions, next) {
+				return fmt.Errorf("commit %d is missing from %s", next, l.delta_log_dir)
+			}
+		}
+		commitPath := l.commitPath(next)
+		data, fileInfo, readErr := l.storage.Read(commitPath)
+		if readErr != nil {
+			if len(versions) == 0 && IsNotExist(readErr) {
+				// caught up with the latest commit
+				break
+			}
+			return fmt.Errorf("failed to read %s: %w", commitPath, readErr)
+		}
+		if fileInfo.Size() <= 2 && l.tigrisStaleCacheWorkaround() {
+			log.Debug().Msgf("importPersistedLog(%s) empty or invalid json, assuming empty table on tigris", commitPath)
+			break
+		}
+		if err := os.WriteFile(filepath.Join(tmpDir, filepath.Base(commitPath)), data, 0644); err != nil {
+			return fmt.Errorf("failed to write temp file: %w", err)
+		}
+		imported = next
 	}
-	defer tmpFile.Close()
-	defer os.Remove(tmpFile.Name())
 
-	if _, err := tmpFile.Write(data); err != nil {
-		return fmt.Errorf("failed to write temp file: %w", err)
+	if imported == version {
+		return nil
 	}
-	// Close for writes, it's ready for reads
-	tmpFile.Close()
 
-	if importErr := l.Import(tmpFile.Name(), fileInfo.ETag()); importErr != nil {
-		return fmt.Errorf("failed to import %s: %w", l.delta_log_json, importErr)
+	if importErr := l.Import(tmpDir, imported); importErr != nil {
+		return fmt.Errorf("failed to import %s: %w", l.delta_log_dir, importErr)
 	}
 
 	return nil
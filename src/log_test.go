@@ -0,0 +1,377 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	InitLogger("info")
+}
+
+// newTestDB opens a DuckpondDB over a storage dir of the test's own, destroyed and closed
+// when the test ends. opts can replace the storage dir.
+func newTestDB(t *testing.T, opts ...IceBaseOption) *DuckpondDB {
+	t.Helper()
+	ib, err := NewIceBase(append([]IceBaseOption{WithStorageDir(t.TempDir())}, opts...)...)
+	require.NoError(t, err, "Failed to create IceBase")
+	t.Cleanup(func() {
+		assert.NoError(t, ib.Destroy(), "Failed to clean up after test")
+		ib.Close()
+	})
+	return ib
+}
+
+// newLogTestTable creates a table with rowCount single-row inserts, so it has rowCount+1 commits
+func newLogTestTable(t *testing.T, rowCount int) *DuckpondDB {
+	t.Helper()
+	ib := newTestDB(t)
+	_, err := ib.PostEndpoint("/query", "CREATE TABLE log_test (id INTEGER, text VARCHAR)")
+	require.NoError(t, err, "CREATE TABLE failed")
+	for i := 0; i < rowCount; i++ {
+		_, err = ib.PostEndpoint("/query", fmt.Sprintf("INSERT INTO log_test VALUES (%d, 'row %d')", i, i))
+		require.NoError(t, err, "INSERT failed")
+	}
+	return ib
+}
+
+func TestCheckpointImport(t *testing.T) {
+	ib := newLogTestTable(t, 12)
+
+	// 13 commits with the default interval of 10 checkpoint version 10
+	checkpoint, err := ib.logs["log_test"].readLastCheckpoint()
+	assert.NoError(t, err)
+	if assert.NotNil(t, checkpoint, "_last_checkpoint was not written") {
+		assert.Equal(t, int64(10), checkpoint.Version)
+	}
+	_, err = ib.logs["log_test"].storage.Stat(filepath.Join("log_test", "_delta_log", "00000000000000000010.checkpoint.parquet"))
+	assert.NoError(t, err, "checkpoint parquet was not written")
+
+	// a fresh log starts from the checkpoint and replays the commits after it
+	coldLog := NewLog(ib.storageDir, "log_test")
+	defer coldLog.Close()
+	files, err := coldLog.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.Len(t, files, 12)
+
+	version, err := coldLog.currentVersion(coldLog.logDB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(12), version)
+
+	var createTable string
+	err = coldLog.logDB.QueryRow("SELECT metaData.duckpond.createTable FROM log_json WHERE metaData IS NOT NULL").Scan(&createTable)
+	assert.NoError(t, err, "metaData missing after checkpoint import")
+	assert.Equal(t, "CREATE TABLE log_test (id INTEGER, text VARCHAR)", createTable)
+}
+
+// stageAdd stages an 'add' of a parquet file that doesn't need to exist for log-only tests
+func stageAdd(t *testing.T, l *Log, path string) {
+	db, err := l.getLogDBAfterImport()
+	assert.NoError(t, err)
+	_, err = db.Exec(query_insert_table_event_add, path, 1, "{}", "{}", true)
+	assert.NoError(t, err, "failed to stage add of %s", path)
+}
+
+func TestCommitRetry(t *testing.T) {
+	ib := newLogTestTable(t, 1)
+
+	writer := NewLog(ib.storageDir, "log_test")
+	defer writer.Close()
+	racer := NewLog(ib.storageDir, "log_test")
+	defer racer.Close()
+
+	// racer commits version 2 after writer imported version 1, appends don't conflict
+	err := writer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+		assert.NoError(t, racer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+			stageAdd(t, racer, "data/racer.parquet")
+			return nil
+		}))
+		stageAdd(t, writer, "data/writer.parquet")
+		return nil
+	})
+	assert.NoError(t, err, "append should have been retried on top of concurrent append")
+	version, err := writer.currentVersion(writer.logDB)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), version)
+	files, err := writer.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.Contains(t, files, "data/racer.parquet")
+	assert.Contains(t, files, "data/writer.parquet")
+
+	// removing files conflicts with a concurrent add, like UPDATE racing an INSERT
+	err = writer.withPersistedLog(commitOperation{Name: "UPDATE"}, func() error {
+		assert.NoError(t, racer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+			stageAdd(t, racer, "data/racer2.parquet")
+			return nil
+		}))
+		for _, file := range files {
+			if _, err := writer.logDB.Exec(query_remove_file, file, true, int64(latestVersion)); err != nil {
+				return err
+			}
+		}
+		stageAdd(t, writer, "data/merged.parquet")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCommitConflict)
+
+	// conflicting actions are not left behind for the next commit
+	var staged int
+	assert.NoError(t, writer.logDB.QueryRow("SELECT count(*) FROM log_json WHERE version IS NULL").Scan(&staged))
+	assert.Equal(t, 0, staged)
+
+	// moving rows to other files, like OPTIMIZE, doesn't conflict with a concurrent add
+	err = writer.withPersistedLog(commitOperation{Name: "OPTIMIZE"}, func() error {
+		assert.NoError(t, racer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+			stageAdd(t, racer, "data/racer3.parquet")
+			return nil
+		}))
+		for _, file := range files {
+			if _, err := writer.logDB.Exec(query_remove_file, file, false, int64(latestVersion)); err != nil {
+				return err
+			}
+		}
+		stageAdd(t, writer, "data/optimized.parquet")
+		return nil
+	})
+	assert.NoError(t, err, "OPTIMIZE should have been retried on top of concurrent append")
+	files, err = writer.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{"data/racer2.parquet", "data/racer3.parquet", "data/optimized.parquet"}, files)
+
+	// writes of the same app conflict, the staged one may be a retry of the concurrent one
+	stageTxn := func(l *Log) {
+		_, err := l.logDB.Exec(`INSERT INTO log_json (txn) SELECT {'appId': 'ingest', 'version': 1::BIGINT, 'lastUpdated': 0::BIGINT}`)
+		assert.NoError(t, err)
+	}
+	err = writer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+		assert.NoError(t, racer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+			stageTxn(racer)
+			stageAdd(t, racer, "data/racer4.parquet")
+			return nil
+		}))
+		stageTxn(writer)
+		stageAdd(t, writer, "data/retry.parquet")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCommitConflict)
+}
+
+func TestCommitRetryPrimaryKey(t *testing.T) {
+	ib := newTestDB(t)
+	_, err := ib.PostEndpoint("/query", "CREATE TABLE keyed (id INTEGER PRIMARY KEY)")
+	require.NoError(t, err)
+
+	writer := NewLog(ib.storageDir, "keyed")
+	defer writer.Close()
+	racer := NewLog(ib.storageDir, "keyed")
+	defer racer.Close()
+
+	// keys were checked before the racer committed, its rows may have the same ones
+	err = writer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+		assert.NoError(t, racer.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+			stageAdd(t, racer, "data/racer.parquet")
+			return nil
+		}))
+		stageAdd(t, writer, "data/writer.parquet")
+		return nil
+	})
+	assert.ErrorIs(t, err, ErrCommitConflict)
+	files, err := writer.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data/racer.parquet"}, files)
+}
+
+func TestVacuumOrphanedFiles(t *testing.T) {
+	ib := newLogTestTable(t, 2)
+
+	// files of writes that died before committing, one old enough to be deleted
+	dataDir := filepath.Join(ib.storageDir, "log_test", "data")
+	oldOrphan := filepath.Join(dataDir, "orphan_old.parquet")
+	newOrphan := filepath.Join(dataDir, "orphan_new.parquet")
+	assert.NoError(t, os.WriteFile(oldOrphan, []byte("not parquet"), 0644))
+	assert.NoError(t, os.WriteFile(newOrphan, []byte("not parquet"), 0644))
+	old := time.Now().Add(-2 * time.Hour)
+	assert.NoError(t, os.Chtimes(oldOrphan, old, old))
+
+	orphans, err := ib.logs["log_test"].listOrphanedFiles()
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"data/orphan_old.parquet"}, orphans)
+
+	_, err = ib.PostEndpoint("/query", "VACUUM log_test")
+	assert.NoError(t, err, "VACUUM failed")
+	assert.NoFileExists(t, oldOrphan, "orphan past the grace period was not deleted")
+	assert.FileExists(t, newOrphan, "orphan within the grace period, maybe of a commit in progress, was deleted")
+
+	files, err := ib.logs["log_test"].listFiles(filesLive)
+	assert.NoError(t, err)
+	for _, file := range files {
+		assert.FileExists(t, filepath.Join(ib.storageDir, "log_test", file), "live file was deleted")
+	}
+	result, err := ib.PostEndpoint("/query", "SELECT count(*) FROM log_test")
+	assert.NoError(t, err)
+	assert.Contains(t, result, `"data":[["2"]]`)
+}
+
+func TestAbandonedCommitDeletesFiles(t *testing.T) {
+	ib := newLogTestTable(t, 1)
+
+	l := ib.logs["log_test"]
+	written := filepath.Join(ib.storageDir, "log_test", "data", "abandoned.parquet")
+	err := l.withPersistedLog(commitOperation{Name: "INSERT"}, func() error {
+		assert.NoError(t, l.storage.Write(filepath.Join("log_test", "data", "abandoned.parquet"), []byte("not parquet")))
+		stageAdd(t, l, "data/abandoned.parquet")
+		return fmt.Errorf("write failed after upload")
+	})
+	assert.Error(t, err)
+	assert.NoFileExists(t, written, "file of the abandoned commit was left behind")
+
+	files, err := l.listFiles(filesLive)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+	for _, file := range files {
+		assert.FileExists(t, filepath.Join(ib.storageDir, "log_test", file), "committed file was deleted")
+	}
+}
+
+func TestVacuumRetention(t *testing.T) {
+	ib := newLogTestTable(t, 1)
+
+	for value, expected := range map[string]time.Duration{
+		"interval 1 week":   7 * 24 * time.Hour,
+		"interval 30 days":  30 * 24 * time.Hour,
+		"INTERVAL 2 HOURS":  2 * time.Hour,
+		"90 minutes":        90 * time.Minute,
+		"interval 1 second": time.Second,
+	} {
+		retention, err := parseInterval(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, retention, value)
+	}
+	_, err := parseInterval("a week")
+	assert.Error(t, err)
+
+	_, err = ib.PostEndpoint("/query", "ALTER TABLE log_test SET TBLPROPERTIES ('delta.deletedFileRetentionDuration' = 'a week')")
+	assert.Error(t, err, "bad retention should be rejected")
+	_, err = ib.PostEndpoint("/query", "ALTER TABLE log_test SET TBLPROPERTIES ('delta.deletedFileRetentionDuration' = 'interval 2 hours')")
+	assert.NoError(t, err)
+
+	l := ib.logs["log_test"]
+	logDB, err := l.importedLogDB()
+	assert.NoError(t, err)
+	retention, err := l.vacuumRetention(logDB, nil)
+	assert.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, retention)
+	longer := 3 * time.Hour
+	retention, err = l.vacuumRetention(logDB, &longer)
+	assert.NoError(t, err)
+	assert.Equal(t, longer, retention)
+
+	_, err = ib.PostEndpoint("/query", "VACUUM log_test RETAIN 1 HOURS")
+	assert.Error(t, err, "RETAIN shorter than the table's retention should be rejected")
+	_, err = ib.PostEndpoint("/query", "VACUUM log_test RETAIN 0 HOURS DRY RUN")
+	assert.Error(t, err, "RETAIN shorter than the table's retention should be rejected")
+}
+
+func TestTargetFileSize(t *testing.T) {
+	ib := newLogTestTable(t, 0)
+
+	for value, expected := range map[string]int64{
+		"1048576": 1 << 20,
+		"512kb":   512 << 10,
+		"128MB":   128 << 20,
+		"1 gb":    1 << 30,
+	} {
+		size, err := parseByteSize(value)
+		assert.NoError(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+	for _, value := range []string{"0", "big", "1tb"} {
+		_, err := parseByteSize(value)
+		assert.Error(t, err, value)
+	}
+
+	_, err := ib.PostEndpoint("/query", "ALTER TABLE log_test SET TBLPROPERTIES ('delta.targetFileSize' = 'big')")
+	assert.Error(t, err, "bad size should be rejected")
+	_, err = ib.PostEndpoint("/query", "ALTER TABLE log_test SET TBLPROPERTIES ('delta.targetFileSize' = '1mb')")
+	assert.NoError(t, err)
+
+	// DuckDB splits files between row groups of 122880 rows, each is well over 1mb
+	_, err = ib.PostEndpoint("/query", "INSERT INTO log_test SELECT range, md5(range::VARCHAR) FROM range(300000)")
+	assert.NoError(t, err)
+	l := ib.logs["log_test"]
+	var files, records int64
+	assert.NoError(t, l.logDB.QueryRow(`
+		SELECT count(*), sum(("add".stats::JSON->>'numRecords')::BIGINT) FROM log_json
+		WHERE version = (SELECT max(version) FROM log_json) AND "add" IS NOT NULL`).Scan(&files, &records))
+	assert.Greater(t, files, int64(1), "INSERT should add a file per target size in one commit")
+	assert.Equal(t, int64(300000), records, "each file should have stats of its own rows")
+	assert.Equal(t, "300000", queryIDs(t, ib, "SELECT count(*) FROM log_test"))
+}
+
+func TestIdempotentInsert(t *testing.T) {
+	ib := newLogTestTable(t, 0)
+	ib.options.enableQuerySplitting = true
+
+	insert := func(query string, txn *Txn) {
+		_, err := ib.PostEndpointWithOptions("/query", query, QueryOptions{Txn: txn})
+		assert.NoError(t, err, query)
+	}
+	insert("INSERT INTO log_test VALUES (1, 'first')", &Txn{AppID: "ingest", Version: 1})
+	insert("INSERT INTO log_test VALUES (1, 'first')", &Txn{AppID: "ingest", Version: 1})
+	assert.Equal(t, "1", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"), "retry should be skipped")
+
+	insert("SET duckpond.txn = 'ingest:2'; INSERT INTO log_test VALUES (2, 'second')", nil)
+	insert("SET duckpond.txn = 'ingest:2'; INSERT INTO log_test VALUES (2, 'second')", nil)
+	insert("INSERT INTO log_test VALUES (3, 'other app')", &Txn{AppID: "backfill", Version: 1})
+	assert.Equal(t, "1,2,3", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"))
+
+	_, err := ib.PostEndpointWithOptions("/query", "INSERT INTO log_test VALUES (4, 'a'); INSERT INTO log_test VALUES (5, 'b')",
+		QueryOptions{Txn: &Txn{AppID: "ingest", Version: 3}})
+	assert.Error(t, err, "a second write of the table would be skipped as a retry of the first")
+	assert.Equal(t, "1,2,3", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"), "nothing of the request should be committed")
+	_, err = ib.PostEndpointWithOptions("/query", "SET duckpond.txn = 'ingest:3'; INSERT INTO log_test VALUES (4, 'a'); SET duckpond.txn = 'ingest:3'; INSERT INTO log_test VALUES (5, 'b')", QueryOptions{})
+	assert.Error(t, err, "SET of the same key again doesn't make it usable for another write")
+	assert.Equal(t, "1,2,3", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"))
+	insert("INSERT INTO log_test VALUES (4, 'a')", &Txn{AppID: "ingest", Version: 3})
+	assert.Equal(t, "1,2,3,4", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"), "retry with one write per table should commit")
+	_, err = ib.PostEndpoint("/query", "SET duckpond.txn = 'ingest'")
+	assert.Error(t, err, "key without a version should be rejected")
+
+	// Idempotency-Key headers are opaque keys, a retry with one is skipped
+	handler := ib.RequestHandler()
+	post := func(key string, id int) int {
+		request := httptest.NewRequest(http.MethodPost, "/query", strings.NewReader(fmt.Sprintf("INSERT INTO log_test VALUES (%d, 'keyed')", id)))
+		request.Header.Set("Idempotency-Key", key)
+		recorder := httptest.NewRecorder()
+		handler(recorder, request)
+		return recorder.Code
+	}
+	assert.Equal(t, http.StatusOK, post("3f2b5c1e-9d4a-4f6e-8b7a-1c2d3e4f5a6b", 5))
+	assert.Equal(t, http.StatusOK, post("3f2b5c1e-9d4a-4f6e-8b7a-1c2d3e4f5a6b", 5))
+	assert.Equal(t, http.StatusOK, post("ingest:1", 6), "a key that looks like appId:version is opaque too")
+	assert.Equal(t, "1,2,3,4,5,6", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"))
+
+	// txns are read back from commits and checkpoints
+	l := ib.logs["log_test"]
+	version, err := l.currentVersion(l.logDB)
+	require.NoError(t, err)
+	require.NoError(t, l.writeCheckpoint(l.logDB, version))
+	reader := NewLog(ib.storageDir, "log_test")
+	defer reader.Close()
+	logDB, err := reader.importedLogDB()
+	require.NoError(t, err)
+	for _, txn := range []Txn{{"ingest", 4}, {"ingest", 3}, {"ingest", 2}, {"backfill", 1}} {
+		committed, err := reader.txnCommitted(logDB, &txn)
+		assert.NoError(t, err)
+		assert.Equal(t, txn.Version < 4, committed, "%s:%d", txn.AppID, txn.Version)
+	}
+}
@@ -18,6 +18,8 @@ func main() {
 	versionFlag := flag.Bool("version", false, "print the version and exit")
 	loadExtFlag := flag.Bool("load-extensions", false, "load DuckDB extensions from extension paths")
 	installExtFlag := flag.Bool("install-extensions", false, "install (INSTALL then LOAD) DuckDB extensions")
+	maintenanceInterval := flag.Duration("maintenance-interval", 0, "with -port, check tables this often and OPTIMIZE/VACUUM them in the background when needed, e.g. 1m (0 disables)")
+	compactMinFiles := flag.Int("compact-min-files", 50, "background OPTIMIZE a table once it has this many small files")
 	flag.Parse()
 
 	if *loadExtFlag || *installExtFlag {
@@ -69,6 +71,10 @@ func main() {
 	if *port != 0 {
 		addr := fmt.Sprintf(":%d", *port)
 		log.Info().Msgf("Starting server on %s", addr)
+		if *maintenanceInterval > 0 {
+			stop := ib.StartMaintenance(MaintenanceOptions{Interval: *maintenanceInterval, MinFilesToCompact: *compactMinFiles})
+			defer stop()
+		}
 		handler := ib.RequestHandler()
 		http.HandleFunc("/query", handler)
 		http.HandleFunc("/parse", handler)
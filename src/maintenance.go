@@ -0,0 +1,174 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rs/zerolog/log"
+)
+
+// MaintenanceOptions configure background compaction and tombstone cleanup
+type MaintenanceOptions struct {
+	// how often tables are checked
+	Interval time.Duration
+	// OPTIMIZE a table once it has at least this many files to compact
+	MinFilesToCompact int
+}
+
+// defaultMaintenanceRetention is how long background VACUUM keeps removed files of tables without
+// delta.deletedFileRetentionDuration, Delta's default. TTL_SECONDS only applies to VACUUM statements.
+const defaultMaintenanceRetention = 7 * 24 * time.Hour
+
+// maintenance OPTIMIZEs and VACUUMs tables the server has opened when they need it
+type maintenance struct {
+	ib      *DuckpondDB
+	options MaintenanceOptions
+	// per table, when maintenance last VACUUMed it
+	vacuumed map[string]time.Time
+	// DATA database of its own, queries of other tables run meanwhile
+	dataDB *sql.DB
+}
+
+func newMaintenance(ib *DuckpondDB, options MaintenanceOptions) *maintenance {
+	return &maintenance{ib: ib, options: options, vacuumed: map[string]time.Time{}}
+}
+
+// StartMaintenance checks tables every options.Interval in the background until stop is called
+func (ib *DuckpondDB) StartMaintenance(options MaintenanceOptions) (stop func()) {
+	m := newMaintenance(ib, options)
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(options.Interval)
+		defer ticker.Stop()
+		defer m.close()
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				m.run()
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+// close closes the DATA database of maintenance
+func (m *maintenance) close() {
+	if m.dataDB != nil {
+		m.dataDB.Close()
+		m.dataDB = nil
+	}
+}
+
+// run maintains each table in turn, only queries of the table being maintained wait for it
+func (m *maintenance) run() {
+	m.ib.mu.Lock()
+	tables := slices.Sorted(maps.Keys(m.ib.logs))
+	m.ib.mu.Unlock()
+	for _, table := range tables {
+		m.ib.mu.Lock()
+		dblog, ok := m.ib.logs[table]
+		if !ok {
+			// dropped since run listed it
+			m.ib.mu.Unlock()
+			continue
+		}
+		dblog.mu.Lock()
+		m.ib.mu.Unlock()
+		err := m.maintainTable(dblog)
+		dblog.mu.Unlock()
+		if err != nil {
+			log.Error().Err(err).Str("table", table).Msg("Background maintenance failed")
+		}
+	}
+}
+
+// maintainTable OPTIMIZEs the table when it has MinFilesToCompact files to compact, unless
+// delta.autoOptimize.autoCompact is false, and VACUUMs it when files were removed longer than
+// its retention ago since the last VACUUM, see defaultMaintenanceRetention. Both commit like their
+// statements, retrying on conflicts.
+func (m *maintenance) maintainTable(dblog *Log) error {
+	table := dblog.tableName
+	logDB, err := dblog.getLogDBAfterImport()
+	if err != nil {
+		return fmt.Errorf("failed to get database: %w", err)
+	}
+	if err := dblog.importPersistedLog(); err != nil {
+		return err
+	}
+	if version, err := dblog.currentVersion(logDB); err != nil || version < 0 {
+		return err
+	}
+
+	autoCompact, err := dblog.tableProperty(logDB, "delta.autoOptimize.autoCompact")
+	if err != nil {
+		return err
+	}
+	if !strings.EqualFold(autoCompact, "false") {
+		n, err := dblog.filesToCompact(logDB)
+		if err != nil {
+			return err
+		}
+		if n >= m.options.MinFilesToCompact {
+			if err := m.optimize(dblog); err != nil {
+				return fmt.Errorf("OPTIMIZE failed for %s: %w", table, err)
+			}
+		}
+	}
+
+	retention, configured, err := dblog.deletedFileRetention(logDB)
+	if err != nil {
+		return err
+	}
+	if !configured {
+		retention = defaultMaintenanceRetention
+	}
+	started := time.Now()
+	expired, err := dblog.countExpiredTombstones(logDB, retention, m.vacuumed[table])
+	if err != nil || expired == 0 {
+		return err
+	}
+	if err := dblog.Vacuum(&retention); err != nil {
+		return fmt.Errorf("VACUUM failed for %s: %w", table, err)
+	}
+	m.vacuumed[table] = started
+	return nil
+}
+
+// optimize runs OPTIMIZE on the table like a query would, in a transaction of the DATA database of maintenance
+func (m *maintenance) optimize(dblog *Log) error {
+	if m.dataDB == nil {
+		db, err := InitializeDuckDB()
+		if err != nil {
+			return fmt.Errorf("failed to initialize database: %w", err)
+		}
+		m.dataDB = db
+	}
+	dataTx, err := m.dataDB.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin DATA transaction: %w", err)
+	}
+	defer func() {
+		if err := dataTx.Rollback(); err != nil {
+			log.Error().Err(err).Msg("Failed to rollback transaction")
+		}
+	}()
+	if err := dblog.CreateTempTable(dataTx); err != nil {
+		return err
+	}
+	metrics, err := dblog.Optimize(dataTx, Optimize{})
+	if err != nil {
+		return err
+	}
+	log.Info().
+		Str("table", dblog.tableName).
+		Int64("files_added", metrics.FilesAdded).
+		Int64("files_removed", metrics.FilesRemoved).
+		Msg("Background OPTIMIZE")
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance(t *testing.T) {
+	ib := newTestDB(t)
+
+	for _, query := range []string{
+		"CREATE TABLE maintained (id INTEGER)",
+		"INSERT INTO maintained VALUES (1)",
+		"INSERT INTO maintained VALUES (2)",
+		"INSERT INTO maintained VALUES (3)",
+	} {
+		_, err := ib.PostEndpoint("/query", query)
+		require.NoError(t, err, query)
+	}
+	l := ib.logs["maintained"]
+	parquetFiles := func() int {
+		files, err := l.storage.List("maintained/")
+		require.NoError(t, err)
+		var n int
+		for _, file := range files {
+			if strings.HasSuffix(file, ".parquet") && !isHiddenPath(filepath.ToSlash(file)) {
+				n++
+			}
+		}
+		return n
+	}
+	m := newMaintenance(ib, MaintenanceOptions{MinFilesToCompact: 3})
+	defer m.close()
+
+	// 3 small files are compacted, without a retention of the table the files they replace are kept
+	m.run()
+	files, err := l.listFiles(filesLive)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, 4, parquetFiles(), "removed files should be kept for a week")
+
+	// and deleted past the table's retention
+	_, err = ib.PostEndpoint("/query", "ALTER TABLE maintained SET TBLPROPERTIES ('delta.deletedFileRetentionDuration' = 'interval 0 seconds')")
+	require.NoError(t, err)
+	m.run()
+	files, err = l.listFiles(filesLive)
+	require.NoError(t, err)
+	assert.Len(t, files, 1)
+	assert.Equal(t, 1, parquetFiles(), "compacted files should be vacuumed")
+	assert.Equal(t, "1,2,3", queryIDs(t, ib, "SELECT id FROM maintained ORDER BY id"))
+
+	// nothing left to do, nothing is committed
+	version, err := l.currentVersion(l.logDB)
+	require.NoError(t, err)
+	m.run()
+	after, err := l.currentVersion(l.logDB)
+	require.NoError(t, err)
+	assert.Equal(t, version, after)
+
+	// tables can opt out of compaction
+	for _, query := range []string{
+		"ALTER TABLE maintained SET TBLPROPERTIES ('delta.autoOptimize.autoCompact' = 'false')",
+		"INSERT INTO maintained VALUES (4)",
+		"INSERT INTO maintained VALUES (5)",
+	} {
+		_, err := ib.PostEndpoint("/query", query)
+		require.NoError(t, err, query)
+	}
+	m.run()
+	files, err = l.listFiles(filesLive)
+	require.NoError(t, err)
+	assert.Len(t, files, 3)
+
+	// queries of other tables don't wait for a table being maintained
+	l.mu.Lock()
+	done := make(chan error)
+	go func() {
+		_, err := ib.PostEndpoint("/query", "CREATE TABLE unrelated (id INTEGER)")
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Error("query of another table waited for maintenance")
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,316 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// optimizeFile is a live file OPTIMIZE may rewrite
+type optimizeFile struct {
+	liveFile
+	Size int64
+	// add.partitionValues as json, files are only combined with files of the same partition
+	Partition string
+}
+
+// optimizeMetrics counts files OPTIMIZE added and removed
+type optimizeMetrics struct {
+	FilesAdded   int64
+	FilesRemoved int64
+}
+
+// binPack groups files smaller than target, or with rows deleted from them, into bins of up to
+// target bytes, smallest files first. A bin of a single file without deleted rows is left out,
+// rewriting it gains nothing.
+func binPack(files []optimizeFile, target int64) [][]optimizeFile {
+	files = slices.Clone(files)
+	slices.SortStableFunc(files, func(a, b optimizeFile) int {
+		return int(a.Size - b.Size)
+	})
+	var bins [][]optimizeFile
+	var bin []optimizeFile
+	var binSize int64
+	for _, file := range files {
+		if file.Size >= target && file.DeletionVector == nil {
+			continue
+		}
+		if len(bin) > 0 && binSize+file.Size > target {
+			bins = append(bins, bin)
+			bin, binSize = nil, 0
+		}
+		bin = append(bin, file)
+		binSize += file.Size
+	}
+	if len(bin) > 0 {
+		bins = append(bins, bin)
+	}
+	return slices.DeleteFunc(bins, func(bin []optimizeFile) bool {
+		return len(bin) == 1 && bin[0].DeletionVector == nil
+	})
+}
+
+// byPartition groups files by partition, in order of their partitionValues
+func byPartition(files []optimizeFile) [][]optimizeFile {
+	grouped := map[string][]optimizeFile{}
+	for _, file := range files {
+		grouped[file.Partition] = append(grouped[file.Partition], file)
+	}
+	partitions := slices.Sorted(maps.Keys(grouped))
+	groups := make([][]optimizeFile, len(partitions))
+	for i, partition := range partitions {
+		groups[i] = grouped[partition]
+	}
+	return groups
+}
+
+// zOrderSQL adds a duckpond_zorder column to rows placing them on a z-order curve over columns:
+// values of each column are ranked into buckets and the bits of the buckets interleaved,
+// so rows close in all of the columns get close duckpond_zorder
+func zOrderSQL(rows string, columns []string) string {
+	bits := min(16, 63/len(columns))
+	ranks := make([]string, len(columns))
+	exclude := make([]string, len(columns))
+	for j, column := range columns {
+		ranks[j] = fmt.Sprintf("ntile(%d) OVER (ORDER BY %s) - 1 AS duckpond_z%d", 1<<bits, quoteIdentifier(column), j)
+		exclude[j] = fmt.Sprintf("duckpond_z%d", j)
+	}
+	var terms []string
+	for i := 0; i < bits; i++ {
+		for j := range columns {
+			terms = append(terms, fmt.Sprintf("(((duckpond_z%d >> %d) & 1) << %d)", j, i, i*len(columns)+j))
+		}
+	}
+	return fmt.Sprintf("SELECT * EXCLUDE (%s), %s AS duckpond_zorder FROM (SELECT *, %s FROM (%s))",
+		strings.Join(exclude, ", "), strings.Join(terms, " + "), strings.Join(ranks, ", "), rows)
+}
+
+// Optimize compacts small files of the table created by CreateTempTable: per partition, files
+// smaller than delta.targetFileSize, or with deleted rows, are bin-packed into files of up to
+// that size. With ZORDER BY, all files of each partition are rewritten with their rows sorted along a
+// z-order curve of the columns, so data skipping works for all of them. WHERE limits it to
+// partitions matching a predicate on partition columns. Removes and adds have dataChange false,
+// readers see the same rows.
+func (l *Log) Optimize(dataTx *sql.Tx, optimize Optimize) (optimizeMetrics, error) {
+	predicate := []string{}
+	if optimize.Where != "" {
+		predicate = append(predicate, optimize.Where)
+	}
+	predicateJSON, err := json.Marshal(predicate)
+	if err != nil {
+		return optimizeMetrics{}, err
+	}
+	zOrderJSON, err := json.Marshal(append([]string{}, optimize.ZOrderBy...))
+	if err != nil {
+		return optimizeMetrics{}, err
+	}
+	operation := commitOperation{Name: "OPTIMIZE", Parameters: map[string]string{
+		"predicate": string(predicateJSON),
+		"zOrderBy":  string(zOrderJSON),
+	}}
+
+	var metrics optimizeMetrics
+	err = l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		partitionBy, err := l.partitionBy(logDB)
+		if err != nil {
+			return err
+		}
+		columns, err := tableColumnTypes(dataTx, l.tableName)
+		if err != nil {
+			return err
+		}
+		for _, column := range optimize.ZOrderBy {
+			if _, ok := columns[strings.ToLower(column)]; !ok {
+				return fmt.Errorf("ZORDER BY column %s is not a column of %s", column, l.tableName)
+			}
+			if slices.ContainsFunc(partitionBy, func(p PartitionColumn) bool { return strings.EqualFold(p.Name, column) }) {
+				return fmt.Errorf("ZORDER BY partition column %s, files are already split by it", column)
+			}
+		}
+
+		files, err := l.optimizeCandidates(logDB, partitionBy, columns, optimize.Where)
+		if err != nil {
+			return err
+		}
+		schema, err := l.currentSchema(dataTx, logDB)
+		if err != nil {
+			return err
+		}
+		targetFileSize, err := l.targetFileSize(logDB)
+		if err != nil {
+			return err
+		}
+		for _, files := range byPartition(files) {
+			if len(optimize.ZOrderBy) > 0 {
+				if err := l.rewriteOptimized(dataTx, logDB, schema, files, optimize.ZOrderBy); err != nil {
+					return err
+				}
+				continue
+			}
+			for _, bin := range binPack(files, targetFileSize) {
+				if err := l.rewriteOptimized(dataTx, logDB, schema, bin, nil); err != nil {
+					return err
+				}
+			}
+		}
+		return logDB.QueryRow(`SELECT count("add"), count(remove) FROM log_json WHERE version IS NULL`).
+			Scan(&metrics.FilesAdded, &metrics.FilesRemoved)
+	})
+	return metrics, err
+}
+
+// optimizeCandidates lists live files with their sizes and partitions, only of partitions
+// matching where when it's given. where can only use partition columns.
+func (l *Log) optimizeCandidates(logDB *sql.DB, partitionBy []PartitionColumn, columns map[string][2]string, where string) ([]optimizeFile, error) {
+	live, err := l.queryLiveFiles(sqlFilesListLive, int64(latestVersion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files to optimize: %w", err)
+	}
+	rows, err := logDB.Query(`
+		SELECT path, "add".size, coalesce("add".partitionValues::JSON::VARCHAR, '{}')
+		FROM file_actions_at($1)
+		WHERE "add" IS NOT NULL`, int64(latestVersion))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list sizes of files to optimize: %w", err)
+	}
+	defer rows.Close()
+	sizes := map[string]int64{}
+	partitions := map[string]string{}
+	for rows.Next() {
+		var path, partition string
+		var size sql.NullInt64
+		if err := rows.Scan(&path, &size, &partition); err != nil {
+			return nil, err
+		}
+		sizes[path], partitions[path] = size.Int64, partition
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matching := func(string) (bool, error) { return true, nil }
+	if where != "" {
+		if matching, err = l.partitionPredicate(logDB, partitionBy, columns, where); err != nil {
+			return nil, err
+		}
+	}
+	var files []optimizeFile
+	for _, file := range live {
+		ok, err := matching(partitions[file.Path])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			files = append(files, optimizeFile{liveFile: file, Size: sizes[file.Path], Partition: partitions[file.Path]})
+		}
+	}
+	return files, nil
+}
+
+// partitionPredicate evaluates where for partitions by their partitionValues json,
+// it fails when where uses columns other than partition columns
+func (l *Log) partitionPredicate(logDB *sql.DB, partitionBy []PartitionColumn, columns map[string][2]string, where string) (func(string) (bool, error), error) {
+	pinned := map[string]bool{}
+	for _, column := range partitionBy {
+		pinned[strings.ToLower(column.Name)] = true
+	}
+	if len(partitionBy) == 0 || !allPinned(logDB, where, pinned) {
+		return nil, fmt.Errorf("OPTIMIZE WHERE can only use partition columns of %s", l.tableName)
+	}
+	physical, err := l.physicalNames(logDB, latestVersion)
+	if err != nil {
+		return nil, err
+	}
+	evaluated := map[string]bool{}
+	return func(partition string) (bool, error) {
+		if match, ok := evaluated[partition]; ok {
+			return match, nil
+		}
+		var values map[string]*string
+		if err := json.Unmarshal([]byte(partition), &values); err != nil {
+			return false, fmt.Errorf("bad partitionValues %s: %w", partition, err)
+		}
+		selected := make([]string, len(partitionBy))
+		for i, column := range partitionBy {
+			dataType := "VARCHAR"
+			if c, ok := columns[strings.ToLower(column.Name)]; ok {
+				dataType = c[1]
+			}
+			value := "NULL"
+			if v := values[physicalName(physical, column.Name)]; v != nil {
+				value = quoteSQLString(*v)
+			}
+			selected[i] = fmt.Sprintf("TRY_CAST(%s AS %s) AS %s", value, dataType, quoteIdentifier(column.Name))
+		}
+		var match sql.NullBool
+		query := fmt.Sprintf("SELECT (%s)::BOOLEAN FROM (SELECT %s)", where, strings.Join(selected, ", "))
+		if err := logDB.QueryRow(query).Scan(&match); err != nil {
+			return false, fmt.Errorf("bad OPTIMIZE WHERE %s: %w", where, err)
+		}
+		evaluated[partition] = match.Bool
+		return match.Bool, nil
+	}, nil
+}
+
+// rewriteOptimized stages rows of files, all of one partition, as new files in place of them,
+// split at the target size. Rows are sorted along a z-order curve of zOrderBy when given.
+func (l *Log) rewriteOptimized(dataTx *sql.Tx, logDB *sql.DB, schema tableSchema, files []optimizeFile, zOrderBy []string) error {
+	selects := make([]string, len(files))
+	err := l.WithDuckDBSecret(dataTx, func() error {
+		for i, file := range files {
+			rowsSQL, err := l.liveRowsSQL(dataTx, file.liveFile)
+			if err != nil {
+				return err
+			}
+			selects[i] = schema.rowsSQL(rowsSQL)
+		}
+		rows := strings.Join(selects, " UNION ALL ")
+		if len(zOrderBy) > 0 {
+			rows = fmt.Sprintf("SELECT * EXCLUDE (duckpond_zorder) FROM (%s) ORDER BY duckpond_zorder", zOrderSQL(rows, zOrderBy))
+		}
+		if _, err := dataTx.Exec(fmt.Sprintf("DELETE FROM %s", l.tableName)); err != nil {
+			return err
+		}
+		_, err := dataTx.Exec(fmt.Sprintf("INSERT INTO %s BY NAME %s", l.tableName, rows))
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to load files to optimize: %w", err)
+	}
+
+	for _, file := range files {
+		if _, err := logDB.Exec(query_remove_file, file.Path, false, int64(latestVersion)); err != nil {
+			return fmt.Errorf("failed to record 'remove' of %s: %w", file.Path, err)
+		}
+	}
+	if err := l.stageAddsOf(dataTx, logDB, l.tableName, false); err != nil {
+		return fmt.Errorf("failed to write optimized files: %w", err)
+	}
+	return nil
+}
+
+// filesToCompact counts the files OPTIMIZE without ZORDER BY would rewrite
+func (l *Log) filesToCompact(logDB *sql.DB) (int, error) {
+	files, err := l.optimizeCandidates(logDB, nil, nil, "")
+	if err != nil {
+		return 0, err
+	}
+	targetFileSize, err := l.targetFileSize(logDB)
+	if err != nil {
+		return 0, err
+	}
+	var n int
+	for _, files := range byPartition(files) {
+		for _, bin := range binPack(files, targetFileSize) {
+			n += len(bin)
+		}
+	}
+	return n, nil
+}
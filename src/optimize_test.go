@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBinPack(t *testing.T) {
+	file := func(path string, size int64, deleted bool) optimizeFile {
+		f := optimizeFile{liveFile: liveFile{Path: path}, Size: size}
+		if deleted {
+			f.DeletionVector = &deletionVector{StorageType: "u"}
+		}
+		return f
+	}
+	paths := func(bins [][]optimizeFile) [][]string {
+		var result [][]string
+		for _, bin := range bins {
+			var binPaths []string
+			for _, f := range bin {
+				binPaths = append(binPaths, f.Path)
+			}
+			result = append(result, binPaths)
+		}
+		return result
+	}
+
+	files := []optimizeFile{
+		file("big", 100, false),
+		file("a", 40, false),
+		file("b", 30, false),
+		file("c", 50, false),
+		file("d", 10, false),
+	}
+	// smallest first, bins of up to 100 bytes, files of the target size are left alone
+	assert.Equal(t, [][]string{{"d", "b", "a"}}, paths(binPack(files, 100)), "a bin of just c gains nothing")
+	assert.Equal(t, [][]string{{"d", "b", "a"}}, paths(binPack(files, 90)), "c alone is left out")
+	files = append(files, file("e", 45, false))
+	assert.Equal(t, [][]string{{"d", "b", "a"}, {"e", "c"}}, paths(binPack(files, 100)))
+
+	// files with deleted rows are rewritten even when they're alone or big enough
+	files = []optimizeFile{file("big", 100, true), file("small", 10, false)}
+	assert.Equal(t, [][]string{{"big"}}, paths(binPack(files, 100)))
+	assert.Empty(t, binPack([]optimizeFile{file("small", 10, false)}, 100))
+}
+
+func TestZOrderSQL(t *testing.T) {
+	ib, err := NewIceBase()
+	require.NoError(t, err)
+	defer ib.Close()
+
+	// rows of a 4x4 grid, each quadrant comes before the next one
+	var order string
+	err = ib.DataDB().QueryRow(`
+		SELECT string_agg(x || ':' || y, ' ' ORDER BY duckpond_zorder)
+		FROM (` + zOrderSQL("SELECT x, y FROM range(4) a(x), range(4) b(y)", []string{"x", "y"}) + `)`).Scan(&order)
+	require.NoError(t, err)
+	assert.Equal(t, "0:0 1:0 0:1 1:1 2:0 3:0 2:1 3:1 0:2 1:2 0:3 1:3 2:2 3:2 2:3 3:3", order)
+}
+
+func TestOptimize(t *testing.T) {
+	ib := newTestDB(t)
+
+	for _, query := range []string{
+		"CREATE TABLE optimized (id INTEGER, tenant INTEGER, x INTEGER) PARTITION BY (tenant)",
+		"INSERT INTO optimized VALUES (1, 1, 4)",
+		"INSERT INTO optimized VALUES (2, 1, 3)",
+		"INSERT INTO optimized VALUES (3, 1, 2)",
+		"INSERT INTO optimized VALUES (4, 2, 1), (5, 2, 0)",
+		"DELETE FROM optimized WHERE id = 5",
+	} {
+		_, err := ib.PostEndpoint("/query", query)
+		require.NoError(t, err, query)
+	}
+	l := ib.logs["optimized"]
+
+	_, err := ib.PostEndpoint("/query", "OPTIMIZE optimized WHERE x = 1")
+	assert.Error(t, err, "WHERE on other than partition columns should be rejected")
+	_, err = ib.PostEndpoint("/query", "OPTIMIZE optimized ZORDER BY (tenant)")
+	assert.Error(t, err, "ZORDER BY partition column should be rejected")
+
+	// files of tenant 1 are packed into one, tenant 2 is left alone
+	assert.Equal(t, "1", queryIDs(t, ib, "OPTIMIZE optimized WHERE tenant = 1"))
+	files, err := l.listFiles(filesLive)
+	require.NoError(t, err)
+	assert.Len(t, files, 2)
+	var rearranged int
+	require.NoError(t, l.logDB.QueryRow(`
+		SELECT count(*) FROM log_json
+		WHERE version = (SELECT max(version) FROM log_json) AND (NOT "add".dataChange OR NOT remove.dataChange)`).Scan(&rearranged))
+	assert.Equal(t, 4, rearranged, "OPTIMIZE should add and remove files with dataChange false")
+
+	// tenant 2's file with a deleted row is rewritten without it, nothing is left to do after
+	assert.Equal(t, "1", queryIDs(t, ib, "OPTIMIZE optimized"))
+	assert.Equal(t, "0", queryIDs(t, ib, "OPTIMIZE optimized"))
+	assert.Equal(t, "1,2,3,4", queryIDs(t, ib, "SELECT id FROM optimized ORDER BY id"))
+
+	// every file is rewritten sorted
+	assert.Equal(t, "2", queryIDs(t, ib, "OPTIMIZE optimized ZORDER BY (x)"))
+	assert.Equal(t, "3,2,1", queryIDs(t, ib, "SELECT id FROM optimized WHERE tenant = 1"))
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
 	"regexp"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type Operation int
@@ -13,6 +17,15 @@ const (
 	OpAlterTable
 	OpVacuum
 	OpDropTable
+	OpDescribeHistory
+	OpRestore
+	OpDelete
+	OpUpdate
+	OpMerge
+	OpOptimize
+	OpBegin
+	OpCommit
+	OpRollback
 	OpUnknown
 )
 
@@ -30,31 +43,435 @@ func (o Operation) String() string {
 		return "vacuum"
 	case OpDropTable:
 		return "drop_table"
+	case OpDescribeHistory:
+		return "describe_history"
+	case OpRestore:
+		return "restore"
+	case OpDelete:
+		return "delete"
+	case OpUpdate:
+		return "update"
+	case OpMerge:
+		return "merge"
+	case OpOptimize:
+		return "optimize"
+	case OpBegin:
+		return "begin"
+	case OpCommit:
+		return "commit"
+	case OpRollback:
+		return "rollback"
 	default:
 		return "unknown"
 	}
 }
 
+// TimeTravel selects the snapshot of a table a SELECT reads
+type TimeTravel struct {
+	Version   int64
+	Timestamp string // when set, Version is resolved from commit times
+}
+
+// OnConflict is what an INSERT does with rows whose primary key is already in the table
+type OnConflict int
+
+const (
+	ConflictError OnConflict = iota
+	ConflictReplace
+	ConflictIgnore
+	// ON CONFLICT DO UPDATE SET ..., only duckdb knows how to apply it
+	ConflictUpdate
+)
+
+func (c OnConflict) String() string {
+	switch c {
+	case ConflictReplace:
+		return "Replace"
+	case ConflictIgnore:
+		return "Ignore"
+	case ConflictUpdate:
+		return "Update"
+	default:
+		return "Append"
+	}
+}
+
+// PartitionColumn is a column of PARTITION BY in CREATE TABLE, its value for a row is Expression
+type PartitionColumn struct {
+	Name       string `json:"name"`
+	Expression string `json:"expression"`
+}
+
+// Vacuum is what `VACUUM t [RETAIN n HOURS] [DRY RUN]` asks for
+type Vacuum struct {
+	Retain *time.Duration // nil keeps removed files as long as the table's retention says
+	DryRun bool           // list files VACUUM would delete instead of deleting them
+}
+
+// Optimize is what `OPTIMIZE t [WHERE predicate] [ZORDER BY (cols)]` asks for
+type Optimize struct {
+	Where    string   // predicate on partition columns limiting which partitions are compacted
+	ZOrderBy []string // columns to cluster rows of each partition by
+}
+
+// Txn makes a write idempotent: it's recorded as a txn action and skipped when the table
+// already has a txn of AppID with Version or a later one
+type Txn struct {
+	AppID   string
+	Version int64
+}
+
+// IdempotencyKeyTxn is the txn of an Idempotency-Key header. The key is opaque, it's the app id
+// of a txn with version 0, so a write is skipped when the table already has a txn of the key.
+func IdempotencyKeyTxn(key string) *Txn {
+	return &Txn{AppID: key}
+}
+
+// ParseTxn reads a duckpond.txn key of the form 'appId:version'
+func ParseTxn(key string) (*Txn, error) {
+	i := strings.LastIndex(key, ":")
+	if i <= 0 {
+		return nil, fmt.Errorf("bad idempotency key %q, expected 'appId:version'", key)
+	}
+	version, err := strconv.ParseInt(key[i+1:], 10, 64)
+	if err != nil || version < 0 {
+		return nil, fmt.Errorf("bad idempotency key %q, version has to be a non-negative integer", key)
+	}
+	return &Txn{AppID: key[:i], Version: version}, nil
+}
+
+// Merge is a MERGE INTO upsert rewritten as an INSERT duckdb can run
+type Merge struct {
+	Insert    string
+	Conflict  OnConflict
+	Predicate string   // the ON clause
+	Keys      []string // columns the ON clause matches rows by
+}
+
 type Parser struct {
-	insertRe *regexp.Regexp
-	createRe *regexp.Regexp
-	selectRe *regexp.Regexp
-	alterRe  *regexp.Regexp
-	vacuumRe *regexp.Regexp
-	dropRe   *regexp.Regexp
+	insertRe        *regexp.Regexp
+	createRe        *regexp.Regexp
+	selectRe        *regexp.Regexp
+	selectFromRe    *regexp.Regexp
+	alterRe         *regexp.Regexp
+	alterActionRe   *regexp.Regexp
+	vacuumRe        *regexp.Regexp
+	vacuumOptionsRe *regexp.Regexp
+	tblPropertiesRe *regexp.Regexp
+	optimizeRe      *regexp.Regexp
+	optimizeArgsRe  *regexp.Regexp
+	propertyRe      *regexp.Regexp
+	setTxnRe        *regexp.Regexp
+	transactionRe   *regexp.Regexp
+	dropRe          *regexp.Regexp
+	historyRe       *regexp.Regexp
+	restoreRe       *regexp.Regexp
+	deleteRe        *regexp.Regexp
+	updateRe        *regexp.Regexp
+	onConflictRe    *regexp.Regexp
+	mergeRe         *regexp.Regexp
+	mergeOnKeyRe    *regexp.Regexp
+	mergeWhenRe     *regexp.Regexp
+	andRe           *regexp.Regexp
+	partitionByRe   *regexp.Regexp
+	partitionAsRe   *regexp.Regexp
+	columnNameRe    *regexp.Regexp
+	whenRe          *regexp.Regexp
+	versionAsOfRe   *regexp.Regexp
+	timestampAsOfRe *regexp.Regexp
+	versionSuffixRe *regexp.Regexp
 }
 
 func NewParser() *Parser {
 	return &Parser{
-		insertRe: regexp.MustCompile(`(?i)^\s*INSERT\s+(OR\s+(REPLACE|IGNORE)\s+)?INTO\s+([.\w]+)`),
-		createRe: regexp.MustCompile(`(?i)^\s*CREATE\s+(OR\s+REPLACE\s+)?(TEMP(?:ORARY)?\s+)?TABLE\s+(\w+)`),
-		selectRe: regexp.MustCompile(`(?i)^\s*SELECT\s+.*?(?:\s+FROM\s+([.\w]+))?[\s;]*$`),
-		alterRe:  regexp.MustCompile(`(?i)^\s*ALTER\s+TABLE\s+([.\w]+)`),
-		vacuumRe: regexp.MustCompile(`(?i)^\s*VACUUM(?:\s+(\S+))?`),
-		dropRe:   regexp.MustCompile(`(?i)^\s*DROP\s+TABLE\s+([.\w]+)`),
+		insertRe:        regexp.MustCompile(`(?i)^\s*INSERT\s+(OR\s+(REPLACE|IGNORE)\s+)?INTO\s+([.\w]+)`),
+		createRe:        regexp.MustCompile(`(?i)^\s*CREATE\s+(OR\s+REPLACE\s+)?(TEMP(?:ORARY)?\s+)?TABLE\s+(\w+)`),
+		selectRe:        regexp.MustCompile(`(?i)^\s*SELECT\b`),
+		selectFromRe:    regexp.MustCompile(`(?is)^\s*SELECT\s+.*?\s+FROM\s+([.\w]+)(?:[^.\w(]|$)`),
+		alterRe:         regexp.MustCompile(`(?i)^\s*ALTER\s+TABLE\s+([.\w]+)`),
+		alterActionRe:   regexp.MustCompile(`(?i)^\s*ALTER\s+TABLE\s+[.\w]+\s+(ADD|DROP|RENAME|ALTER)\b(\s+TO\b)?`),
+		vacuumRe:        regexp.MustCompile(`(?i)^\s*VACUUM(?:\s+(\S+))?`),
+		vacuumOptionsRe: regexp.MustCompile(`(?i)^\s*VACUUM\s+[.\w]+(?:\s+RETAIN\s+(\d+(?:\.\d+)?)\s+HOURS?)?(\s+DRY\s+RUN)?\s*;?\s*$`),
+		optimizeRe:      regexp.MustCompile(`(?i)^\s*OPTIMIZE\s+([.\w]+)`),
+		optimizeArgsRe:  regexp.MustCompile(`(?is)^\s*OPTIMIZE\s+[.\w]+(?:\s+WHERE\s+(.+?))?(?:\s+ZORDER\s+BY\s*(\(.*\)|[^()]+?))?\s*;?\s*$`),
+		tblPropertiesRe: regexp.MustCompile(`(?is)^\s*ALTER\s+TABLE\s+[.\w]+\s+SET\s+TBLPROPERTIES\s*\((.*)\)\s*;?\s*$`),
+		propertyRe:      regexp.MustCompile(`(?s)^\s*'((?:[^']|'')*)'\s*=\s*'((?:[^']|'')*)'\s*$`),
+		setTxnRe:        regexp.MustCompile(`(?is)^\s*SET\s+duckpond\.txn\s*(?:=|TO)\s*'((?:[^']|'')*)'\s*;?\s*$`),
+		transactionRe:   regexp.MustCompile(`(?i)^\s*(?:(BEGIN|COMMIT|END|ROLLBACK|ABORT)(?:\s+(?:TRANSACTION|WORK))?|START\s+TRANSACTION)\s*;?\s*$`),
+		dropRe:          regexp.MustCompile(`(?i)^\s*DROP\s+TABLE\s+([.\w]+)`),
+		historyRe:       regexp.MustCompile(`(?i)^\s*DESCRIBE\s+HISTORY\s+([.\w]+)`),
+		restoreRe:       regexp.MustCompile(`(?i)^\s*RESTORE\s+(?:TABLE\s+)?([.\w]+)(?:\s+TO\s+(?:VERSION\s+AS\s+OF\s+(\d+)|TIMESTAMP\s+AS\s+OF\s+'([^']*)'))?`),
+		deleteRe:        regexp.MustCompile(`(?i)^\s*DELETE\s+FROM\s+([.\w]+)`),
+		updateRe:        regexp.MustCompile(`(?i)^\s*UPDATE\s+([.\w]+)`),
+		onConflictRe:    regexp.MustCompile(`(?is)\bON\s+CONFLICT\b.*?\bDO\s+(NOTHING|UPDATE)\b`),
+		mergeRe:         regexp.MustCompile(`(?is)^\s*MERGE\s+INTO\s+([.\w]+)(?:\s+(?:AS\s+)?(\w+))?\s+USING\s+(.+?)\s+ON\s+(.+?)\s+(WHEN\s+.*?)\s*;?\s*$`),
+		mergeOnKeyRe:    regexp.MustCompile(`(?i)^\(?\s*(?:\w+\.)?(\w+)\s*=\s*(?:\w+\.)?(\w+)\s*\)?$`),
+		mergeWhenRe:     regexp.MustCompile(`(?is)^(MATCHED|NOT\s+MATCHED(?:\s+BY\s+TARGET)?)\s+THEN\s+(.+?)\s*$`),
+		andRe:           regexp.MustCompile(`(?i)\s+AND\s+`),
+		partitionByRe:   regexp.MustCompile(`(?is)\)\s*PARTITION\s+BY\s*\((.*)\)\s*;?\s*$`),
+		partitionAsRe:   regexp.MustCompile(`(?is)^(.+?)\s+AS\s+"?(\w+)"?$`),
+		columnNameRe:    regexp.MustCompile(`^\w+$`),
+		whenRe:          regexp.MustCompile(`(?i)\bWHEN\s+`),
+		versionAsOfRe:   regexp.MustCompile(`(?i)(\bFROM\s+[.\w]+)\s+VERSION\s+AS\s+OF\s+(\d+)`),
+		timestampAsOfRe: regexp.MustCompile(`(?i)(\bFROM\s+[.\w]+)\s+TIMESTAMP\s+AS\s+OF\s+'([^']*)'`),
+		versionSuffixRe: regexp.MustCompile(`(?i)(\bFROM\s+[.\w]+)@v(\d+)\b`),
 	}
 }
 
+// ParseTimeTravel strips `VERSION AS OF n`, `TIMESTAMP AS OF '...'` or a `@vN` suffix
+// from the table a query reads, duckdb can't parse those.
+// Returns nil TimeTravel when query reads the latest version.
+func (p *Parser) ParseTimeTravel(query string) (string, *TimeTravel) {
+	for _, re := range []*regexp.Regexp{p.versionAsOfRe, p.versionSuffixRe} {
+		if matches := re.FindStringSubmatchIndex(query); matches != nil {
+			version, err := strconv.ParseInt(query[matches[4]:matches[5]], 10, 64)
+			if err != nil {
+				return query, nil
+			}
+			return query[:matches[3]] + query[matches[1]:], &TimeTravel{Version: version}
+		}
+	}
+	if matches := p.timestampAsOfRe.FindStringSubmatchIndex(query); matches != nil {
+		return query[:matches[3]] + query[matches[1]:], &TimeTravel{Timestamp: query[matches[4]:matches[5]]}
+	}
+	return query, nil
+}
+
+// ParseRestore returns the version `RESTORE TABLE t TO VERSION AS OF n`
+// or `TO TIMESTAMP AS OF '...'` restores to, nil when query doesn't say.
+func (p *Parser) ParseRestore(query string) *TimeTravel {
+	matches := p.restoreRe.FindStringSubmatch(query)
+	switch {
+	case matches == nil:
+		return nil
+	case matches[2] != "":
+		version, err := strconv.ParseInt(matches[2], 10, 64)
+		if err != nil {
+			return nil
+		}
+		return &TimeTravel{Version: version}
+	case matches[3] != "":
+		return &TimeTravel{Timestamp: matches[3]}
+	}
+	return nil
+}
+
+// ParseVacuum reads the options of VACUUM query
+func (p *Parser) ParseVacuum(query string) (Vacuum, error) {
+	matches := p.vacuumOptionsRe.FindStringSubmatch(query)
+	if matches == nil {
+		return Vacuum{}, fmt.Errorf("VACUUM supports RETAIN n HOURS and DRY RUN")
+	}
+	vacuum := Vacuum{DryRun: matches[2] != ""}
+	if matches[1] != "" {
+		hours, err := strconv.ParseFloat(matches[1], 64)
+		if err != nil {
+			return Vacuum{}, fmt.Errorf("bad RETAIN %s HOURS: %w", matches[1], err)
+		}
+		retain := time.Duration(hours * float64(time.Hour))
+		vacuum.Retain = &retain
+	}
+	return vacuum, nil
+}
+
+// ParseOptimize reads the WHERE and ZORDER BY of OPTIMIZE query
+func (p *Parser) ParseOptimize(query string) (Optimize, error) {
+	matches := p.optimizeArgsRe.FindStringSubmatch(query)
+	if matches == nil {
+		return Optimize{}, fmt.Errorf("OPTIMIZE supports WHERE and ZORDER BY (columns)")
+	}
+	optimize := Optimize{Where: strings.TrimSpace(matches[1])}
+	if matches[2] != "" {
+		columns := strings.TrimSuffix(strings.TrimPrefix(matches[2], "("), ")")
+		for _, column := range splitTopLevel(columns, ',') {
+			column = strings.Trim(strings.TrimSpace(column), `"`)
+			if !p.columnNameRe.MatchString(column) {
+				return Optimize{}, fmt.Errorf("ZORDER BY takes column names, not %s", column)
+			}
+			optimize.ZOrderBy = append(optimize.ZOrderBy, column)
+		}
+	}
+	return optimize, nil
+}
+
+// ParseSetTxn reads the idempotency key of `SET duckpond.txn = 'appId:version'`,
+// nil when query isn't one
+func (p *Parser) ParseSetTxn(query string) (*Txn, error) {
+	matches := p.setTxnRe.FindStringSubmatch(query)
+	if matches == nil {
+		return nil, nil
+	}
+	return ParseTxn(strings.ReplaceAll(matches[1], "''", "'"))
+}
+
+// ParseTableProperties returns the properties `ALTER TABLE t SET TBLPROPERTIES ('key' = 'value', ...)`
+// sets, nil when query isn't one
+func (p *Parser) ParseTableProperties(query string) (map[string]string, error) {
+	matches := p.tblPropertiesRe.FindStringSubmatch(query)
+	if matches == nil {
+		return nil, nil
+	}
+	properties := map[string]string{}
+	for _, property := range splitTopLevel(matches[1], ',') {
+		kv := p.propertyRe.FindStringSubmatch(property)
+		if kv == nil {
+			return nil, fmt.Errorf("SET TBLPROPERTIES takes 'key' = 'value' pairs, not %s", strings.TrimSpace(property))
+		}
+		properties[strings.ReplaceAll(kv[1], "''", "'")] = strings.ReplaceAll(kv[2], "''", "'")
+	}
+	return properties, nil
+}
+
+// ParseAlterTable names the operation ALTER TABLE query is in the commit history,
+// as delta names it. Renaming the table isn't supported, it's the name of its directory.
+func (p *Parser) ParseAlterTable(query string) (string, error) {
+	matches := p.alterActionRe.FindStringSubmatch(query)
+	switch {
+	case matches == nil:
+		return "", fmt.Errorf("ALTER TABLE supports ADD, DROP, RENAME and ALTER of columns")
+	case matches[2] != "":
+		return "", fmt.Errorf("ALTER TABLE ... RENAME TO is not supported")
+	}
+	switch strings.ToUpper(matches[1]) {
+	case "ADD":
+		return "ADD COLUMNS", nil
+	case "DROP":
+		return "DROP COLUMNS", nil
+	case "RENAME":
+		return "RENAME COLUMN", nil
+	}
+	return "CHANGE COLUMN", nil
+}
+
+// ParsePartitionBy strips `PARTITION BY (expr AS col, ...)` from the end of CREATE TABLE,
+// duckdb can't parse it. A bare column partitions by the column itself.
+// Returns no partition columns when query doesn't partition.
+func (p *Parser) ParsePartitionBy(query string) (string, []PartitionColumn, error) {
+	matches := p.partitionByRe.FindStringSubmatchIndex(query)
+	if matches == nil {
+		return query, nil, nil
+	}
+	var columns []PartitionColumn
+	for _, expression := range splitTopLevel(query[matches[2]:matches[3]], ',') {
+		expression = strings.TrimSpace(expression)
+		column := PartitionColumn{Name: strings.Trim(expression, `"`), Expression: expression}
+		if as := p.partitionAsRe.FindStringSubmatch(expression); as != nil {
+			column = PartitionColumn{Name: as[2], Expression: strings.TrimSpace(as[1])}
+		}
+		if !p.columnNameRe.MatchString(column.Name) {
+			return "", nil, fmt.Errorf("PARTITION BY %q needs a column name, use expr AS name", expression)
+		}
+		columns = append(columns, column)
+	}
+	if len(columns) == 0 {
+		return "", nil, fmt.Errorf("PARTITION BY needs at least one column")
+	}
+	// keep the ) closing the column list
+	return query[:matches[0]+1], columns, nil
+}
+
+// splitTopLevel splits s at sep outside of parentheses and quotes
+func splitTopLevel(s string, sep rune) []string {
+	var parts []string
+	depth, start := 0, 0
+	var quote rune
+	for i, c := range s {
+		switch {
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			quote = c
+		case c == '(':
+			depth++
+		case c == ')':
+			depth--
+		case c == sep && depth == 0:
+			parts = append(parts, s[start:i])
+			start = i + 1
+		}
+	}
+	if strings.TrimSpace(s[start:]) != "" {
+		parts = append(parts, s[start:])
+	}
+	return parts
+}
+
+// ParseOnConflict tells what INSERT OR REPLACE, INSERT OR IGNORE
+// or ON CONFLICT DO ... makes an INSERT do with conflicting rows
+func (p *Parser) ParseOnConflict(query string) OnConflict {
+	if matches := p.insertRe.FindStringSubmatch(query); matches != nil {
+		switch strings.ToUpper(matches[2]) {
+		case "REPLACE":
+			return ConflictReplace
+		case "IGNORE":
+			return ConflictIgnore
+		}
+	}
+	if matches := p.onConflictRe.FindStringSubmatch(query); matches != nil {
+		if strings.EqualFold(matches[1], "NOTHING") {
+			return ConflictIgnore
+		}
+		return ConflictUpdate
+	}
+	return ConflictError
+}
+
+// ParseMerge rewrites a MERGE INTO upsert into INSERT OR REPLACE (WHEN MATCHED THEN UPDATE)
+// or INSERT OR IGNORE (no WHEN MATCHED or WHEN MATCHED THEN DO NOTHING) of the source rows by name.
+// duckdb can't parse MERGE, so only merges that update or insert whole rows
+// matched by equality of same-named columns are supported.
+func (p *Parser) ParseMerge(query string) (*Merge, error) {
+	matches := p.mergeRe.FindStringSubmatch(query)
+	if matches == nil {
+		return nil, fmt.Errorf("MERGE INTO requires USING, ON and WHEN clauses")
+	}
+	target, source, on, whens := matches[1], matches[3], matches[4], matches[5]
+
+	var keys []string
+	for _, condition := range p.andRe.Split(strings.TrimSpace(on), -1) {
+		key := p.mergeOnKeyRe.FindStringSubmatch(strings.TrimSpace(condition))
+		if key == nil || !strings.EqualFold(key[1], key[2]) {
+			return nil, fmt.Errorf("MERGE INTO only supports ON clauses matching same-named columns, got %q", on)
+		}
+		keys = append(keys, key[1])
+	}
+
+	conflict := ConflictIgnore
+	inserts := false
+	for _, clause := range p.whenRe.Split(whens, -1)[1:] {
+		when := p.mergeWhenRe.FindStringSubmatch(clause)
+		if when == nil {
+			return nil, fmt.Errorf("MERGE INTO can't parse WHEN %s", clause)
+		}
+		action := strings.Join(strings.Fields(strings.ToUpper(when[2])), " ")
+		switch {
+		case strings.EqualFold(when[1], "MATCHED") && (action == "UPDATE" || action == "UPDATE SET *"):
+			conflict = ConflictReplace
+		case strings.EqualFold(when[1], "MATCHED") && action == "DO NOTHING":
+		case !strings.EqualFold(when[1], "MATCHED") && (action == "INSERT" || action == "INSERT *"):
+			inserts = true
+		default:
+			return nil, fmt.Errorf("MERGE INTO doesn't support WHEN %s THEN %s", when[1], when[2])
+		}
+	}
+	if !inserts {
+		return nil, fmt.Errorf("MERGE INTO requires WHEN NOT MATCHED THEN INSERT")
+	}
+
+	insert := "INSERT OR IGNORE"
+	if conflict == ConflictReplace {
+		insert = "INSERT OR REPLACE"
+	}
+	return &Merge{
+		Insert:    fmt.Sprintf("%s INTO %s BY NAME SELECT * FROM %s", insert, target, source),
+		Conflict:  conflict,
+		Predicate: strings.TrimSpace(on),
+		Keys:      keys,
+	}, nil
+}
+
 func (p *Parser) Parse(query string) (Operation, string) {
 	if matches := p.insertRe.FindStringSubmatch(query); matches != nil {
 		return OpInsert, matches[len(matches)-1]
@@ -62,16 +479,19 @@ func (p *Parser) Parse(query string) (Operation, string) {
 	if matches := p.createRe.FindStringSubmatch(query); matches != nil {
 		return OpCreateTable, matches[len(matches)-1]
 	}
-	if matches := p.selectRe.FindStringSubmatch(query); matches != nil {
+	if matches := p.selectFromRe.FindStringSubmatch(query); matches != nil {
+		return OpSelect, matches[1]
+	}
+	if p.selectRe.MatchString(query) {
 		// If no table found, return empty string
-		if len(matches) > 1 && matches[1] != "" {
-			return OpSelect, matches[1]
-		}
 		return OpSelect, ""
 	}
 	if matches := p.alterRe.FindStringSubmatch(query); matches != nil {
 		return OpAlterTable, matches[len(matches)-1]
 	}
+	if matches := p.optimizeRe.FindStringSubmatch(query); matches != nil {
+		return OpOptimize, matches[1]
+	}
 	if matches := p.vacuumRe.FindStringSubmatch(query); matches != nil {
 		table := ""
 		if len(matches) > 1 {
@@ -82,5 +502,29 @@ func (p *Parser) Parse(query string) (Operation, string) {
 	if matches := p.dropRe.FindStringSubmatch(query); matches != nil {
 		return OpDropTable, matches[1]
 	}
+	if matches := p.historyRe.FindStringSubmatch(query); matches != nil {
+		return OpDescribeHistory, matches[1]
+	}
+	if matches := p.restoreRe.FindStringSubmatch(query); matches != nil {
+		return OpRestore, matches[1]
+	}
+	if matches := p.deleteRe.FindStringSubmatch(query); matches != nil {
+		return OpDelete, matches[1]
+	}
+	if matches := p.updateRe.FindStringSubmatch(query); matches != nil {
+		return OpUpdate, matches[1]
+	}
+	if matches := p.mergeRe.FindStringSubmatch(query); matches != nil {
+		return OpMerge, matches[1]
+	}
+	if matches := p.transactionRe.FindStringSubmatch(query); matches != nil {
+		switch strings.ToUpper(matches[1]) {
+		case "COMMIT", "END":
+			return OpCommit, ""
+		case "ROLLBACK", "ABORT":
+			return OpRollback, ""
+		}
+		return OpBegin, ""
+	}
 	return OpUnknown, ""
 }
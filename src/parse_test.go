@@ -1,7 +1,9 @@
 package main
 
 import (
+	"reflect"
 	"testing"
+	"time"
 )
 
 func init() {
@@ -40,6 +42,10 @@ func TestParser(t *testing.T) {
 		{"  SELECT col1,col2 FROM temp_users", OpSelect, "temp_users"},
 		{"SELECT 1 + 1", OpSelect, ""},
 		{"SELECT NOW()", OpSelect, ""},
+		{"SELECT * FROM users WHERE id = 1", OpSelect, "users"},
+		{"SELECT *\nFROM users\nORDER BY id;", OpSelect, "users"},
+		{"SELECT * FROM users@v3", OpSelect, "users"},
+		{"SELECT * FROM read_parquet('x.parquet')", OpSelect, ""},
 
 		// Vacuum tests
 		{"VACUUM", OpVacuum, ""},
@@ -47,12 +53,44 @@ func TestParser(t *testing.T) {
 		{"  VACUUM schema.users", OpVacuum, "schema.users"},
 		{"VACUUM\tmy_table", OpVacuum, "my_table"},
 
+		// Optimize tests
+		{"OPTIMIZE users", OpOptimize, "users"},
+		{"optimize app.users WHERE tenant = 1 ZORDER BY (id)", OpOptimize, "app.users"},
+
 		// Negative tests
-		{"UPDATE users", OpUnknown, ""},
+		{"UPSERT users", OpUnknown, ""},
 
 		// Drop table tests
 		{"DROP TABLE users", OpDropTable, "users"},
 		{"   DROP TABLE app.users", OpDropTable, "app.users"},
+
+		// History tests
+		{"DESCRIBE HISTORY users", OpDescribeHistory, "users"},
+		{"describe history app.users", OpDescribeHistory, "app.users"},
+		{"DESCRIBE users", OpUnknown, ""},
+
+		// Restore tests
+		{"RESTORE TABLE users TO VERSION AS OF 3", OpRestore, "users"},
+		{"restore app.users to timestamp as of '2026-01-01'", OpRestore, "app.users"},
+
+		// Delete tests
+		{"DELETE FROM users WHERE id = 1", OpDelete, "users"},
+		{"  delete from app.users", OpDelete, "app.users"},
+
+		// Update tests
+		{"UPDATE users SET name = 'x' WHERE id = 1", OpUpdate, "users"},
+		{"update app.users set age = age + 1", OpUpdate, "app.users"},
+
+		// Merge tests
+		{"MERGE INTO users u USING (SELECT 1 AS id) s ON u.id = s.id WHEN NOT MATCHED THEN INSERT", OpMerge, "users"},
+		{"merge into app.users using src on users.id = src.id when matched then update set *", OpMerge, "app.users"},
+
+		// Transaction tests
+		{"BEGIN", OpBegin, ""},
+		{"start transaction;", OpBegin, ""},
+		{"COMMIT", OpCommit, ""},
+		{"end work", OpCommit, ""},
+		{"ROLLBACK TRANSACTION", OpRollback, ""},
 	}
 
 	parser := NewParser()
@@ -64,3 +102,266 @@ func TestParser(t *testing.T) {
 		}
 	}
 }
+
+func TestParseTimeTravel(t *testing.T) {
+	tests := []struct {
+		query      string
+		rewritten  string
+		timeTravel *TimeTravel
+	}{
+		{"SELECT * FROM t", "SELECT * FROM t", nil},
+		{"SELECT * FROM t VERSION AS OF 12 WHERE id = 1", "SELECT * FROM t WHERE id = 1", &TimeTravel{Version: 12}},
+		{"select count(*) from app.t version as of 0", "select count(*) from app.t", &TimeTravel{Version: 0}},
+		{"SELECT * FROM t@v7 ORDER BY id", "SELECT * FROM t ORDER BY id", &TimeTravel{Version: 7}},
+		{"SELECT * FROM t TIMESTAMP AS OF '2026-01-01' LIMIT 1", "SELECT * FROM t LIMIT 1", &TimeTravel{Timestamp: "2026-01-01"}},
+		{"SELECT 'VERSION AS OF 3'", "SELECT 'VERSION AS OF 3'", nil},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		rewritten, timeTravel := parser.ParseTimeTravel(tt.query)
+		if rewritten != tt.rewritten || !reflect.DeepEqual(timeTravel, tt.timeTravel) {
+			t.Errorf("ParseTimeTravel(%q) = (%q, %+v), want (%q, %+v)",
+				tt.query, rewritten, timeTravel, tt.rewritten, tt.timeTravel)
+		}
+	}
+}
+
+func TestParseRestore(t *testing.T) {
+	tests := []struct {
+		query  string
+		target *TimeTravel
+	}{
+		{"RESTORE TABLE t TO VERSION AS OF 3", &TimeTravel{Version: 3}},
+		{"restore t to version as of 0", &TimeTravel{Version: 0}},
+		{"RESTORE TABLE t TO TIMESTAMP AS OF '2026-01-01 00:00:00'", &TimeTravel{Timestamp: "2026-01-01 00:00:00"}},
+		{"RESTORE TABLE t", nil},
+		{"SELECT * FROM t VERSION AS OF 3", nil},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		target := parser.ParseRestore(tt.query)
+		if !reflect.DeepEqual(target, tt.target) {
+			t.Errorf("ParseRestore(%q) = %+v, want %+v", tt.query, target, tt.target)
+		}
+	}
+}
+
+func TestParseVacuum(t *testing.T) {
+	week := 168 * time.Hour
+	half := 30 * time.Minute
+	tests := []struct {
+		query  string
+		vacuum Vacuum
+	}{
+		{"VACUUM t", Vacuum{}},
+		{"VACUUM t;", Vacuum{}},
+		{"vacuum t retain 168 hours", Vacuum{Retain: &week}},
+		{"VACUUM t RETAIN 0.5 HOURS DRY RUN", Vacuum{Retain: &half, DryRun: true}},
+		{"VACUUM app.t DRY RUN", Vacuum{DryRun: true}},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		vacuum, err := parser.ParseVacuum(tt.query)
+		if err != nil {
+			t.Errorf("ParseVacuum(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(vacuum, tt.vacuum) {
+			t.Errorf("ParseVacuum(%q) = %+v, want %+v", tt.query, vacuum, tt.vacuum)
+		}
+	}
+	for _, query := range []string{"VACUUM t RETAIN 7 DAYS", "VACUUM t DRY RUN RETAIN 1 HOURS"} {
+		if _, err := parser.ParseVacuum(query); err == nil {
+			t.Errorf("ParseVacuum(%q) should fail", query)
+		}
+	}
+}
+
+func TestParseOptimize(t *testing.T) {
+	tests := []struct {
+		query    string
+		optimize Optimize
+	}{
+		{"OPTIMIZE t", Optimize{}},
+		{"OPTIMIZE t;", Optimize{}},
+		{"OPTIMIZE t WHERE day >= '2026-01-01' AND tenant = 1", Optimize{Where: "day >= '2026-01-01' AND tenant = 1"}},
+		{"optimize t zorder by (x, \"y\")", Optimize{ZOrderBy: []string{"x", "y"}}},
+		{"OPTIMIZE t WHERE tenant IN (1, 2) ZORDER BY x", Optimize{Where: "tenant IN (1, 2)", ZOrderBy: []string{"x"}}},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		optimize, err := parser.ParseOptimize(tt.query)
+		if err != nil {
+			t.Errorf("ParseOptimize(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(optimize, tt.optimize) {
+			t.Errorf("ParseOptimize(%q) = %+v, want %+v", tt.query, optimize, tt.optimize)
+		}
+	}
+	if _, err := parser.ParseOptimize("OPTIMIZE t ZORDER BY (x + 1)"); err == nil {
+		t.Error("ParseOptimize of ZORDER BY an expression should fail")
+	}
+}
+
+func TestParseTableProperties(t *testing.T) {
+	tests := []struct {
+		query      string
+		properties map[string]string
+	}{
+		{"ALTER TABLE t SET TBLPROPERTIES ('delta.deletedFileRetentionDuration' = 'interval 7 days')",
+			map[string]string{"delta.deletedFileRetentionDuration": "interval 7 days"}},
+		{"alter table t set tblproperties ('a'='1', 'b' = 'it''s, b');",
+			map[string]string{"a": "1", "b": "it's, b"}},
+		{"ALTER TABLE t ADD COLUMN c INTEGER", nil},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		properties, err := parser.ParseTableProperties(tt.query)
+		if err != nil {
+			t.Errorf("ParseTableProperties(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(properties, tt.properties) {
+			t.Errorf("ParseTableProperties(%q) = %v, want %v", tt.query, properties, tt.properties)
+		}
+	}
+	if _, err := parser.ParseTableProperties("ALTER TABLE t SET TBLPROPERTIES (a = 1)"); err == nil {
+		t.Error("ParseTableProperties of unquoted properties should fail")
+	}
+}
+
+func TestParseOnConflict(t *testing.T) {
+	tests := []struct {
+		query    string
+		conflict OnConflict
+	}{
+		{"INSERT INTO t VALUES (1)", ConflictError},
+		{"INSERT OR REPLACE INTO t VALUES (1)", ConflictReplace},
+		{"insert or ignore into t values (1)", ConflictIgnore},
+		{"INSERT INTO t VALUES (1) ON CONFLICT DO NOTHING", ConflictIgnore},
+		{"INSERT INTO t VALUES (1, 'x') ON CONFLICT (id) DO UPDATE SET text = excluded.text", ConflictUpdate},
+		{"INSERT INTO t VALUES ('ON CONFLICT')", ConflictError},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		if conflict := parser.ParseOnConflict(tt.query); conflict != tt.conflict {
+			t.Errorf("ParseOnConflict(%q) = %v, want %v", tt.query, conflict, tt.conflict)
+		}
+	}
+}
+
+func TestParseMerge(t *testing.T) {
+	tests := []struct {
+		query string
+		merge *Merge
+	}{
+		{
+			"MERGE INTO t USING (VALUES (1, 'x')) AS s(id, text) ON t.id = s.id\nWHEN MATCHED THEN UPDATE SET *\nWHEN NOT MATCHED THEN INSERT *;",
+			&Merge{
+				Insert:    "INSERT OR REPLACE INTO t BY NAME SELECT * FROM (VALUES (1, 'x')) AS s(id, text)",
+				Conflict:  ConflictReplace,
+				Predicate: "t.id = s.id",
+				Keys:      []string{"id"},
+			},
+		},
+		{
+			"merge into t as d using (select 1 as a, 2 as b) s on d.a = s.a and (d.b = s.b) when matched then do nothing when not matched by target then insert",
+			&Merge{
+				Insert:    "INSERT OR IGNORE INTO t BY NAME SELECT * FROM (select 1 as a, 2 as b) s",
+				Conflict:  ConflictIgnore,
+				Predicate: "d.a = s.a and (d.b = s.b)",
+				Keys:      []string{"a", "b"},
+			},
+		},
+		{"MERGE INTO t USING s ON t.id = s.id WHEN MATCHED THEN DELETE WHEN NOT MATCHED THEN INSERT", nil},
+		{"MERGE INTO t USING s ON t.id = s.other WHEN NOT MATCHED THEN INSERT", nil},
+		{"MERGE INTO t USING s ON t.id = s.id WHEN MATCHED THEN UPDATE", nil},
+		{"MERGE INTO t USING s", nil},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		merge, err := parser.ParseMerge(tt.query)
+		if tt.merge == nil {
+			if err == nil {
+				t.Errorf("ParseMerge(%q) = %+v, want error", tt.query, merge)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(merge, tt.merge) {
+			t.Errorf("ParseMerge(%q) = (%+v, %v), want %+v", tt.query, merge, err, tt.merge)
+		}
+	}
+}
+
+func TestParsePartitionBy(t *testing.T) {
+	tests := []struct {
+		query       string
+		createTable string
+		partitionBy []PartitionColumn
+		fails       bool
+	}{
+		{"CREATE TABLE t (id INTEGER)", "CREATE TABLE t (id INTEGER)", nil, false},
+		{
+			"CREATE TABLE t (user_id INTEGER, ts BIGINT)\nPARTITION BY (user_id, strftime(to_timestamp(ts / 1000), '%Y-%m-%d') AS d);",
+			"CREATE TABLE t (user_id INTEGER, ts BIGINT)",
+			[]PartitionColumn{
+				{Name: "user_id", Expression: "user_id"},
+				{Name: "d", Expression: "strftime(to_timestamp(ts / 1000), '%Y-%m-%d')"},
+			},
+			false,
+		},
+		{"CREATE TABLE t (a VARCHAR) partition by ('x,y' || a as b)", "CREATE TABLE t (a VARCHAR)", []PartitionColumn{{Name: "b", Expression: "'x,y' || a"}}, false},
+		{"CREATE TABLE t (a INTEGER) PARTITION BY (a + 1)", "", nil, true},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		createTable, partitionBy, err := parser.ParsePartitionBy(tt.query)
+		if tt.fails {
+			if err == nil {
+				t.Errorf("ParsePartitionBy(%q) = %+v, want error", tt.query, partitionBy)
+			}
+			continue
+		}
+		if err != nil || createTable != tt.createTable || !reflect.DeepEqual(partitionBy, tt.partitionBy) {
+			t.Errorf("ParsePartitionBy(%q) = (%q, %+v, %v), want (%q, %+v)",
+				tt.query, createTable, partitionBy, err, tt.createTable, tt.partitionBy)
+		}
+	}
+}
+
+func TestParseSetTxn(t *testing.T) {
+	tests := []struct {
+		query string
+		txn   *Txn
+	}{
+		{"SET duckpond.txn = 'ingest:42'", &Txn{AppID: "ingest", Version: 42}},
+		{"set duckpond.txn to 'host:8080/app:7';", &Txn{AppID: "host:8080/app", Version: 7}},
+		{"SET threads = 4", nil},
+	}
+
+	parser := NewParser()
+	for _, tt := range tests {
+		txn, err := parser.ParseSetTxn(tt.query)
+		if err != nil {
+			t.Errorf("ParseSetTxn(%q) failed: %v", tt.query, err)
+			continue
+		}
+		if !reflect.DeepEqual(txn, tt.txn) {
+			t.Errorf("ParseSetTxn(%q) = %v, want %v", tt.query, txn, tt.txn)
+		}
+	}
+	for _, key := range []string{"ingest", ":1", "ingest:-1", "ingest:x"} {
+		if _, err := ParseTxn(key); err == nil {
+			t.Errorf("ParseTxn(%q) should fail", key)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// hive's name for the directory of rows whose partition value is NULL
+const hiveDefaultPartition = "__HIVE_DEFAULT_PARTITION__"
+
+// hiveEscape escapes a partition value for use in a col=value directory name
+func hiveEscape(value string) string {
+	var escaped strings.Builder
+	for _, b := range []byte(value) {
+		if b >= 'a' && b <= 'z' || b >= 'A' && b <= 'Z' || b >= '0' && b <= '9' || strings.IndexByte("-_.", b) >= 0 {
+			escaped.WriteByte(b)
+			continue
+		}
+		fmt.Fprintf(&escaped, "%%%02X", b)
+	}
+	return escaped.String()
+}
+
+// partitionDir is the directory files with values of partitionBy live in, relative to data
+func partitionDir(partitionBy []PartitionColumn, values []sql.NullString) string {
+	parts := make([]string, len(partitionBy))
+	for i, column := range partitionBy {
+		value := hiveDefaultPartition
+		if values[i].Valid {
+			value = hiveEscape(values[i].String)
+		}
+		parts[i] = column.Name + "=" + value
+	}
+	return filepath.Join(parts...)
+}
+
+// partitionValuesJSON renders values of partitionBy as add.partitionValues, keyed by physical names
+func partitionValuesJSON(partitionBy []PartitionColumn, values []sql.NullString, physical map[string]string) (string, error) {
+	partitionValues := map[string]*string{}
+	for i, column := range partitionBy {
+		if values[i].Valid {
+			partitionValues[physicalName(physical, column.Name)] = &values[i].String
+		} else {
+			partitionValues[physicalName(physical, column.Name)] = nil
+		}
+	}
+	data, err := json.Marshal(partitionValues)
+	return string(data), err
+}
+
+// readParquetSQL selects rows of parquet files at quoted paths read with read_parquet options,
+// with partitionValues of columns kept out of the files as columns of their own
+func readParquetSQL(paths []string, partitionValues map[string]*string, options string) string {
+	from := fmt.Sprintf("read_parquet([%s], %s)", strings.Join(paths, ", "), options)
+	if len(partitionValues) == 0 {
+		return "SELECT * FROM " + from
+	}
+	names := slices.Sorted(maps.Keys(partitionValues))
+	excluded := make([]string, len(names))
+	values := make([]string, len(names))
+	for i, name := range names {
+		excluded[i] = quoteSQLString(name)
+		values[i] = "NULL AS " + quoteIdentifier(name)
+		if value := partitionValues[name]; value != nil {
+			values[i] = quoteSQLString(*value) + " AS " + quoteIdentifier(name)
+		}
+	}
+	// some writers keep partition columns in data files too, partitionValues are what counts
+	return fmt.Sprintf("SELECT COLUMNS(c -> c NOT IN (%s)), %s FROM %s",
+		strings.Join(excluded, ", "), strings.Join(values, ", "), from)
+}
+
+// partitionBy reads PARTITION BY of the table's latest metaData, nil for unpartitioned tables.
+// Tables other writers created are partitioned by their partitionColumns as they are.
+func (l *Log) partitionBy(db *sql.DB) ([]PartitionColumn, error) {
+	var partitionBy sql.NullString
+	err := db.QueryRow(`
+		SELECT metaData.duckpond.partitionBy::JSON
+		FROM log_json
+		WHERE metaData IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`).Scan(&partitionBy)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to get partitionBy: %w", err)
+	}
+	if !partitionBy.Valid {
+		external, err := l.externalPartitionColumns(db)
+		if err != nil {
+			return nil, err
+		}
+		var columns []PartitionColumn
+		for _, name := range external {
+			columns = append(columns, PartitionColumn{Name: name, Expression: quoteIdentifier(name)})
+		}
+		return columns, nil
+	}
+	var columns []PartitionColumn
+	if err := json.Unmarshal([]byte(partitionBy.String), &columns); err != nil {
+		return nil, fmt.Errorf("bad partitionBy %s: %w", partitionBy.String, err)
+	}
+	return columns, nil
+}
+
+// externalPartitionColumns lists partitionColumns of a table another writer created.
+// Delta keeps values of partition columns out of data files, they're only in add.partitionValues.
+// Columns duckpond partitions by are in its files too, so there are none for its tables.
+func (l *Log) externalPartitionColumns(db *sql.DB) ([]string, error) {
+	var partitionColumns []any
+	err := db.QueryRow(`
+		SELECT CASE WHEN metaData.duckpond.partitionBy IS NULL THEN coalesce(metaData.partitionColumns, []) ELSE [] END
+		FROM log_json
+		WHERE metaData IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`).Scan(&partitionColumns)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get partitionColumns: %w", err)
+	}
+	columns := make([]string, len(partitionColumns))
+	for i, column := range partitionColumns {
+		columns[i] = fmt.Sprint(column)
+	}
+	return columns, nil
+}
+
+// validatePartitionBy fails before anything is committed when partition expressions
+// don't work on the table
+func (l *Log) validatePartitionBy(dataTx *sql.Tx, partitionBy []PartitionColumn) error {
+	for _, column := range partitionBy {
+		if _, err := dataTx.Exec(fmt.Sprintf("SELECT (%s)::VARCHAR FROM %s LIMIT 0", column.Expression, l.tableName)); err != nil {
+			return fmt.Errorf("bad PARTITION BY %s AS %s: %w", column.Expression, column.Name, err)
+		}
+	}
+	return nil
+}
+
+// partitionCondition is SQL over "add".partitionValues that is false only for files in partitions
+// no row matching all predicates can be in. A partition is pruned when = predicates give values
+// for every column its expression uses, it's evaluated on db with those values.
+func partitionCondition(db *sql.DB, partitionBy []PartitionColumn, predicates []statsPredicate, columns map[string][2]string, physical map[string]string) string {
+	var values []string
+	pinned := map[string]bool{}
+	for _, p := range predicates {
+		column, ok := columns[strings.ToLower(p.Column)]
+		if p.Op != "=" || !ok {
+			continue
+		}
+		values = append(values, fmt.Sprintf(`TRY_CAST(%s AS %s) AS "%s"`, p.Value, column[1], column[0]))
+		pinned[strings.ToLower(column[0])] = true
+	}
+	if len(values) == 0 {
+		return "true"
+	}
+
+	conditions := []string{"true"}
+	for _, partition := range partitionBy {
+		// a column missing from values could bind to a function of the same name, like user
+		if !allPinned(db, partition.Expression, pinned) {
+			continue
+		}
+		var value sql.NullString
+		query := fmt.Sprintf("SELECT (%s)::VARCHAR FROM (SELECT %s)", partition.Expression, strings.Join(values, ", "))
+		if err := db.QueryRow(query).Scan(&value); err != nil {
+			continue
+		}
+		name := quoteSQLString(physicalName(physical, partition.Name))
+		match := "IS NULL"
+		if value.Valid {
+			match = "= " + quoteSQLString(value.String)
+		}
+		conditions = append(conditions, fmt.Sprintf(
+			`(NOT list_contains(map_keys("add".partitionValues), %[1]s) OR map_extract("add".partitionValues, %[1]s)[1] %[2]s)`,
+			name, match))
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// allPinned tells if every column expression refers to is in pinned, by lowercased name
+func allPinned(db *sql.DB, expression string, pinned map[string]bool) bool {
+	var serialized string
+	err := db.QueryRow("SELECT json_serialize_sql(" + quoteSQLString("SELECT "+expression) + ")").Scan(&serialized)
+	if err != nil {
+		return false
+	}
+	var ast any
+	if err := json.Unmarshal([]byte(serialized), &ast); err != nil {
+		return false
+	}
+	var walk func(node any) bool
+	walk = func(node any) bool {
+		switch n := node.(type) {
+		case map[string]any:
+			if n["class"] == "COLUMN_REF" {
+				names, _ := n["column_names"].([]any)
+				return len(names) > 0 && pinned[strings.ToLower(fmt.Sprint(names[len(names)-1]))]
+			}
+			for _, child := range n {
+				if !walk(child) {
+					return false
+				}
+			}
+		case []any:
+			for _, child := range n {
+				if !walk(child) {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return walk(ast)
+}
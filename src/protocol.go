@@ -0,0 +1,182 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// deltaProtocol is the protocol action of a table
+// see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#protocol-evolution
+type deltaProtocol struct {
+	MinReaderVersion int      `json:"minReaderVersion"`
+	MinWriterVersion int      `json:"minWriterVersion"`
+	ReaderFeatures   []string `json:"readerFeatures,omitempty"`
+	WriterFeatures   []string `json:"writerFeatures,omitempty"`
+}
+
+// features implied by each protocol version from before table features,
+// reader versions below 3 and writer versions below 7
+var (
+	legacyReaderFeatures = map[int][]string{2: {"columnMapping"}}
+	legacyWriterFeatures = map[int][]string{
+		2: {"appendOnly", "invariants"},
+		3: {"checkConstraints"},
+		4: {"changeDataFeed", "generatedColumns"},
+		5: {"columnMapping"},
+		6: {"identityColumns"},
+	}
+)
+
+// table features duckpond reads and writes tables with
+var supportedTableFeatures = []string{
+	"appendOnly", "columnMapping", "deletionVectors", "timestampNtz", "typeWidening", "typeWidening-preview",
+	"vacuumProtocolCheck",
+}
+
+func legacyFeatures(implied map[int][]string, version int) []string {
+	var features []string
+	for v := 1; v <= version; v++ {
+		features = append(features, implied[v]...)
+	}
+	return features
+}
+
+// readerFeatures lists features readers of the table have to support
+func (p deltaProtocol) readerFeatures() []string {
+	if p.MinReaderVersion >= 3 {
+		return p.ReaderFeatures
+	}
+	return legacyFeatures(legacyReaderFeatures, p.MinReaderVersion)
+}
+
+// writerFeatures lists features writers of the table have to support
+func (p deltaProtocol) writerFeatures() []string {
+	if p.MinWriterVersion >= 7 {
+		return p.WriterFeatures
+	}
+	return legacyFeatures(legacyWriterFeatures, p.MinWriterVersion)
+}
+
+// withFeature is p upgraded to table features with reader-writer feature added
+func (p deltaProtocol) withFeature(feature string) deltaProtocol {
+	upgraded := deltaProtocol{
+		MinReaderVersion: 3,
+		MinWriterVersion: 7,
+		ReaderFeatures:   slices.Clone(p.readerFeatures()),
+		WriterFeatures:   slices.Clone(p.writerFeatures()),
+	}
+	if !slices.Contains(upgraded.ReaderFeatures, feature) {
+		upgraded.ReaderFeatures = append(upgraded.ReaderFeatures, feature)
+	}
+	if !slices.Contains(upgraded.WriterFeatures, feature) {
+		upgraded.WriterFeatures = append(upgraded.WriterFeatures, feature)
+	}
+	return upgraded
+}
+
+// protocol reads the table's latest protocol, staged ones included. nil before the table is created.
+func (l *Log) protocol(db *sql.DB) (*deltaProtocol, error) {
+	var protocolJSON string
+	err := db.QueryRow(`
+		SELECT protocol
+		FROM log_json
+		WHERE protocol IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`).Scan(&protocolJSON)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get protocol of %s: %w", l.tableName, err)
+	}
+	var protocol deltaProtocol
+	if err := json.Unmarshal([]byte(protocolJSON), &protocol); err != nil {
+		return nil, fmt.Errorf("bad protocol of %s: %w", l.tableName, err)
+	}
+	return &protocol, nil
+}
+
+// featureInUse tells if a writer feature duckpond doesn't support is used by the table.
+// Writers only have to enforce these when the table uses them.
+func (l *Log) featureInUse(db *sql.DB, feature string) (bool, error) {
+	var schemaString, configuration sql.NullString
+	err := db.QueryRow(`
+		SELECT metaData.schemaString, metaData.configuration::JSON
+		FROM log_json
+		WHERE metaData IS NOT NULL
+		ORDER BY version DESC NULLS FIRST, rowid DESC
+		LIMIT 1`).Scan(&schemaString, &configuration)
+	if err != nil && err != sql.ErrNoRows {
+		return false, fmt.Errorf("failed to get metaData of %s: %w", l.tableName, err)
+	}
+	switch feature {
+	case "invariants":
+		return strings.Contains(schemaString.String, `"delta.invariants"`), nil
+	case "checkConstraints":
+		return strings.Contains(configuration.String, `"delta.constraints.`), nil
+	case "changeDataFeed":
+		enabled, err := l.tableProperty(db, "delta.enableChangeDataFeed")
+		return strings.EqualFold(enabled, "true"), err
+	case "generatedColumns":
+		return strings.Contains(schemaString.String, `"delta.generationExpression"`), nil
+	case "identityColumns":
+		return strings.Contains(schemaString.String, `"delta.identity.`), nil
+	}
+	return true, nil
+}
+
+// checkProtocol fails when the table has features duckpond can't read it with,
+// or for writes, features it can't write it with
+func (l *Log) checkProtocol(db *sql.DB, write bool) error {
+	protocol, err := l.protocol(db)
+	if err != nil || protocol == nil {
+		return err
+	}
+	if protocol.MinReaderVersion > 3 || protocol.MinWriterVersion > 7 {
+		return fmt.Errorf("%s needs Delta Lake protocol %d/%d, newer than duckpond supports",
+			l.tableName, protocol.MinReaderVersion, protocol.MinWriterVersion)
+	}
+	for _, feature := range protocol.readerFeatures() {
+		if !slices.Contains(supportedTableFeatures, feature) {
+			return fmt.Errorf("reading %s needs Delta Lake table feature %s, duckpond doesn't support it", l.tableName, feature)
+		}
+	}
+	if !write {
+		return nil
+	}
+	for _, feature := range protocol.writerFeatures() {
+		if slices.Contains(supportedTableFeatures, feature) {
+			continue
+		}
+		inUse, err := l.featureInUse(db, feature)
+		if err != nil {
+			return err
+		}
+		if inUse {
+			return fmt.Errorf("writing %s needs Delta Lake table feature %s, duckpond doesn't support it", l.tableName, feature)
+		}
+	}
+	return nil
+}
+
+// checkAppendOnly fails when the table has delta.appendOnly set and staged actions remove data
+func (l *Log) checkAppendOnly(db *sql.DB) error {
+	appendOnly, err := l.tableProperty(db, "delta.appendOnly")
+	if err != nil || !strings.EqualFold(appendOnly, "true") {
+		return err
+	}
+	var removes int
+	err = db.QueryRow(`
+		SELECT count(*) FROM log_json
+		WHERE version IS NULL AND remove IS NOT NULL AND coalesce(remove.dataChange, true)`).Scan(&removes)
+	if err != nil {
+		return fmt.Errorf("failed to count staged removes: %w", err)
+	}
+	if removes > 0 {
+		return fmt.Errorf("%s is append-only (delta.appendOnly), rows can't be changed or deleted", l.tableName)
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+-- tombstones live file $1, e.g. after its rows were rewritten into a new file,
+-- $2 is false when its rows were only moved to other files, $3 is latestVersion
+INSERT INTO log_json (remove)
+SELECT struct_pack(
+    path := path,
+    dataChange := $2,
+    deletionTimestamp := epoch_ms(CURRENT_TIMESTAMP),
+    extendedFileMetadata := true,
+    partitionValues := "add".partitionValues,
+    size := "add".size,
+    deletionVector := "add".deletionVector
+)
+FROM file_actions_at($3)
+WHERE path = $1 AND "add" IS NOT NULL;
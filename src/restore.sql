@@ -0,0 +1,40 @@
+-- stages actions making the table what it was at version $1 without copying data:
+-- re-adds files live at $1 that were removed since, removes files added since.
+-- Files are identified by path and deletion vector, so rows deleted since come back too
+-- and brings back metaData of $1 when it changed since. Removes go first, a file re-added with
+-- another deletion vector than it has now ends up live. $2 is latestVersion.
+INSERT INTO log_json BY NAME
+WITH target AS (
+    SELECT path, "add" FROM file_actions_at($1) WHERE "add" IS NOT NULL
+), live AS (
+    SELECT path, "add" FROM file_actions_at($2) WHERE "add" IS NOT NULL
+), metadata AS (
+    -- newest metaData as of $1 and newest overall
+    SELECT version <= $1 AS at_target, metaData
+    FROM log_json
+    WHERE metaData IS NOT NULL
+    QUALIFY row_number() OVER (PARTITION BY version <= $1 ORDER BY version DESC NULLS FIRST, rowid DESC) = 1
+)
+SELECT struct_pack(
+    path := l.path,
+    dataChange := true,
+    deletionTimestamp := epoch_ms(CURRENT_TIMESTAMP),
+    extendedFileMetadata := true,
+    partitionValues := l."add".partitionValues,
+    size := l."add".size,
+    deletionVector := l."add".deletionVector
+) AS remove
+FROM live l
+WHERE NOT EXISTS (
+    SELECT 1 FROM target t WHERE t.path = l.path AND t."add".deletionVector IS NOT DISTINCT FROM l."add".deletionVector
+)
+UNION ALL BY NAME
+SELECT t."add" FROM target t
+WHERE NOT EXISTS (
+    SELECT 1 FROM live l WHERE l.path = t.path AND l."add".deletionVector IS NOT DISTINCT FROM t."add".deletionVector
+)
+UNION ALL BY NAME
+SELECT m.metaData FROM metadata m
+WHERE m.at_target AND EXISTS (
+    SELECT 1 FROM metadata WHERE NOT at_target AND metaData IS DISTINCT FROM m.metaData
+);
@@ -0,0 +1,20 @@
+-- stages actions undoing commit $1 for files no commit since changed:
+-- removes files it added, re-adds files it removed as they were before it. $2 is latestVersion.
+INSERT INTO log_json BY NAME
+WITH changed AS (
+    SELECT path, "add" FROM file_actions_at($2) WHERE version = $1
+)
+SELECT struct_pack(
+    path := c.path,
+    dataChange := true,
+    deletionTimestamp := epoch_ms(CURRENT_TIMESTAMP),
+    extendedFileMetadata := true,
+    partitionValues := c."add".partitionValues,
+    size := c."add".size,
+    deletionVector := c."add".deletionVector
+) AS remove
+FROM changed c
+WHERE c."add" IS NOT NULL
+UNION ALL BY NAME
+SELECT p."add" FROM file_actions_at($1 - 1) p
+WHERE p."add" IS NOT NULL AND p.path IN (SELECT path FROM changed);
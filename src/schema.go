@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// see https://github.com/delta-io/delta/blob/master/PROTOCOL.md#schema-serialization-format
+type deltaStructField struct {
+	Name     string         `json:"name"`
+	Type     any            `json:"type"`
+	Nullable bool           `json:"nullable"`
+	Metadata map[string]any `json:"metadata"`
+}
+
+type deltaStructType struct {
+	Type   string             `json:"type"`
+	Fields []deltaStructField `json:"fields"`
+}
+
+type deltaArrayType struct {
+	Type         string `json:"type"`
+	ElementType  any    `json:"elementType"`
+	ContainsNull bool   `json:"containsNull"`
+}
+
+type deltaMapType struct {
+	Type              string `json:"type"`
+	KeyType           any    `json:"keyType"`
+	ValueType         any    `json:"valueType"`
+	ValueContainsNull bool   `json:"valueContainsNull"`
+}
+
+// duckdb types stored in parquet the way readers expect of a delta primitive type
+var deltaPrimitiveTypes = map[string]string{
+	"BOOLEAN":   "boolean",
+	"TINYINT":   "byte",
+	"SMALLINT":  "short",
+	"INTEGER":   "integer",
+	"BIGINT":    "long",
+	"UTINYINT":  "short",
+	"USMALLINT": "integer",
+	"UINTEGER":  "long",
+	"UBIGINT":   "decimal(20,0)",
+	"FLOAT":     "float",
+	"DOUBLE":    "double",
+	"VARCHAR":   "string",
+	"UUID":      "string",
+	"BLOB":      "binary",
+	"DATE":      "date",
+
+	"TIMESTAMP":                "timestamp_ntz",
+	"TIMESTAMP_S":              "timestamp_ntz",
+	"TIMESTAMP_MS":             "timestamp_ntz",
+	"TIMESTAMP WITH TIME ZONE": "timestamp",
+}
+
+var (
+	decimalTypeRe = regexp.MustCompile(`^DECIMAL\((\d+),\s*(\d+)\)$`)
+	listTypeRe    = regexp.MustCompile(`^(.*)\[\d*\]$`)
+)
+
+// structFields parses the names and types of fields of a STRUCT(...) type, nil for other types
+func structFields(dataType string) [][2]string {
+	if !strings.HasPrefix(dataType, "STRUCT(") || !strings.HasSuffix(dataType, ")") {
+		return nil
+	}
+	var fields [][2]string
+	for _, field := range splitTopLevel(dataType[len("STRUCT("):len(dataType)-1], ',') {
+		field = strings.TrimSpace(field)
+		var name, fieldType string
+		if strings.HasPrefix(field, `"`) {
+			end := 1
+			for end < len(field) {
+				if field[end] == '"' {
+					if end+1 < len(field) && field[end+1] == '"' {
+						end += 2
+						continue
+					}
+					break
+				}
+				end++
+			}
+			name = strings.ReplaceAll(field[1:end], `""`, `"`)
+			fieldType = field[min(end+1, len(field)):]
+		} else {
+			name, fieldType, _ = strings.Cut(field, " ")
+		}
+		fields = append(fields, [2]string{name, strings.TrimSpace(fieldType)})
+	}
+	return fields
+}
+
+// deltaType maps a duckdb column type to its delta schema type: a string for primitive
+// types, a struct, array or map object for nested ones. Types delta can't represent are an error.
+func deltaType(dataType string) (any, error) {
+	if primitive, ok := deltaPrimitiveTypes[dataType]; ok {
+		return primitive, nil
+	}
+	if matches := decimalTypeRe.FindStringSubmatch(dataType); matches != nil {
+		return fmt.Sprintf("decimal(%s,%s)", matches[1], matches[2]), nil
+	}
+	if strings.HasPrefix(dataType, "ENUM(") {
+		// enums are written to parquet as their strings
+		return "string", nil
+	}
+	if fields := structFields(dataType); fields != nil {
+		structType := deltaStructType{Type: "struct", Fields: []deltaStructField{}}
+		for _, field := range fields {
+			fieldType, err := deltaType(field[1])
+			if err != nil {
+				return nil, err
+			}
+			structType.Fields = append(structType.Fields, deltaStructField{
+				Name: field[0], Type: fieldType, Nullable: true, Metadata: map[string]any{},
+			})
+		}
+		return structType, nil
+	}
+	if strings.HasPrefix(dataType, "MAP(") && strings.HasSuffix(dataType, ")") {
+		kv := splitTopLevel(dataType[len("MAP("):len(dataType)-1], ',')
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("bad MAP type %s", dataType)
+		}
+		keyType, err := deltaType(strings.TrimSpace(kv[0]))
+		if err != nil {
+			return nil, err
+		}
+		valueType, err := deltaType(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		return deltaMapType{Type: "map", KeyType: keyType, ValueType: valueType, ValueContainsNull: true}, nil
+	}
+	if matches := listTypeRe.FindStringSubmatch(dataType); matches != nil {
+		elementType, err := deltaType(matches[1])
+		if err != nil {
+			return nil, err
+		}
+		return deltaArrayType{Type: "array", ElementType: elementType, ContainsNull: true}, nil
+	}
+	return nil, fmt.Errorf("type %s has no Delta Lake equivalent", dataType)
+}
+
+// parquetDataType is dataType as written to parquet files. Delta has no uuid type, so UUIDs,
+// nested ones too, are written as the strings the schema says they are. rowsSQL casts them back.
+func parquetDataType(dataType string) string {
+	if dataType == "UUID" {
+		return "VARCHAR"
+	}
+	if fields := structFields(dataType); fields != nil {
+		columns := make([]string, len(fields))
+		for i, field := range fields {
+			columns[i] = quoteIdentifier(field[0]) + " " + parquetDataType(field[1])
+		}
+		return "STRUCT(" + strings.Join(columns, ", ") + ")"
+	}
+	if strings.HasPrefix(dataType, "MAP(") && strings.HasSuffix(dataType, ")") {
+		kv := splitTopLevel(dataType[len("MAP("):len(dataType)-1], ',')
+		if len(kv) == 2 {
+			return fmt.Sprintf("MAP(%s, %s)", parquetDataType(strings.TrimSpace(kv[0])), parquetDataType(strings.TrimSpace(kv[1])))
+		}
+	}
+	if matches := listTypeRe.FindStringSubmatch(dataType); matches != nil {
+		return parquetDataType(matches[1]) + dataType[len(matches[1]):]
+	}
+	return dataType
+}
+
+// tableColumn is a column of a duckdb table
+type tableColumn struct {
+	Name     string
+	DataType string
+	Nullable bool
+	Default  sql.NullString
+}
+
+// tableColumns lists columns of table in their order
+func tableColumns(dataTx *sql.Tx, table string) ([]tableColumn, error) {
+	rows, err := dataTx.Query(`
+		SELECT column_name, data_type, is_nullable, column_default
+		FROM duckdb_columns()
+		WHERE table_name = $1
+		ORDER BY column_index`, table)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get columns of %s: %w", table, err)
+	}
+	defer rows.Close()
+	var columns []tableColumn
+	for rows.Next() {
+		var column tableColumn
+		if err := rows.Scan(&column.Name, &column.DataType, &column.Nullable, &column.Default); err != nil {
+			return nil, err
+		}
+		columns = append(columns, column)
+	}
+	return columns, rows.Err()
+}
+
+// integral delta types in the order they widen in
+var deltaIntegralTypes = []string{"byte", "short", "integer", "long"}
+
+// digits of the widest value of each integral delta type
+var deltaIntegralDigits = map[string]int{"byte": 3, "short": 5, "integer": 10, "long": 20}
+
+// isTypeWidening tells if values of primitive delta type from can be read as to
+// without rewriting them, as allowed by delta's typeWidening feature
+func isTypeWidening(from, to string) bool {
+	var p, s, toP, toS int
+	_, fromErr := fmt.Sscanf(from, "decimal(%d,%d)", &p, &s)
+	_, toErr := fmt.Sscanf(to, "decimal(%d,%d)", &toP, &toS)
+	fromIndex, toIndex := slices.Index(deltaIntegralTypes, from), slices.Index(deltaIntegralTypes, to)
+	switch {
+	case fromIndex >= 0 && toIndex >= 0:
+		return fromIndex < toIndex
+	case from == "float" && to == "double":
+		return true
+	case from == "date" && to == "timestamp_ntz":
+		return true
+	case fromIndex >= 0 && to == "double":
+		return from != "long"
+	case fromIndex >= 0 && toErr == nil:
+		return toP-toS >= deltaIntegralDigits[from]
+	case fromErr == nil && toErr == nil:
+		return toP >= p && toS >= s && toP-toS >= p-s && (toP > p || toS > s)
+	}
+	return false
+}
+
+// deltaSchema maps the columns of table to a delta schema, followed by partition columns
+// computed from other columns, whose values are only in partitionValues.
+// Columns in previous keep its metadata, and its type unless that's nil.
+func deltaSchema(dataTx *sql.Tx, table string, partitionBy []PartitionColumn, previous map[string]deltaStructField) (deltaStructType, error) {
+	columns, err := tableColumns(dataTx, table)
+	if err != nil {
+		return deltaStructType{}, err
+	}
+	schema := deltaStructType{Type: "struct", Fields: []deltaStructField{}}
+	field := func(name string, fieldType any, nullable bool) deltaStructField {
+		metadata := map[string]any{}
+		if p, ok := previous[name]; ok {
+			if p.Metadata != nil {
+				metadata = p.Metadata
+			}
+			if p.Type != nil {
+				fieldType = p.Type
+			}
+		}
+		return deltaStructField{Name: name, Type: fieldType, Nullable: nullable, Metadata: metadata}
+	}
+	names := map[string]bool{}
+	for _, column := range columns {
+		fieldType, err := deltaType(column.DataType)
+		if err != nil {
+			return deltaStructType{}, fmt.Errorf("column %s: %w", column.Name, err)
+		}
+		schema.Fields = append(schema.Fields, field(column.Name, fieldType, column.Nullable))
+		names[column.Name] = true
+	}
+	for _, column := range partitionBy {
+		if !names[column.Name] {
+			schema.Fields = append(schema.Fields, field(column.Name, "string", true))
+		}
+	}
+	return schema, nil
+}
+
+// renderSchemaString renders schema as metaData.schemaString, tables that map columns
+// (maxColumnId >= 0) get ids for new fields. Returns the new maxColumnId.
+func renderSchemaString(schema deltaStructType, maxColumnId int64) (string, int64, error) {
+	if maxColumnId >= 0 {
+		return columnMappedSchemaString(schema, maxColumnId)
+	}
+	data, err := json.Marshal(schema)
+	return string(data), maxColumnId, err
+}
+
+// duckdb types of delta primitive types, the other way around from deltaPrimitiveTypes
+var duckdbPrimitiveTypes = map[string]string{
+	"boolean":       "BOOLEAN",
+	"byte":          "TINYINT",
+	"short":         "SMALLINT",
+	"integer":       "INTEGER",
+	"long":          "BIGINT",
+	"float":         "FLOAT",
+	"double":        "DOUBLE",
+	"string":        "VARCHAR",
+	"binary":        "BLOB",
+	"date":          "DATE",
+	"timestamp":     "TIMESTAMP WITH TIME ZONE",
+	"timestamp_ntz": "TIMESTAMP",
+}
+
+// duckdbType maps a delta schema type, decoded from json, to a duckdb column type
+func duckdbType(schemaType any) (string, error) {
+	switch t := schemaType.(type) {
+	case string:
+		if primitive, ok := duckdbPrimitiveTypes[t]; ok {
+			return primitive, nil
+		}
+		var p, s int
+		if _, err := fmt.Sscanf(t, "decimal(%d,%d)", &p, &s); err == nil {
+			return fmt.Sprintf("DECIMAL(%d,%d)", p, s), nil
+		}
+	case map[string]any:
+		switch t["type"] {
+		case "struct":
+			fields, _ := t["fields"].([]any)
+			columns := make([]string, 0, len(fields))
+			for _, f := range fields {
+				field, _ := f.(map[string]any)
+				name, _ := field["name"].(string)
+				fieldType, err := duckdbType(field["type"])
+				if err != nil {
+					return "", err
+				}
+				columns = append(columns, quoteIdentifier(name)+" "+fieldType)
+			}
+			return "STRUCT(" + strings.Join(columns, ", ") + ")", nil
+		case "array":
+			elementType, err := duckdbType(t["elementType"])
+			if err != nil {
+				return "", err
+			}
+			return elementType + "[]", nil
+		case "map":
+			keyType, err := duckdbType(t["keyType"])
+			if err != nil {
+				return "", err
+			}
+			valueType, err := duckdbType(t["valueType"])
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("MAP(%s, %s)", keyType, valueType), nil
+		}
+	}
+	data, _ := json.Marshal(schemaType)
+	return "", fmt.Errorf("delta type %s has no duckdb equivalent", data)
+}
+
+// createTableFromSchema derives a CREATE TABLE of table from the schemaString of a table
+// another writer created, which has no duckpond.createTable to take it from
+func createTableFromSchema(table, schemaString string) (string, error) {
+	var schema struct {
+		Fields []struct {
+			Name     string `json:"name"`
+			Type     any    `json:"type"`
+			Nullable bool   `json:"nullable"`
+		} `json:"fields"`
+	}
+	if err := json.Unmarshal([]byte(schemaString), &schema); err != nil {
+		return "", fmt.Errorf("bad schemaString of %s: %w", table, err)
+	}
+	if len(schema.Fields) == 0 {
+		return "", fmt.Errorf("schemaString of %s has no columns", table)
+	}
+	columns := make([]string, len(schema.Fields))
+	for i, field := range schema.Fields {
+		dataType, err := duckdbType(field.Type)
+		if err != nil {
+			return "", fmt.Errorf("column %s: %w", field.Name, err)
+		}
+		columns[i] = quoteIdentifier(field.Name) + " " + dataType
+		if !field.Nullable {
+			columns[i] += " NOT NULL"
+		}
+	}
+	return fmt.Sprintf("CREATE TABLE %s (%s)", table, strings.Join(columns, ", ")), nil
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaType(t *testing.T) {
+	tests := []struct {
+		dataType  string
+		deltaType string
+	}{
+		{"BIGINT", `"long"`},
+		{"UBIGINT", `"decimal(20,0)"`},
+		{"DECIMAL(10,2)", `"decimal(10,2)"`},
+		{"TIMESTAMP", `"timestamp_ntz"`},
+		{"TIMESTAMP WITH TIME ZONE", `"timestamp"`},
+		{"ENUM('a', 'b')", `"string"`},
+		{"VARCHAR[]", `{"type": "array", "elementType": "string", "containsNull": true}`},
+		{"INTEGER[3][]", `{"type": "array", "elementType": {"type": "array", "elementType": "integer", "containsNull": true}, "containsNull": true}`},
+		{"MAP(VARCHAR, DECIMAL(18,3))", `{"type": "map", "keyType": "string", "valueType": "decimal(18,3)", "valueContainsNull": true}`},
+		{`STRUCT(a DATE, "b, ""c""" STRUCT(d BLOB)[])`, `{"type": "struct", "fields": [
+			{"name": "a", "type": "date", "nullable": true, "metadata": {}},
+			{"name": "b, \"c\"", "type": {"type": "array", "elementType": {"type": "struct", "fields": [
+				{"name": "d", "type": "binary", "nullable": true, "metadata": {}}]}, "containsNull": true},
+			 "nullable": true, "metadata": {}}]}`},
+	}
+	for _, tt := range tests {
+		deltaType, err := deltaType(tt.dataType)
+		if assert.NoError(t, err, tt.dataType) {
+			data, err := json.Marshal(deltaType)
+			assert.NoError(t, err)
+			assert.JSONEq(t, tt.deltaType, string(data), tt.dataType)
+		}
+	}
+
+	for _, dataType := range []string{"HUGEINT", "TIME", "INTERVAL", "TIMESTAMP_NS", "UNION(i INTEGER, s VARCHAR)", "STRUCT(t TIME)", "MAP(VARCHAR, INTERVAL)"} {
+		_, err := deltaType(dataType)
+		assert.Error(t, err, dataType)
+	}
+}
+
+func TestParquetDataType(t *testing.T) {
+	tests := map[string]string{
+		"UUID":                         "VARCHAR",
+		"UUID[3][]":                    "VARCHAR[3][]",
+		"MAP(UUID, INTEGER)":           "MAP(VARCHAR, INTEGER)",
+		"STRUCT(UUID UUID, u INTEGER)": `STRUCT("UUID" VARCHAR, "u" INTEGER)`,
+		"STRUCT(s STRUCT(u UUID)[])":   `STRUCT("s" STRUCT("u" VARCHAR)[])`,
+		"DECIMAL(10,2)":                "DECIMAL(10,2)",
+	}
+	for dataType, parquetType := range tests {
+		assert.Equal(t, parquetType, parquetDataType(dataType), dataType)
+	}
+}
+
+func TestCreateTableOfTypeWithoutDeltaEquivalent(t *testing.T) {
+	ib := newTestDB(t)
+
+	_, err := ib.PostEndpoint("/query", "CREATE TABLE schema_test (id INTEGER, at TIME)")
+	assert.ErrorContains(t, err, "TIME has no Delta Lake equivalent")
+	_, err = ib.PostEndpoint("/query", "CREATE TABLE schema_test (id INTEGER, price DECIMAL(10,2), tags STRUCT(k VARCHAR, v DOUBLE)[])")
+	assert.NoError(t, err, "table name should still be free")
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// statsPredicate is a conjunct of a WHERE clause that add.stats min/max can rule files out by
+type statsPredicate struct {
+	Column string
+	Op     string // one of = < <= > >=
+	Value  string // SQL literal
+}
+
+var whereKeywordRe = regexp.MustCompile(`(?i)\bWHERE\b`)
+var setKeywordRe = regexp.MustCompile(`(?i)\bSET\b`)
+
+// topLevelKeyword locates the first match of keywordRe in query that isn't inside
+// string literals or parentheses, nil when there is none
+func topLevelKeyword(query string, keywordRe *regexp.Regexp) []int {
+	for _, loc := range keywordRe.FindAllStringIndex(query, -1) {
+		prefix := query[:loc[0]]
+		if strings.Count(prefix, "'")%2 == 0 && strings.Count(prefix, `"`)%2 == 0 &&
+			strings.Count(prefix, "(") == strings.Count(prefix, ")") {
+			return loc
+		}
+	}
+	return nil
+}
+
+// topLevelWhere returns the condition after the WHERE of a DELETE or UPDATE,
+// skipping WHEREs inside string literals or parentheses. "" when there is none.
+func topLevelWhere(query string) string {
+	if loc := topLevelKeyword(query, whereKeywordRe); loc != nil {
+		return strings.TrimSpace(query[loc[1]:])
+	}
+	return ""
+}
+
+// topLevelSet returns the assignments between SET and WHERE of an UPDATE, "" for other statements
+func topLevelSet(query string) string {
+	loc := topLevelKeyword(query, setKeywordRe)
+	if loc == nil {
+		return ""
+	}
+	set := query[loc[1]:]
+	if where := topLevelKeyword(set, whereKeywordRe); where != nil {
+		set = set[:where[0]]
+	}
+	return strings.TrimSpace(set)
+}
+
+// flipped comparisons for `constant op column`
+var flippedOps = map[string]string{"=": "=", "<": ">", "<=": ">=", ">": "<", ">=": "<="}
+
+var comparisonOps = map[string]string{
+	"COMPARE_EQUAL":                "=",
+	"COMPARE_LESSTHAN":             "<",
+	"COMPARE_LESSTHANOREQUALTO":    "<=",
+	"COMPARE_GREATERTHAN":          ">",
+	"COMPARE_GREATERTHANOREQUALTO": ">=",
+}
+
+// statsPredicates extracts `column op constant` conjuncts from the WHERE condition of statement,
+// a DELETE or UPDATE of table. Anything else in the condition is ignored, which is safe since it can
+// only make fewer rows match. A condition duckdb can't parse as part of a SELECT yields no predicates.
+func statsPredicates(db *sql.DB, table string, statement string) ([]statsPredicate, error) {
+	where := topLevelWhere(statement)
+	if where == "" {
+		return nil, nil
+	}
+	// assignments parse as comparisons, so subqueries of the table in them count for selectPredicates
+	selectList := "*"
+	if set := topLevelSet(statement); set != "" {
+		selectList = set
+	}
+	return selectPredicates(db, table, fmt.Sprintf("SELECT %s FROM %s WHERE %s", selectList, table, where))
+}
+
+// selectPredicates extracts `column op constant` conjuncts from the WHERE clause of statement,
+// a SELECT from table alone. Other statements, like joins or unions, yield no predicates, and so do
+// ones reading the table again, e.g. in a subquery, since that has to see rows of every file.
+func selectPredicates(db *sql.DB, table string, statement string) ([]statsPredicate, error) {
+	var serialized string
+	// json_serialize_sql only takes a constant
+	err := db.QueryRow("SELECT json_serialize_sql(" + quoteSQLString(statement) + ")").Scan(&serialized)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse WHERE clause: %w", err)
+	}
+	var ast struct {
+		Error      bool `json:"error"`
+		Statements []struct {
+			Node struct {
+				Type      string `json:"type"`
+				FromTable struct {
+					Type       string `json:"type"`
+					Alias      string `json:"alias"`
+					SchemaName string `json:"schema_name"`
+					TableName  string `json:"table_name"`
+				} `json:"from_table"`
+				WhereClause map[string]any `json:"where_clause"`
+			} `json:"node"`
+		} `json:"statements"`
+	}
+	var tree any
+	if err := json.Unmarshal([]byte(serialized), &ast); err != nil {
+		return nil, fmt.Errorf("failed to decode WHERE clause: %w", err)
+	}
+	if err := json.Unmarshal([]byte(serialized), &tree); err != nil {
+		return nil, fmt.Errorf("failed to decode WHERE clause: %w", err)
+	}
+	if ast.Error || len(ast.Statements) != 1 {
+		return nil, nil
+	}
+	node := ast.Statements[0].Node
+	from := node.FromTable
+	qualifiedName := from.TableName
+	if from.SchemaName != "" {
+		qualifiedName = from.SchemaName + "." + from.TableName
+	}
+	if node.Type != "SELECT_NODE" || from.Type != "BASE_TABLE" || !strings.EqualFold(qualifiedName, table) {
+		return nil, nil
+	}
+	if tableReferences(tree, from.TableName) != 1 {
+		return nil, nil
+	}
+	// columns qualified by anything else are from subqueries
+	qualifiers := []string{strings.ToLower(from.TableName), strings.ToLower(from.Alias)}
+
+	var predicates []statsPredicate
+	var collect func(node map[string]any) error
+	add := func(column, constant map[string]any, op string) error {
+		names, _ := column["column_names"].([]any)
+		if len(names) == 0 {
+			return nil
+		}
+		if len(names) > 1 && !slices.Contains(qualifiers, strings.ToLower(fmt.Sprint(names[len(names)-2]))) {
+			return nil
+		}
+		if value, _ := constant["value"].(map[string]any); value == nil || value["is_null"] == true {
+			return nil
+		}
+		literal, err := constantLiteral(db, constant)
+		if err != nil {
+			return err
+		}
+		predicates = append(predicates, statsPredicate{Column: fmt.Sprint(names[len(names)-1]), Op: op, Value: literal})
+		return nil
+	}
+	collect = func(node map[string]any) error {
+		switch node["class"] {
+		case "CONJUNCTION":
+			if node["type"] != "CONJUNCTION_AND" {
+				return nil
+			}
+			children, _ := node["children"].([]any)
+			for _, child := range children {
+				if child, ok := child.(map[string]any); ok {
+					if err := collect(child); err != nil {
+						return err
+					}
+				}
+			}
+		case "COMPARISON":
+			op, ok := comparisonOps[fmt.Sprint(node["type"])]
+			if !ok {
+				return nil
+			}
+			left, _ := node["left"].(map[string]any)
+			right, _ := node["right"].(map[string]any)
+			switch {
+			case left["class"] == "COLUMN_REF" && right["class"] == "CONSTANT":
+				return add(left, right, op)
+			case left["class"] == "CONSTANT" && right["class"] == "COLUMN_REF":
+				return add(right, left, flippedOps[op])
+			}
+		case "BETWEEN":
+			input, _ := node["input"].(map[string]any)
+			lower, _ := node["lower"].(map[string]any)
+			upper, _ := node["upper"].(map[string]any)
+			if input["class"] == "COLUMN_REF" && lower["class"] == "CONSTANT" && upper["class"] == "CONSTANT" {
+				if err := add(input, lower, ">="); err != nil {
+					return err
+				}
+				return add(input, upper, "<=")
+			}
+		}
+		return nil
+	}
+	if node.WhereClause == nil {
+		return nil, nil
+	}
+	if err := collect(node.WhereClause); err != nil {
+		return nil, err
+	}
+	return predicates, nil
+}
+
+// tableReferences counts references to table in a serialized statement, whatever their schema
+func tableReferences(node any, table string) int {
+	count := 0
+	switch node := node.(type) {
+	case map[string]any:
+		if name, _ := node["table_name"].(string); node["type"] == "BASE_TABLE" && strings.EqualFold(name, table) {
+			count++
+		}
+		for _, child := range node {
+			count += tableReferences(child, table)
+		}
+	case []any:
+		for _, child := range node {
+			count += tableReferences(child, table)
+		}
+	}
+	return count
+}
+
+// constantLiteral renders a CONSTANT node of a serialized statement back into SQL
+func constantLiteral(db *sql.DB, constant map[string]any) (string, error) {
+	statement := map[string]any{
+		"error": false,
+		"statements": []any{map[string]any{"node": map[string]any{
+			"type":               "SELECT_NODE",
+			"modifiers":          []any{},
+			"cte_map":            map[string]any{"map": []any{}},
+			"select_list":        []any{constant},
+			"from_table":         map[string]any{"type": "EMPTY", "alias": "", "sample": nil},
+			"where_clause":       nil,
+			"group_expressions":  []any{},
+			"group_sets":         []any{},
+			"aggregate_handling": "STANDARD_HANDLING",
+			"having":             nil,
+			"sample":             nil,
+			"qualify":            nil,
+		}}},
+	}
+	serialized, err := json.Marshal(statement)
+	if err != nil {
+		return "", err
+	}
+	var query string
+	if err := db.QueryRow("SELECT json_deserialize_sql(" + quoteSQLString(string(serialized)) + "::JSON)").Scan(&query); err != nil {
+		return "", fmt.Errorf("failed to render constant: %w", err)
+	}
+	return strings.TrimPrefix(query, "SELECT "), nil
+}
+
+// tableColumnTypes maps lowercased column names of table to their name and duckdb type
+func tableColumnTypes(dataTx *sql.Tx, table string) (map[string][2]string, error) {
+	columns, err := tableColumns(dataTx, table)
+	if err != nil {
+		return nil, err
+	}
+	return columnTypes(columns), nil
+}
+
+// columnTypes maps lowercased names of columns to their name and duckdb type
+func columnTypes(columns []tableColumn) map[string][2]string {
+	types := make(map[string][2]string, len(columns))
+	for _, column := range columns {
+		types[strings.ToLower(column.Name)] = [2]string{column.Name, column.DataType}
+	}
+	return types
+}
+
+// comparableValue is a constant as SQL duckdb compares with values of dataType the way WHERE does.
+// String constants are cast to dataType, other constants are kept as they are: casting them could
+// round them, like 1.5 to 2 for an INTEGER column, and rule out files with matching rows.
+// ok is false when duckdb can't compare the two at all.
+func comparableValue(db *sql.DB, value string, dataType string) (string, bool) {
+	var valueType string
+	var compared sql.NullBool
+	query := fmt.Sprintf("SELECT typeof(%[1]s), NULL::%[2]s = %[1]s", value, dataType)
+	if err := db.QueryRow(query).Scan(&valueType, &compared); err != nil {
+		return "", false
+	}
+	if valueType == "VARCHAR" {
+		return fmt.Sprintf("TRY_CAST(%s AS %s)", value, dataType), true
+	}
+	return value, true
+}
+
+// statsCondition is SQL over "add".stats that is false only for files whose min/max
+// rule out rows matching all predicates. Unknown stats never rule a file out.
+func statsCondition(db *sql.DB, predicates []statsPredicate, columns map[string][2]string, physical map[string]string) string {
+	conditions := []string{"true"}
+	for _, p := range predicates {
+		column, ok := columns[strings.ToLower(p.Column)]
+		if !ok {
+			continue
+		}
+		name, dataType := quoteSQLString(physicalName(physical, column[0])), column[1]
+		value, ok := comparableValue(db, p.Value, dataType)
+		if !ok {
+			continue
+		}
+		minValue := fmt.Sprintf(`TRY_CAST(stats_min("add".stats, %s) AS %s)`, name, dataType)
+		maxValue := fmt.Sprintf(`TRY_CAST(stats_max("add".stats, %s) AS %s)`, name, dataType)
+		var condition string
+		switch p.Op {
+		case "=":
+			condition = fmt.Sprintf("%s <= %s AND %s >= %s", minValue, value, maxValue, value)
+		case "<", "<=":
+			condition = fmt.Sprintf("%s %s %s", minValue, p.Op, value)
+		case ">", ">=":
+			condition = fmt.Sprintf("%s %s %s", maxValue, p.Op, value)
+		}
+		conditions = append(conditions, fmt.Sprintf("coalesce((%s), true)", condition))
+	}
+	return strings.Join(conditions, " AND ")
+}
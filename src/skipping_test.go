@@ -0,0 +1,98 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTopLevelWhere(t *testing.T) {
+	tests := []struct {
+		query string
+		where string
+	}{
+		{"DELETE FROM t WHERE id = 1", "id = 1"},
+		{"DELETE FROM t", ""},
+		{"UPDATE t SET note = 'WHERE id = 2' WHERE id = 3", "id = 3"},
+		{"UPDATE t SET n = (SELECT max(n) FROM u WHERE u.id = 1) where id > 2", "id > 2"},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.where, topLevelWhere(tt.query), "topLevelWhere(%q)", tt.query)
+	}
+}
+
+func TestTopLevelSet(t *testing.T) {
+	tests := []struct {
+		query string
+		set   string
+	}{
+		{"UPDATE t SET note = 'SET x = 1 WHERE' WHERE id = 3", "note = 'SET x = 1 WHERE'"},
+		{"UPDATE t SET n = (SELECT max(n) FROM u WHERE u.id = 1), m = 2", "n = (SELECT max(n) FROM u WHERE u.id = 1), m = 2"},
+		{"DELETE FROM t WHERE id = 1", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.set, topLevelSet(tt.query), "topLevelSet(%q)", tt.query)
+	}
+}
+
+func TestStatsPredicates(t *testing.T) {
+	db, err := InitializeDuckDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	predicates, err := statsPredicates(db, "t", "DELETE FROM t WHERE id >= 5 AND 1.5 > x AND d BETWEEN '2024-01-01' AND '2024-02-01' AND (a = 1 OR b = 2) AND t.name = 'bob'")
+	assert.NoError(t, err)
+	assert.Equal(t, []statsPredicate{
+		{Column: "id", Op: ">=", Value: "5"},
+		{Column: "x", Op: "<", Value: "1.5"},
+		{Column: "d", Op: ">=", Value: "'2024-01-01'"},
+		{Column: "d", Op: "<=", Value: "'2024-02-01'"},
+		{Column: "name", Op: "=", Value: "'bob'"},
+	}, predicates)
+
+	// conditions that aren't a conjunction of comparisons can't rule files out
+	predicates, err = statsPredicates(db, "t", "DELETE FROM t WHERE a = 1 OR b = 2")
+	assert.NoError(t, err)
+	assert.Empty(t, predicates)
+	predicates, err = statsPredicates(db, "t", "DELETE FROM t WHERE id = 1 RETURNING *")
+	assert.NoError(t, err)
+	assert.Empty(t, predicates)
+
+	predicates, err = statsPredicates(db, "t", "UPDATE t SET note = 'x', n = n + 1 WHERE id = 1")
+	assert.NoError(t, err)
+	assert.Equal(t, []statsPredicate{{Column: "id", Op: "=", Value: "1"}}, predicates)
+	// subqueries of the table have to see rows of every file
+	for _, statement := range []string{
+		"DELETE FROM t WHERE id > 2 AND id < (SELECT max(id) FROM t)",
+		"UPDATE t SET n = (SELECT count(*) FROM t) WHERE id > 2",
+	} {
+		predicates, err = statsPredicates(db, "t", statement)
+		assert.NoError(t, err)
+		assert.Empty(t, predicates, statement)
+	}
+}
+
+func TestSelectPredicates(t *testing.T) {
+	db, err := InitializeDuckDB()
+	assert.NoError(t, err)
+	defer db.Close()
+
+	predicates, err := selectPredicates(db, "t", "SELECT * FROM t AS x WHERE x.id = 1 AND u.id = 2 ORDER BY id LIMIT 3")
+	assert.NoError(t, err)
+	assert.Equal(t, []statsPredicate{{Column: "id", Op: "=", Value: "1"}}, predicates)
+
+	// other tables may have rows the WHERE clause is about
+	for _, query := range []string{
+		"SELECT * FROM t JOIN u USING (id) WHERE id = 1",
+		"SELECT * FROM t UNION ALL SELECT * FROM t WHERE id = 1",
+		"SELECT * FROM u WHERE id = 1",
+		// and reading the table again needs rows of every file
+		"SELECT (SELECT count(*) FROM t) AS total FROM t WHERE id = 1",
+		"SELECT * FROM t WHERE id = 1 AND EXISTS (SELECT 1 FROM t x WHERE x.id = 6)",
+		"WITH c AS (SELECT count(*) AS n FROM main.t) SELECT * FROM t, c WHERE id = 1",
+	} {
+		predicates, err = selectPredicates(db, "t", query)
+		assert.NoError(t, err)
+		assert.Empty(t, predicates, query)
+	}
+}
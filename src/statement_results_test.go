@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAllResults(t *testing.T) {
+	ib := newLogTestTable(t, 0)
+	ib.options.enableQuerySplitting = true
+
+	post := func(body string) (StatementResults, error) {
+		jsonResponse, err := ib.PostEndpointWithOptions("/query", body, QueryOptions{AllResults: true})
+		var results StatementResults
+		require.NoError(t, json.Unmarshal([]byte(jsonResponse), &results), jsonResponse)
+		return results, err
+	}
+
+	results, err := post(`
+		INSERT INTO log_test VALUES (1, 'a'), (2, 'b'), (3, 'c');
+		UPDATE log_test SET text = 'z' WHERE id > 1;
+		DELETE FROM log_test WHERE id = 3;
+		SELECT id, text FROM log_test ORDER BY id`)
+	require.NoError(t, err)
+	require.Len(t, results.Results, 4)
+	assert.Nil(t, results.Error)
+	for i, expected := range []int64{3, 2, 1} {
+		result := results.Results[i]
+		assert.Equal(t, i, result.Statement)
+		if assert.NotNil(t, result.AffectedRows, result.Query) {
+			assert.Equal(t, expected, *result.AffectedRows, result.Query)
+		}
+		assert.Greater(t, result.Statistics.Elapsed, 0.0)
+	}
+	selected := results.Results[3]
+	assert.Nil(t, selected.AffectedRows, "SELECT changes no rows")
+	assert.Equal(t, "SELECT id, text FROM log_test ORDER BY id", selected.Query)
+	assert.Equal(t, 2, selected.Rows)
+	assert.Equal(t, [][]interface{}{{"1", "a"}, {"2", "z"}}, selected.Data)
+
+	results, err = post("INSERT INTO log_test VALUES (4, 'd'); SELECT * FROM missing; INSERT INTO log_test VALUES (5, 'e')")
+	assert.Error(t, err)
+	assert.Len(t, results.Results, 1, "statements after the failing one don't run")
+	if assert.NotNil(t, results.Error) {
+		assert.Equal(t, 1, results.Error.Statement)
+		assert.Equal(t, err.Error(), results.Error.Message)
+	}
+
+	results, err = post("BEGIN; INSERT INTO log_test VALUES (6, 'f')")
+	assert.Error(t, err)
+	if assert.NotNil(t, results.Error) {
+		assert.Equal(t, 0, results.Error.Statement, "missing COMMIT should point at BEGIN")
+	}
+	assert.Equal(t, "1,2,4", queryIDs(t, ib, "SELECT id FROM log_test ORDER BY id"))
+
+	// counts are of rows committed, not of rows duckdb inserted in memory
+	_, err = ib.PostEndpoint("/query", "CREATE TABLE keyed (id INTEGER PRIMARY KEY); INSERT INTO keyed VALUES (1), (2)")
+	require.NoError(t, err)
+	results, err = post(`
+		INSERT OR IGNORE INTO keyed VALUES (2), (3);
+		INSERT OR REPLACE INTO keyed VALUES (1);
+		SET duckpond.txn = 'ingest:1';
+		INSERT INTO keyed VALUES (4)`)
+	require.NoError(t, err)
+	retried, err := post("SET duckpond.txn = 'ingest:1'; INSERT INTO keyed VALUES (5)")
+	require.NoError(t, err)
+	for _, result := range []StatementResult{results.Results[0], results.Results[1], results.Results[3], retried.Results[1]} {
+		expected := int64(1)
+		if result.Query == "INSERT INTO keyed VALUES (5)" {
+			expected = 0 // the txn is already committed
+		}
+		if assert.NotNil(t, result.AffectedRows, result.Query) {
+			assert.Equal(t, expected, *result.AffectedRows, result.Query)
+		}
+	}
+	assert.Equal(t, "1,2,3,4", queryIDs(t, ib, "SELECT id FROM keyed ORDER BY id"))
+
+	// over HTTP results=all is a query parameter, failures still respond with the results
+	handler := ib.RequestHandler()
+	recorder := httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/query?results=all", strings.NewReader("SELECT 1 AS one; SELECT * FROM missing")))
+	assert.Equal(t, http.StatusBadRequest, recorder.Code)
+	assert.Equal(t, "application/json", recorder.Header().Get("Content-Type"))
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &results))
+	assert.Len(t, results.Results, 1)
+	if assert.NotNil(t, results.Error) {
+		assert.Equal(t, 1, results.Error.Statement)
+	}
+
+	recorder = httptest.NewRecorder()
+	handler(recorder, httptest.NewRequest(http.MethodPost, "/query", strings.NewReader("SELECT 1 AS one; SELECT 2 AS two")))
+	assert.Equal(t, http.StatusOK, recorder.Code)
+	var response QueryResponse
+	require.NoError(t, json.Unmarshal(recorder.Body.Bytes(), &response))
+	assert.Equal(t, [][]interface{}{{"2"}}, response.Data, "without results=all only the last result is returned")
+}
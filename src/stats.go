@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// strings in stats are cut to this many characters, as delta's dataSkippingStringPrefixLength
+const statsStringPrefixLength = 32
+
+// statsField is a column or struct field stats are collected for
+type statsField struct {
+	name     string
+	sql      string // expression selecting the field
+	dataType string
+}
+
+// quoteIdentifier renders name as a double-quoted SQL identifier
+func quoteIdentifier(name string) string {
+	return `"` + strings.ReplaceAll(name, `"`, `""`) + `"`
+}
+
+// minMaxSQL renders min and max of field as JSON, empty for types delta keeps no min/max of
+func minMaxSQL(field statsField) (string, string) {
+	x := field.sql
+	switch field.dataType {
+	case "TINYINT", "SMALLINT", "INTEGER", "BIGINT", "UTINYINT", "USMALLINT", "UINTEGER", "UBIGINT":
+		return fmt.Sprintf("min(%s)::VARCHAR::JSON", x), fmt.Sprintf("max(%s)::VARCHAR::JSON", x)
+	case "FLOAT", "DOUBLE":
+		// NaN and infinities have no JSON number
+		finite := fmt.Sprintf("CASE WHEN bool_and(isfinite(%s)) THEN %%s(%s)::VARCHAR::JSON END", x, x)
+		return fmt.Sprintf(finite, "min"), fmt.Sprintf(finite, "max")
+	case "DATE":
+		return fmt.Sprintf("to_json(strftime(min(%s), '%%Y-%%m-%%d'))", x),
+			fmt.Sprintf("to_json(strftime(max(%s), '%%Y-%%m-%%d'))", x)
+	case "TIMESTAMP", "TIMESTAMP_S", "TIMESTAMP_MS":
+		return fmt.Sprintf("to_json(strftime(min(%s)::TIMESTAMP, '%%Y-%%m-%%dT%%H:%%M:%%S.%%f'))", x),
+			fmt.Sprintf("to_json(strftime(max(%s)::TIMESTAMP, '%%Y-%%m-%%dT%%H:%%M:%%S.%%f'))", x)
+	case "TIMESTAMP WITH TIME ZONE":
+		// in UTC regardless of the session's TimeZone
+		return fmt.Sprintf("to_json(strftime(make_timestamp(epoch_us(min(%s))), '%%Y-%%m-%%dT%%H:%%M:%%S.%%fZ'))", x),
+			fmt.Sprintf("to_json(strftime(make_timestamp(epoch_us(max(%s))), '%%Y-%%m-%%dT%%H:%%M:%%S.%%fZ'))", x)
+	case "VARCHAR":
+		// a cut max is followed by the greatest code point to stay above the values it stands for
+		return fmt.Sprintf("to_json(left(min(%s), %d))", x, statsStringPrefixLength),
+			fmt.Sprintf("to_json(CASE WHEN length(max(%[1]s)) > %[2]d THEN left(max(%[1]s), %[2]d) || chr(1114111) ELSE max(%[1]s) END)",
+				x, statsStringPrefixLength)
+	case "UUID":
+		// a cut uuid no longer casts back
+		return fmt.Sprintf("to_json(min(%s)::VARCHAR)", x), fmt.Sprintf("to_json(max(%s)::VARCHAR)", x)
+	}
+	if strings.HasPrefix(field.dataType, "DECIMAL(") {
+		return fmt.Sprintf("min(%s)::VARCHAR::JSON", x), fmt.Sprintf("max(%s)::VARCHAR::JSON", x)
+	}
+	return "", ""
+}
+
+// statsObjects renders minValues, maxValues and nullCount of fields as json_object calls,
+// nesting struct fields. Fields without min/max are left out of minValues and maxValues.
+func statsObjects(fields []statsField) (string, string, string) {
+	var mins, maxs, nulls []string
+	for _, field := range fields {
+		name := quoteSQLString(field.name)
+		if structType := structFields(field.dataType); structType != nil {
+			nested := make([]statsField, len(structType))
+			for i, f := range structType {
+				nested[i] = statsField{name: f[0], sql: field.sql + "." + quoteIdentifier(f[0]), dataType: f[1]}
+			}
+			minObject, maxObject, nullObject := statsObjects(nested)
+			mins = append(mins, name, minObject)
+			maxs = append(maxs, name, maxObject)
+			nulls = append(nulls, name, nullObject)
+			continue
+		}
+		if minValue, maxValue := minMaxSQL(field); minValue != "" {
+			mins = append(mins, name, minValue)
+			maxs = append(maxs, name, maxValue)
+		}
+		nulls = append(nulls, name, fmt.Sprintf("count(*) - count(%s)", field.sql))
+	}
+	object := func(args []string) string {
+		return "json_object(" + strings.Join(args, ", ") + ")"
+	}
+	return object(mins), object(maxs), object(nulls)
+}
+
+// deltaStatsSQL is a query for the add.stats of table's rows in delta's format:
+// numRecords with minValues, maxValues and nullCount keyed by the columns' physical names
+func deltaStatsSQL(dataTx *sql.Tx, table string, physical map[string]string) (string, error) {
+	columns, err := tableColumns(dataTx, table)
+	if err != nil {
+		return "", err
+	}
+	fields := make([]statsField, len(columns))
+	for i, column := range columns {
+		fields[i] = statsField{name: physicalName(physical, column.Name), sql: quoteIdentifier(column.Name), dataType: column.DataType}
+	}
+
+	minValues, maxValues, nullCount := statsObjects(fields)
+	// merging into {} drops NULL min/max of columns without values
+	return fmt.Sprintf(`
+		SELECT json_merge_patch('{}', json_object(
+			'numRecords', count(*),
+			'minValues', %s,
+			'maxValues', %s,
+			'nullCount', %s))::VARCHAR
+		FROM %s`, minValues, maxValues, nullCount, table), nil
+}
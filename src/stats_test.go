@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeltaStatsSQL(t *testing.T) {
+	db, err := InitializeDuckDB()
+	assert.NoError(t, err)
+	defer db.Close()
+	tx, err := db.Begin()
+	assert.NoError(t, err)
+	defer tx.Rollback()
+
+	_, err = tx.Exec(`
+		CREATE TABLE t (
+			id BIGINT, price DECIMAL(10, 2), ratio DOUBLE, day DATE, ts TIMESTAMP, tstz TIMESTAMPTZ,
+			name VARCHAR, "odd ""name""" STRUCT(a INTEGER, "b c" STRUCT(d VARCHAR)), flag BOOLEAN, tags VARCHAR[]);
+		INSERT INTO t VALUES
+			(1, 1.50, 0.25, '2024-01-02', '2024-01-02 03:04:05.123456', '2024-01-02 03:04:05+00',
+			 'a', {'a': 7, 'b c': {'d': 'x'}}, true, ['a']),
+			(-2, 10.00, 'nan', NULL, NULL, NULL,
+			 '` + strings.Repeat("z", 40) + `', NULL, NULL, NULL)`)
+	assert.NoError(t, err)
+
+	query, err := deltaStatsSQL(tx, "t", nil)
+	assert.NoError(t, err)
+	var stats string
+	assert.NoError(t, tx.QueryRow(query).Scan(&stats))
+	assert.JSONEq(t, `{
+		"numRecords": 2,
+		"minValues": {"id": -2, "price": 1.50, "day": "2024-01-02", "ts": "2024-01-02T03:04:05.123456",
+			"tstz": "2024-01-02T03:04:05.000000Z", "name": "a", "odd \"name\"": {"a": 7, "b c": {"d": "x"}}},
+		"maxValues": {"id": 1, "price": 10.00, "day": "2024-01-02", "ts": "2024-01-02T03:04:05.123456",
+			"tstz": "2024-01-02T03:04:05.000000Z", "name": "`+strings.Repeat("z", 32)+"\U0010FFFF"+`",
+			"odd \"name\"": {"a": 7, "b c": {"d": "x"}}},
+		"nullCount": {"id": 0, "price": 0, "ratio": 0, "day": 1, "ts": 1, "tstz": 1, "name": 0,
+			"odd \"name\"": {"a": 1, "b c": {"d": 1}}, "flag": 1, "tags": 1}
+	}`, stats)
+}
@@ -5,8 +5,10 @@ import (
 	"context"
 	"crypto/md5"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
@@ -14,8 +16,10 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go-v2/aws"
+	awshttp "github.com/aws/aws-sdk-go-v2/aws/transport/http"
 	"github.com/aws/aws-sdk-go-v2/config"
 	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/s3/types"
 	"github.com/rs/zerolog/log"
 )
 
@@ -25,6 +29,20 @@ func bytesToETag(data []byte) string {
 	return hex.EncodeToString(sum[:])
 }
 
+// ErrPreconditionFailed is returned by conditional writes (WithIfMatch, WithIfNoneMatch)
+// when another writer changed the object first
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// IsNotExist reports whether err from Storage means the object does not exist
+func IsNotExist(err error) bool {
+	if os.IsNotExist(err) {
+		return true
+	}
+	var noSuchKey *types.NoSuchKey
+	var notFound *types.NotFound
+	return errors.As(err, &noSuchKey) || errors.As(err, &notFound)
+}
+
 // StorageConfig interface defines root directory access
 type StorageConfig interface {
 	RootDir() string
@@ -79,7 +97,8 @@ func (c *S3Config) LoadAWSConfig() (aws.Config, error) {
 type WriteOption func(*writeConfig)
 
 type writeConfig struct {
-	etag string
+	etag        string
+	ifNoneMatch bool
 }
 
 func WithIfMatch(etag string) WriteOption {
@@ -88,6 +107,13 @@ func WithIfMatch(etag string) WriteOption {
 	}
 }
 
+// WithIfNoneMatch makes the write fail if the object already exists
+func WithIfNoneMatch() WriteOption {
+	return func(c *writeConfig) {
+		c.ifNoneMatch = true
+	}
+}
+
 // Storage interface replaces OpenDAL operations
 type Storage interface {
 	Read(path string) ([]byte, *s3FileInfo, error)
@@ -256,6 +282,7 @@ func (s *S3Storage) Write(path string, data []byte, opts ...WriteOption) error {
 			Int("size", len(data)).
 			Str("return-etag", etagClean).
 			Str("ifMatch-etag", cfg.etag).
+			Bool("ifNoneMatch", cfg.ifNoneMatch).
 			Msgf("Writing object to S3")
 	}()
 
@@ -271,9 +298,18 @@ func (s *S3Storage) Write(path string, data []byte, opts ...WriteOption) error {
 			Str("ifMatch-etag", cfg.etag).
 			Msg("Conditional write (IfMatch)")
 	}
+	if cfg.ifNoneMatch {
+		putInput.IfNoneMatch = aws.String("*")
+	}
 	resp, err := s.client.PutObject(context.Background(), putInput)
 	if err != nil {
 		log.Error().Msgf("Error writing object: %v", err)
+		// 412 when condition did not hold, 409 when a concurrent conditional write won
+		var respErr *awshttp.ResponseError
+		if errors.As(err, &respErr) &&
+			(respErr.HTTPStatusCode() == http.StatusPreconditionFailed || respErr.HTTPStatusCode() == http.StatusConflict) {
+			return fmt.Errorf("%w: %v", ErrPreconditionFailed, err)
+		}
 		return err
 	}
 
@@ -508,7 +544,7 @@ func (fs *FSStorage) Write(path string, data []byte, opts ...WriteOption) error
 			return fmt.Errorf("failed to check etag, %s does not exist: %w", path, err)
 		}
 		if fi.ETag() != cfg.etag {
-			return fmt.Errorf("IfMatch: ETag mismatch (current: %s)", fi.ETag())
+			return fmt.Errorf("IfMatch: ETag mismatch (current: %s): %w", fi.ETag(), ErrPreconditionFailed)
 		}
 		log.Debug().
 			Str("expected_etag", fi.ETag()).
@@ -516,6 +552,10 @@ func (fs *FSStorage) Write(path string, data []byte, opts ...WriteOption) error
 			Msg("FS.Write: ETag as expected")
 	}
 
+	if cfg.ifNoneMatch {
+		return fs.writeNew(fullPath, data)
+	}
+
 	err := os.WriteFile(fullPath, data, 0644)
 	if err != nil && os.IsNotExist(err) {
 		// Only check/create directory if initial write failed
@@ -528,6 +568,38 @@ func (fs *FSStorage) Write(path string, data []byte, opts ...WriteOption) error
 	return err
 }
 
+// writeNew creates fullPath exclusively, failing if it already exists. data is written to a hidden
+// temp file first and linked into place, so readers never see fullPath partly written.
+func (fs *FSStorage) writeNew(fullPath string, data []byte) error {
+	dir := filepath.Dir(fullPath)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("failed to create directory %s: %w", dir, err)
+	}
+	f, err := os.CreateTemp(dir, "."+filepath.Base(fullPath)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(f.Name(), 0644); err != nil {
+		return err
+	}
+	// unlike rename, link fails when fullPath exists
+	if err := os.Link(f.Name(), fullPath); err != nil {
+		if os.IsExist(err) {
+			return fmt.Errorf("IfNoneMatch: %s already exists: %w", fullPath, ErrPreconditionFailed)
+		}
+		return err
+	}
+	return nil
+}
+
 func (fs *FSStorage) CreateDir(path string) error {
 	absPath := fs.fullPath(path)
 	log.Debug().
@@ -0,0 +1,27 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFSStorageWriteNew(t *testing.T) {
+	root := t.TempDir()
+	storage := NewFSStorage(&FSConfig{rootDir: root})
+
+	require.NoError(t, storage.Write("t/_delta_log/00000000000000000000.json", []byte("first"), WithIfNoneMatch()))
+	err := storage.Write("t/_delta_log/00000000000000000000.json", []byte("second"), WithIfNoneMatch())
+	assert.True(t, errors.Is(err, ErrPreconditionFailed), "existing commit should not be replaced: %v", err)
+
+	data, _, err := storage.Read("t/_delta_log/00000000000000000000.json")
+	require.NoError(t, err)
+	assert.Equal(t, "first", string(data))
+	entries, err := os.ReadDir(filepath.Join(root, "t/_delta_log"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 1, "temp files should be removed")
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"encoding/json"
 	"os"
 	"path/filepath"
 	"strconv"
@@ -23,6 +24,9 @@ const assertCommandPrefix = "-- ASSERT"
 //
 // Currently supported commands:
 //   - COUNT_PARQUET: Checks the number of parquet files for a table
+//   - COUNT_COMMITS: Checks the number of commit files in the table's _delta_log
+//   - QUERY_ROWS: Runs a query and checks the number of rows it returns
+//   - FILES_PRUNED: Runs a query and checks the number of parquet files it skipped
 //
 // Example:
 //
@@ -48,6 +52,12 @@ func handleAssertActionInComment(t *testing.T, ib *DuckpondDB, comment string) {
 	switch directiveParts[0] {
 	case "COUNT_PARQUET":
 		assertCountParquet(t, ib, directiveParts[1], expected)
+	case "COUNT_COMMITS":
+		assertCountCommits(t, ib, directiveParts[1], expected)
+	case "QUERY_ROWS":
+		assertQueryRows(t, ib, directiveParts[1], expected)
+	case "FILES_PRUNED":
+		assertFilesPruned(t, ib, directiveParts[1], expected)
 	default:
 		t.Fatalf("Unknown assert directive: %s", directiveParts[0])
 	}
@@ -71,6 +81,50 @@ func assertCountParquet(t *testing.T, ib *DuckpondDB, args string, expected stri
 	assert.Equal(t, expectedCount, len(files), "File count mismatch for %s", tableName)
 }
 
+// assertCountCommits checks that a table's _delta_log has the expected number of commits.
+func assertCountCommits(t *testing.T, ib *DuckpondDB, tableName string, expected string) {
+	expectedCount, err := strconv.Atoi(expected)
+	assert.NoError(t, err, "Invalid expected count format: %s", expected)
+
+	icelog, exists := ib.logs[tableName]
+	if !exists {
+		t.Fatalf("Table %s not found for COUNT_COMMITS assertion", tableName)
+	}
+
+	versions, err := icelog.listCommitVersions()
+	log.Debug().Msgf("assertCountCommits expected=%d versions=%v", expectedCount, versions)
+	assert.NoError(t, err, "Failed to list commits of %s", tableName)
+	assert.Equal(t, expectedCount, len(versions), "Commit count mismatch for %s", tableName)
+}
+
+// assertQueryRows checks that a query returns the expected number of rows.
+func assertQueryRows(t *testing.T, ib *DuckpondDB, query string, expected string) {
+	expectedCount, err := strconv.Atoi(expected)
+	assert.NoError(t, err, "Invalid expected count format: %s", expected)
+
+	jsonResponse, err := ib.PostEndpoint("/query", query)
+	if !assert.NoError(t, err, "Query failed: %s", query) {
+		return
+	}
+	var response QueryResponse
+	assert.NoError(t, json.Unmarshal([]byte(jsonResponse), &response))
+	assert.Equal(t, expectedCount, response.Rows, "Row count mismatch for %s", query)
+}
+
+// assertFilesPruned checks that a query skipped the expected number of parquet files.
+func assertFilesPruned(t *testing.T, ib *DuckpondDB, query string, expected string) {
+	expectedCount, err := strconv.Atoi(expected)
+	assert.NoError(t, err, "Invalid expected count format: %s", expected)
+
+	jsonResponse, err := ib.PostEndpoint("/query", query)
+	if !assert.NoError(t, err, "Query failed: %s", query) {
+		return
+	}
+	var response QueryResponse
+	assert.NoError(t, json.Unmarshal([]byte(jsonResponse), &response))
+	assert.Equal(t, expectedCount, response.Statistics.FilesPruned, "Files pruned mismatch for %s", query)
+}
+
 func TestStressTest(t *testing.T) {
 	testFiles, err := filepath.Glob("test/stress/query_*.sql")
 	assert.NoError(t, err, "Failed to find test files")
@@ -0,0 +1,26 @@
+CREATE TABLE altered (id INTEGER, name VARCHAR);
+INSERT INTO altered VALUES (1, 'one'), (2, 'two');
+-- adding a nullable column only changes metaData, older files read it as NULL
+ALTER TABLE altered ADD COLUMN note VARCHAR;
+-- ASSERT COUNT_PARQUET altered: 1
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE note IS NULL: 2
+INSERT INTO altered VALUES (3, 'three', 'new');
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE note = 'new': 1
+-- so does widening a type
+ALTER TABLE altered ALTER COLUMN id TYPE BIGINT;
+-- ASSERT COUNT_PARQUET altered: 2
+INSERT INTO altered VALUES (9000000000, 'big', NULL);
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE id > 1: 3
+DELETE FROM altered WHERE id = 3;
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE id >= 1: 3
+-- renames and drops only change metaData, files keep physical column names
+ALTER TABLE altered RENAME COLUMN name TO title;
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE title = 'two': 1
+ALTER TABLE altered DROP COLUMN note;
+-- ASSERT QUERY_ROWS SELECT * FROM altered: 3
+-- ASSERT QUERY_ROWS SELECT * FROM altered VERSION AS OF 1 WHERE name = 'two': 1
+-- a default applies to rows already there
+ALTER TABLE altered ADD COLUMN flag BOOLEAN DEFAULT true;
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE flag: 3
+INSERT INTO altered (id, title) VALUES (4, 'four');
+-- ASSERT QUERY_ROWS SELECT * FROM altered WHERE flag AND title = 'four': 1
@@ -0,0 +1,24 @@
+CREATE TABLE mapped (id INTEGER, name VARCHAR, note VARCHAR);
+INSERT INTO mapped VALUES (1, 'one', 'a'), (2, 'two', 'b');
+-- ASSERT COUNT_PARQUET mapped: 1
+-- renaming a column doesn't rewrite files, stats and reads follow the column's physical name
+ALTER TABLE mapped RENAME COLUMN name TO title;
+-- ASSERT COUNT_PARQUET mapped: 1
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE title = 'two': 1
+-- ASSERT FILES_PRUNED SELECT * FROM mapped WHERE title = 'zzz': 1
+-- neither does dropping one
+ALTER TABLE mapped DROP COLUMN note;
+-- ASSERT COUNT_PARQUET mapped: 1
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE title IS NOT NULL: 2
+-- a column added under a dropped column's name doesn't read its values
+ALTER TABLE mapped ADD COLUMN note VARCHAR;
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE note IS NULL: 2
+INSERT INTO mapped VALUES (3, 'three', 'c');
+-- ASSERT COUNT_PARQUET mapped: 2
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE note = 'c': 1
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE note = 'a': 0
+-- earlier versions read under their own names
+-- ASSERT QUERY_ROWS SELECT * FROM mapped VERSION AS OF 1 WHERE name = 'one' AND note = 'a': 1
+UPDATE mapped SET title = 'uno' WHERE id = 1;
+-- ASSERT QUERY_ROWS SELECT * FROM mapped WHERE title = 'uno': 1
+-- ASSERT QUERY_ROWS SELECT * FROM mapped: 3
@@ -0,0 +1,9 @@
+CREATE TABLE commits_test (
+    id INTEGER PRIMARY KEY,
+    text VARCHAR
+); -- protocol and metaData go into the first commit
+-- ASSERT COUNT_COMMITS commits_test: 1
+INSERT INTO commits_test (id, text) VALUES (1, 'one');
+INSERT INTO commits_test (id, text) VALUES (2, 'two'); -- every insert is its own commit, earlier ones are never rewritten
+-- ASSERT COUNT_COMMITS commits_test: 3
+-- ASSERT COUNT_PARQUET commits_test: 2
@@ -0,0 +1,49 @@
+CREATE TABLE deleted (
+    id INTEGER,
+    text VARCHAR
+);
+INSERT INTO deleted (id, text) VALUES (1, 'one'), (2, 'two');
+INSERT INTO deleted (id, text) VALUES (3, 'three'), (4, 'four'), (7, 'seven');
+INSERT INTO deleted (id, text) VALUES (5, 'five'), (6, 'six');
+DELETE FROM deleted WHERE id = 3;
+-- ASSERT QUERY_ROWS SELECT * FROM deleted: 6
+-- ASSERT QUERY_ROWS SELECT * FROM deleted WHERE id = 4: 1
+-- deletion vectors mark the row deleted instead of rewriting the file
+-- ASSERT COUNT_PARQUET deleted: 3
+-- adds to the deletion vector of the file with 3 and empties the one with 5 and 6
+DELETE FROM deleted WHERE id >= 5;
+-- ASSERT QUERY_ROWS SELECT * FROM deleted: 3
+-- ASSERT QUERY_ROWS SELECT * FROM deleted WHERE id = 4: 1
+-- ASSERT COUNT_PARQUET deleted: 3
+DELETE FROM deleted WHERE id = 4;
+-- ASSERT QUERY_ROWS SELECT * FROM deleted: 2
+-- ASSERT QUERY_ROWS SELECT * FROM deleted WHERE id = 3: 0
+DELETE FROM deleted WHERE text = 'nope';
+-- ASSERT COUNT_COMMITS deleted: 7
+-- ASSERT QUERY_ROWS SELECT * FROM deleted VERSION AS OF 3: 7
+-- ASSERT QUERY_ROWS SELECT * FROM deleted VERSION AS OF 4: 6
+UPDATE deleted SET text = 'ONE' WHERE id = 1;
+-- ASSERT QUERY_ROWS SELECT * FROM deleted: 2
+OPTIMIZE deleted;
+VACUUM deleted;
+-- ASSERT QUERY_ROWS SELECT * FROM deleted: 2
+-- ASSERT QUERY_ROWS SELECT * FROM deleted WHERE text = 'ONE': 1
+CREATE TABLE rounded (
+    id INTEGER
+);
+INSERT INTO rounded (id) VALUES (1);
+INSERT INTO rounded (id) VALUES (2);
+-- the constant isn't rounded to the column's type for stats, 1.5 would be 2 and rule out the file with 2
+DELETE FROM rounded WHERE id > 1.5;
+-- ASSERT QUERY_ROWS SELECT * FROM rounded: 1
+-- ASSERT QUERY_ROWS SELECT * FROM rounded WHERE id = 2: 0
+CREATE TABLE scoped (
+    id INTEGER
+);
+INSERT INTO scoped (id) VALUES (1), (2);
+INSERT INTO scoped (id) VALUES (3), (4);
+INSERT INTO scoped (id) VALUES (5), (6);
+-- the subquery sees rows of all files, not only those of the file being rewritten
+DELETE FROM scoped WHERE id < (SELECT max(id) FROM scoped);
+-- ASSERT QUERY_ROWS SELECT * FROM scoped: 1
+-- ASSERT QUERY_ROWS SELECT * FROM scoped WHERE id = 6: 1
@@ -7,7 +7,7 @@ CREATE TABLE stress_test (
 INSERT INTO stress_test (id, text, usage) VALUES ('01947471-2ded-7812-cafe-34567000b33f'::UUID, 'one', 1);
 INSERT INTO stress_test (id, text, usage) VALUES ('01947471-2ded-7812-cafe-34567000b33e'::UUID, 'more', 1);
 -- ASSERT COUNT_PARQUET stress_test: 2
-VACUUM stress_test; -- this will merge the parquet files, but leave the previous two and mark em tombstoned
+OPTIMIZE stress_test; -- this will merge the parquet files, but leave the previous two and mark em tombstoned
 -- ASSERT COUNT_PARQUET stress_test: 3
 select id, text from stress_test;
 VACUUM stress_test; -- this will delete the 2 tombstoned files
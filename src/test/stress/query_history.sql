@@ -0,0 +1,9 @@
+CREATE TABLE history (
+    id INTEGER,
+    text VARCHAR
+);
+INSERT INTO history (id, text) VALUES (1, 'one'), (2, 'two');
+INSERT INTO history (id, text) VALUES (3, 'three');
+OPTIMIZE history;
+-- ASSERT COUNT_COMMITS history: 4
+-- ASSERT QUERY_ROWS DESCRIBE HISTORY history: 4
@@ -0,0 +1,26 @@
+CREATE TABLE partitioned (
+    tenant INTEGER,
+    ts TIMESTAMP,
+    text VARCHAR
+) PARTITION BY (tenant, strftime(ts, '%Y-%m') AS month);
+INSERT INTO partitioned VALUES (1, '2024-01-05', 'a'), (1, '2024-02-05', 'b'), (2, '2024-01-07', 'c');
+-- a file per partition
+-- ASSERT COUNT_PARQUET partitioned: 3
+INSERT INTO partitioned VALUES (2, '2024-01-09', 'd'), (NULL, '2024-01-09', 'e');
+-- ASSERT COUNT_PARQUET partitioned: 5
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned: 5
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant = 2: 2
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant = 2 AND ts = '2024-01-09': 1
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned p WHERE p.tenant = 1 ORDER BY ts: 2
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant IS NULL: 1
+-- an update moving rows to another partition
+UPDATE partitioned SET tenant = 3 WHERE tenant = 1 AND text = 'a';
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant = 3: 1
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant = 1: 1
+DELETE FROM partitioned WHERE tenant = 2;
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned: 3
+OPTIMIZE partitioned;
+VACUUM partitioned;
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned: 3
+-- ASSERT QUERY_ROWS SELECT * FROM partitioned WHERE tenant = 3: 1
+-- ASSERT FILES_PRUNED SELECT * FROM partitioned WHERE tenant = 3: 2
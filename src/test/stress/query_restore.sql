@@ -0,0 +1,16 @@
+CREATE TABLE restored (
+    id INTEGER,
+    text VARCHAR
+);
+INSERT INTO restored (id, text) VALUES (1, 'one');
+INSERT INTO restored (id, text) VALUES (2, 'bad batch'), (3, 'bad batch');
+RESTORE TABLE restored TO VERSION AS OF 1;
+-- ASSERT COUNT_COMMITS restored: 4
+-- ASSERT QUERY_ROWS SELECT * FROM restored: 1
+-- ASSERT QUERY_ROWS SELECT * FROM restored VERSION AS OF 2: 3
+RESTORE TABLE restored TO VERSION AS OF 2;
+-- ASSERT QUERY_ROWS SELECT * FROM restored: 3
+OPTIMIZE restored;
+VACUUM restored;
+-- ASSERT QUERY_ROWS SELECT * FROM restored: 3
+-- ASSERT QUERY_ROWS DESCRIBE HISTORY restored: 6
@@ -0,0 +1,47 @@
+CREATE TABLE skipped (
+    id INTEGER,
+    ts TIMESTAMP,
+    text VARCHAR
+);
+INSERT INTO skipped VALUES (1, '2024-01-01', 'one'), (2, '2024-01-02', 'two');
+INSERT INTO skipped VALUES (3, '2024-02-01', 'three'), (4, '2024-02-02', 'four');
+INSERT INTO skipped VALUES (5, '2024-03-01', 'five'), (6, '2024-03-02', 'six');
+-- ASSERT FILES_PRUNED SELECT * FROM skipped: 0
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 3: 2
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 3: 1
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id > 4 ORDER BY id: 2
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE ts BETWEEN '2024-01-15' AND '2024-02-15': 2
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE ts BETWEEN '2024-01-15' AND '2024-02-15': 2
+-- ASSERT FILES_PRUNED SELECT * FROM skipped s WHERE s.text = 'two' AND s.id <= 2: 2
+-- unsure about OR, every file is read
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 1 OR id = 5: 0
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 1 OR id = 5: 2
+-- all files pruned still gives the table's columns
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 100: 3
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 100: 0
+-- ASSERT FILES_PRUNED SELECT * FROM skipped VERSION AS OF 2 WHERE id = 1: 1
+-- constants aren't rounded to the column's type, 1.5 as INTEGER would be 2 and rule out the file with 2
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id > 1.5: 0
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id > 1.5: 5
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id < 2.5: 2
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id < 2.5: 2
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 2.5: 3
+DELETE FROM skipped WHERE id = 3;
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 4: 1
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 4: 2
+CREATE TABLE skipped_types (
+    name VARCHAR,
+    at TIMESTAMPTZ
+);
+INSERT INTO skipped_types VALUES ('aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa1', '2024-01-01 00:00:00+00');
+INSERT INTO skipped_types VALUES ('aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa2', '2024-06-01 00:00:00+00');
+INSERT INTO skipped_types VALUES ('b', '2024-12-01 00:00:00+00');
+-- strings longer than the stats keep can only rule out values outside their prefix
+-- ASSERT FILES_PRUNED SELECT * FROM skipped_types WHERE name = 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa2': 1
+-- ASSERT QUERY_ROWS SELECT * FROM skipped_types WHERE name = 'aaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaaa2': 1
+-- ASSERT FILES_PRUNED SELECT * FROM skipped_types WHERE at > '2024-05-01': 1
+-- ASSERT QUERY_ROWS SELECT * FROM skipped_types WHERE at > '2024-05-01': 2
+-- the table read again in a subquery sees every file, so none are pruned
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 4 AND (SELECT count(*) FROM skipped) = 5: 1
+-- ASSERT FILES_PRUNED SELECT * FROM skipped WHERE id = 4 AND (SELECT count(*) FROM skipped) = 5: 0
+-- ASSERT QUERY_ROWS SELECT * FROM skipped WHERE id = 4 AND EXISTS (SELECT 1 FROM skipped x WHERE x.id = 6): 1
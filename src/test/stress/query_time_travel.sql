@@ -0,0 +1,11 @@
+CREATE TABLE time_travel (
+    id INTEGER PRIMARY KEY,
+    text VARCHAR
+);
+INSERT INTO time_travel (id, text) VALUES (1, 'one');
+INSERT INTO time_travel (id, text) VALUES (2, 'two');
+-- ASSERT COUNT_COMMITS time_travel: 3
+-- ASSERT QUERY_ROWS SELECT * FROM time_travel: 2
+-- ASSERT QUERY_ROWS SELECT * FROM time_travel VERSION AS OF 1: 1
+-- ASSERT QUERY_ROWS SELECT * FROM time_travel@v2 WHERE id = 1: 1
+-- ASSERT QUERY_ROWS SELECT * FROM time_travel VERSION AS OF 0: 0
@@ -0,0 +1,44 @@
+CREATE TABLE updated (
+    id INTEGER,
+    text VARCHAR
+);
+INSERT INTO updated (id, text) VALUES (1, 'one'), (2, 'two');
+INSERT INTO updated (id, text) VALUES (3, 'three'), (4, 'four');
+UPDATE updated SET text = 'THREE' WHERE id = 3;
+-- ASSERT QUERY_ROWS SELECT * FROM updated: 4
+-- ASSERT QUERY_ROWS SELECT * FROM updated WHERE text = 'THREE': 1
+-- ASSERT QUERY_ROWS SELECT * FROM updated WHERE text = 'three': 0
+-- ASSERT COUNT_PARQUET updated: 3
+UPDATE updated SET id = id + 10;
+-- ASSERT QUERY_ROWS SELECT * FROM updated WHERE id > 10: 4
+-- ASSERT COUNT_PARQUET updated: 5
+UPDATE updated SET text = 'none' WHERE id = 1;
+-- ASSERT COUNT_COMMITS updated: 5
+-- ASSERT QUERY_ROWS SELECT * FROM updated VERSION AS OF 3: 4
+-- ASSERT QUERY_ROWS SELECT * FROM updated VERSION AS OF 3 WHERE text = 'three': 0
+CREATE TABLE counted (
+    id INTEGER
+);
+INSERT INTO counted (id) VALUES (1), (2);
+INSERT INTO counted (id) VALUES (3), (4);
+INSERT INTO counted (id) VALUES (5), (6);
+-- the subquery sees rows of all files, not only those of the file being rewritten
+UPDATE counted SET id = (SELECT count(*) FROM counted);
+-- ASSERT QUERY_ROWS SELECT * FROM counted WHERE id = 6: 6
+-- ASSERT COUNT_PARQUET counted: 6
+-- the subquery sees the files the WHERE rules out too
+UPDATE counted SET id = (SELECT count(*) FROM counted) + 1 WHERE id > 2;
+-- ASSERT QUERY_ROWS SELECT * FROM counted WHERE id = 7: 6
+CREATE TABLE keyed (
+    id INTEGER PRIMARY KEY,
+    text VARCHAR
+);
+INSERT INTO keyed (id, text) VALUES (1, 'one'), (2, 'two');
+INSERT INTO keyed (id, text) VALUES (3, 'three');
+-- rows with an updated key get new rowids, they are written to a file of their own
+-- and the first file is rewritten with the row left, the second one had nothing else
+UPDATE keyed SET id = id + 10 WHERE id >= 2;
+-- ASSERT QUERY_ROWS SELECT * FROM keyed: 3
+-- ASSERT QUERY_ROWS SELECT * FROM keyed WHERE id > 10: 2
+-- ASSERT QUERY_ROWS SELECT * FROM keyed WHERE id = 1 AND text = 'one': 1
+-- ASSERT COUNT_PARQUET keyed: 4
@@ -0,0 +1,64 @@
+CREATE TABLE upserted (
+    id INTEGER PRIMARY KEY,
+    text VARCHAR
+);
+INSERT INTO upserted (id, text) VALUES (1, 'one'), (2, 'two');
+INSERT INTO upserted (id, text) VALUES (10, 'ten'), (11, 'eleven');
+-- only the file with id 2 is rewritten, stats rule out the other one
+INSERT OR REPLACE INTO upserted (id, text) VALUES (2, 'TWO'), (3, 'three');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted: 5
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'TWO': 1
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'two': 0
+-- ASSERT COUNT_PARQUET upserted: 3
+INSERT OR IGNORE INTO upserted (id, text) VALUES (3, 'THREE'), (4, 'four');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted: 6
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'three': 1
+INSERT INTO upserted (id, text) VALUES (4, 'FOUR') ON CONFLICT DO NOTHING;
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'four': 1
+-- ASSERT COUNT_COMMITS upserted: 5
+MERGE INTO upserted t
+USING (VALUES (10, 'TEN'), (12, 'twelve')) AS s(id, text)
+ON t.id = s.id
+WHEN MATCHED THEN UPDATE SET *
+WHEN NOT MATCHED THEN INSERT *;
+-- ASSERT QUERY_ROWS SELECT * FROM upserted: 7
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'TEN': 1
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'ten': 0
+MERGE INTO upserted USING (SELECT 12 AS id, 'TWELVE' AS text) s ON upserted.id = s.id WHEN NOT MATCHED THEN INSERT;
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'twelve': 1
+DELETE FROM upserted WHERE id = 1;
+INSERT OR REPLACE INTO upserted (id, text) VALUES (1, 'ONE'), (3, 'THREE');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted: 7
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE text = 'THREE': 1
+-- ASSERT QUERY_ROWS SELECT * FROM upserted WHERE id = 1: 1
+-- ASSERT QUERY_ROWS SELECT * FROM upserted VERSION AS OF 2: 4
+CREATE TABLE upserted_fractions (
+    id DECIMAL(4, 1) PRIMARY KEY,
+    score DOUBLE,
+    text VARCHAR
+);
+INSERT INTO upserted_fractions (id, score, text) VALUES (1.4, 0.25, 'a');
+INSERT INTO upserted_fractions (id, score, text) VALUES (1.6, 0.75, 'b');
+-- key ranges compared with stats aren't rounded, the file with 1.6 has the conflicting row
+INSERT OR REPLACE INTO upserted_fractions (id, score, text) VALUES (1.6, 0.5, 'B');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions: 2
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions WHERE text = 'B': 1
+INSERT OR IGNORE INTO upserted_fractions (id, score, text) VALUES (1.4, 0.5, 'A'), (1.5, 0.5, 'c');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions: 3
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions WHERE text = 'A': 0
+MERGE INTO upserted_fractions t
+USING (VALUES (1.5, 0.125, 'C')) AS s(id, score, text)
+ON t.id = s.id
+WHEN MATCHED THEN UPDATE SET *
+WHEN NOT MATCHED THEN INSERT *;
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions: 3
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_fractions WHERE text = 'C' AND score = 0.125: 1
+CREATE TABLE upserted_scores (
+    score DOUBLE PRIMARY KEY,
+    text VARCHAR
+);
+INSERT INTO upserted_scores (score, text) VALUES (0.1, 'a');
+INSERT INTO upserted_scores (score, text) VALUES (0.30000000000000004, 'b');
+INSERT OR REPLACE INTO upserted_scores (score, text) VALUES (0.1::DOUBLE + 0.2::DOUBLE, 'B');
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_scores: 2
+-- ASSERT QUERY_ROWS SELECT * FROM upserted_scores WHERE text = 'B': 1
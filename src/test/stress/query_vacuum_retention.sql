@@ -0,0 +1,20 @@
+CREATE TABLE retained (
+    id INTEGER,
+    text VARCHAR
+);
+INSERT INTO retained (id, text) VALUES (1, 'one');
+INSERT INTO retained (id, text) VALUES (2, 'two');
+UPDATE retained SET text = 'uno' WHERE id = 1;
+-- ASSERT COUNT_PARQUET retained: 3
+-- ASSERT QUERY_ROWS VACUUM retained DRY RUN: 1
+-- ASSERT QUERY_ROWS VACUUM retained RETAIN 1 HOURS DRY RUN: 0
+-- readers of versions from the last week may still use removed files
+ALTER TABLE retained SET TBLPROPERTIES ('delta.deletedFileRetentionDuration' = 'interval 7 days');
+-- ASSERT QUERY_ROWS VACUUM retained DRY RUN: 0
+-- ASSERT QUERY_ROWS VACUUM retained RETAIN 168 HOURS DRY RUN: 0
+OPTIMIZE retained;
+VACUUM retained;
+-- merged, but removed files are kept
+-- ASSERT COUNT_PARQUET retained: 4
+-- ASSERT QUERY_ROWS SELECT * FROM retained: 2
+-- ASSERT QUERY_ROWS DESCRIBE HISTORY retained: 6
@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/rs/zerolog/log"
+)
+
+// pendingCommit is what BEGIN ... COMMIT wrote to a table so far, committed at once by COMMIT
+type pendingCommit struct {
+	readVersion int64
+	operations  []string
+}
+
+// begin makes writes to the table stage their actions until commitPending or abortPending
+func (l *Log) begin() error {
+	if err := l.importPersistedLog(); err != nil {
+		return err
+	}
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return fmt.Errorf("failed to get database: %w", err)
+	}
+	readVersion, err := l.currentVersion(db)
+	if err != nil {
+		return err
+	}
+	l.pending = &pendingCommit{readVersion: readVersion}
+	return nil
+}
+
+// checkPending fails when the staged writes conflict with commits made since begin,
+// tables that were only read can't conflict
+func (l *Log) checkPending() error {
+	if err := l.importPersistedLog(); err != nil {
+		return err
+	}
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return fmt.Errorf("failed to get database: %w", err)
+	}
+	var staged int
+	if err := db.QueryRow("SELECT count(*) FROM log_json WHERE version IS NULL").Scan(&staged); err != nil {
+		return fmt.Errorf("failed to count staged actions: %w", err)
+	}
+	if staged == 0 {
+		return nil
+	}
+	keyed, err := l.hasPrimaryKey(db)
+	if err != nil {
+		return err
+	}
+	var reason string
+	err = db.QueryRow(query_commit_conflicts, l.pending.readVersion, keyed).Scan(&reason)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("failed to check for commit conflicts: %w", err)
+	}
+	return fmt.Errorf("%w: %s", ErrCommitConflict, reason)
+}
+
+// commitPending commits the writes staged since begin as one commit and returns its version,
+// -1 when nothing was written
+func (l *Log) commitPending() (int64, error) {
+	pending := l.pending
+	l.pending = nil
+	db, err := l.getLogDBAfterImport()
+	if err != nil {
+		return -1, fmt.Errorf("failed to get database: %w", err)
+	}
+	var staged int
+	if err := db.QueryRow("SELECT count(*) FROM log_json WHERE version IS NULL").Scan(&staged); err != nil {
+		return -1, fmt.Errorf("failed to count staged actions: %w", err)
+	}
+	if staged == 0 {
+		return -1, nil
+	}
+
+	operationsJSON, err := json.Marshal(pending.operations)
+	if err != nil {
+		l.abandonStaged()
+		return -1, err
+	}
+	operation := commitOperation{Name: "TRANSACTION", Parameters: map[string]string{"operations": string(operationsJSON)}}
+	var collapsed []string
+	for _, stage := range []func() error{
+		func() error { return l.checkProtocol(db, true) },
+		func() (err error) {
+			collapsed, err = l.collapseStaged(db)
+			return err
+		},
+		func() error { return l.checkAppendOnly(db) },
+		func() error { return l.stageCommitInfo(db, operation, pending.readVersion) },
+	} {
+		if err := stage(); err != nil {
+			l.abandonStaged()
+			return -1, err
+		}
+	}
+	if err := l.exportStaged(db, pending.readVersion); err != nil {
+		return -1, err
+	}
+	for _, file := range collapsed {
+		if err := l.storage.Delete(filepath.Join(l.tableName, file)); err != nil {
+			log.Warn().Err(err).Msgf("failed to delete %s removed within the transaction, VACUUM will", file)
+		}
+	}
+	return l.currentVersion(db)
+}
+
+// abortPending discards the writes staged since begin and deletes the files they wrote
+func (l *Log) abortPending() {
+	l.pending = nil
+	l.abandonStaged()
+}
+
+// collapseStaged drops staged adds of files that are removed again by later statements,
+// together with their removes, readers never get to see those files. It returns the data files
+// and deletion vectors of the dropped adds no other action refers to, written within the
+// transaction, to be deleted once the rest is committed.
+func (l *Log) collapseStaged(db *sql.DB) ([]string, error) {
+	const collapsed = `
+		SELECT a.rowid AS added, r.rowid AS removed, a."add".path AS path, a."add".deletionVector AS dv
+		FROM log_json a JOIN log_json r
+			ON r.remove.path = a."add".path AND r.remove.deletionVector IS NOT DISTINCT FROM a."add".deletionVector
+		WHERE a.version IS NULL AND r.version IS NULL`
+	files, err := l.queryFiles("SELECT DISTINCT path FROM (" + collapsed + ")")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list files removed within the transaction: %w", err)
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	dvs, err := l.queryFiles("SELECT DISTINCT dv::JSON FROM (" + collapsed + ") WHERE dv.storageType = 'u'")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list deletion vectors removed within the transaction: %w", err)
+	}
+	_, err = db.Exec(fmt.Sprintf(`
+		DELETE FROM log_json
+		WHERE rowid IN (SELECT added FROM (%[1]s) UNION ALL SELECT removed FROM (%[1]s))`, collapsed))
+	if err != nil {
+		return nil, fmt.Errorf("failed to drop files removed within the transaction: %w", err)
+	}
+
+	// committed files, or ones staged adds still use with another deletion vector, stay
+	var unused []string
+	for _, file := range files {
+		var used bool
+		if err := db.QueryRow(`SELECT count(*) > 0 FROM log_json WHERE $1 IN ("add".path, remove.path)`, file).Scan(&used); err != nil {
+			return nil, err
+		}
+		if !used {
+			unused = append(unused, file)
+		}
+	}
+	for _, dv := range dvs {
+		var used bool
+		err := db.QueryRow(`
+			SELECT count(*) > 0 FROM log_json
+			WHERE $1 IN ("add".deletionVector::JSON::VARCHAR, remove.deletionVector::JSON::VARCHAR)`, dv).Scan(&used)
+		if err != nil {
+			return nil, err
+		}
+		if used {
+			continue
+		}
+		paths, err := deletionVectorPaths([]string{dv})
+		if err != nil {
+			return nil, err
+		}
+		unused = append(unused, paths...)
+	}
+	return unused, nil
+}
+
+//go:embed revert.sql
+var query_revert string
+
+// revertCommit commits actions undoing commit version, for the files no commit since changed
+func (l *Log) revertCommit(version int64) error {
+	operation := commitOperation{Name: "REVERT", Parameters: map[string]string{"version": strconv.FormatInt(version, 10)}}
+	return l.withPersistedLog(operation, func() error {
+		logDB, err := l.getLogDBAfterImport()
+		if err != nil {
+			return fmt.Errorf("failed to get database: %w", err)
+		}
+		if _, err := logDB.Exec(query_revert, version, int64(latestVersion)); err != nil {
+			return fmt.Errorf("failed to stage revert of version %d: %w", version, err)
+		}
+		return nil
+	})
+}
+
+// commitTransaction commits the writes of BEGIN ... COMMIT, a commit per table in the order tables
+// were first used. Delta Lake has no commits spanning tables: all of them are checked for conflicts
+// first, and when committing one still fails, commits of tables before it are reverted and the
+// writes of the rest discarded.
+func (ib *DuckpondDB) commitTransaction(logs []*Log) error {
+	for _, l := range logs {
+		if err := l.checkPending(); err != nil {
+			ib.abortTransaction(logs)
+			return fmt.Errorf("COMMIT failed for %s: %w", l.tableName, err)
+		}
+	}
+	versions := make([]int64, len(logs))
+	for i, l := range logs {
+		version, err := l.commitPending()
+		if err == nil {
+			versions[i] = version
+			continue
+		}
+		ib.abortTransaction(logs[i+1:])
+		var reverted, failed []string
+		for j := i - 1; j >= 0; j-- {
+			if versions[j] < 0 {
+				continue
+			}
+			if err := logs[j].revertCommit(versions[j]); err != nil {
+				log.Error().Err(err).Msgf("failed to revert version %d of %s", versions[j], logs[j].tableName)
+				failed = append(failed, fmt.Sprintf("%s version %d", logs[j].tableName, versions[j]))
+				continue
+			}
+			reverted = append(reverted, logs[j].tableName)
+		}
+		if len(failed) > 0 {
+			return fmt.Errorf("COMMIT failed for %s and reverting %s failed, they stay committed: %w",
+				l.tableName, strings.Join(failed, ", "), err)
+		}
+		if len(reverted) > 0 {
+			slices.Reverse(reverted)
+			return fmt.Errorf("COMMIT failed for %s, commits of %s were reverted: %w", l.tableName, strings.Join(reverted, ", "), err)
+		}
+		return fmt.Errorf("COMMIT failed for %s: %w", l.tableName, err)
+	}
+	return nil
+}
+
+// abortTransaction discards the writes of BEGIN ... COMMIT to logs
+func (ib *DuckpondDB) abortTransaction(logs []*Log) {
+	for _, l := range logs {
+		if l.pending != nil {
+			l.abortPending()
+		}
+	}
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTransaction(t *testing.T) {
+	ib := newTestDB(t, WithQuerySplittingEnabled())
+
+	for _, query := range []string{
+		"CREATE TABLE orders (id INTEGER PRIMARY KEY)",
+		"CREATE TABLE items (order_id INTEGER, sku VARCHAR NOT NULL)",
+	} {
+		_, err := ib.PostEndpoint("/query", query)
+		require.NoError(t, err, query)
+	}
+	versions := func() [2]int64 {
+		var versions [2]int64
+		for i, table := range []string{"orders", "items"} {
+			l := ib.logs[table]
+			require.NoError(t, l.importPersistedLog())
+			version, err := l.currentVersion(l.logDB)
+			require.NoError(t, err)
+			versions[i] = version
+		}
+		return versions
+	}
+	lastOperation := func(table string) string {
+		var operation string
+		require.NoError(t, ib.logs[table].logDB.QueryRow(`
+			SELECT commitInfo->>'operation' FROM log_json
+			WHERE commitInfo IS NOT NULL ORDER BY version DESC LIMIT 1`).Scan(&operation))
+		return operation
+	}
+	before := versions()
+
+	// writes land together, one commit per table
+	_, err := ib.PostEndpoint("/query", `
+		BEGIN;
+		INSERT INTO orders VALUES (1);
+		INSERT INTO items VALUES (1, 'a'), (1, 'b');
+		INSERT INTO items VALUES (1, 'c');
+		COMMIT`)
+	require.NoError(t, err)
+	assert.Equal(t, [2]int64{before[0] + 1, before[1] + 1}, versions())
+	assert.Equal(t, "a,b,c", queryIDs(t, ib, "SELECT sku FROM items ORDER BY sku"))
+	assert.Equal(t, "TRANSACTION", lastOperation("items"))
+	before = versions()
+
+	// nothing is committed when a statement fails, the transaction is rolled back or isn't committed
+	for _, body := range []string{
+		"BEGIN; INSERT INTO orders VALUES (2); INSERT INTO items VALUES (2, NULL); COMMIT",
+		"BEGIN; INSERT INTO orders VALUES (2); INSERT INTO items VALUES (2, 'a'); ROLLBACK; SELECT 1",
+		"BEGIN; INSERT INTO orders VALUES (2); INSERT INTO items VALUES (2, 'a')",
+		"BEGIN; INSERT INTO orders VALUES (2); ALTER TABLE items ADD COLUMN qty INTEGER; COMMIT",
+	} {
+		_, _ = ib.PostEndpoint("/query", body)
+		assert.Equal(t, before, versions(), body)
+	}
+	assert.Equal(t, "1", queryIDs(t, ib, "SELECT id FROM orders"))
+	_, err = ib.PostEndpoint("/query", "COMMIT")
+	assert.Error(t, err, "COMMIT without BEGIN should fail")
+
+	// statements see writes of earlier ones, files written and deleted again aren't committed
+	_, err = ib.PostEndpoint("/query", `
+		BEGIN;
+		INSERT INTO items VALUES (3, 'x'), (3, 'y');
+		DELETE FROM items WHERE sku = 'x';
+		UPDATE items SET sku = 'z' WHERE sku = 'y';
+		COMMIT`)
+	require.NoError(t, err)
+	assert.Equal(t, "a,b,c,z", queryIDs(t, ib, "SELECT sku FROM items ORDER BY sku"))
+	var adds, removes int
+	require.NoError(t, ib.logs["items"].logDB.QueryRow(`
+		SELECT count("add"), count(remove) FROM log_json
+		WHERE version = (SELECT max(version) FROM log_json)`).Scan(&adds, &removes))
+	assert.Equal(t, 1, adds, "only the file of the updated row should be added")
+	assert.Equal(t, 0, removes)
+
+	// rows deleted from a file written within the transaction are marked by a deletion vector of it
+	_, err = ib.PostEndpoint("/query", `
+		ALTER TABLE items SET TBLPROPERTIES ('delta.enableDeletionVectors' = 'true');
+		BEGIN;
+		INSERT INTO items VALUES (5, 'p'), (5, 'q');
+		DELETE FROM items WHERE sku = 'p';
+		COMMIT`)
+	require.NoError(t, err)
+	assert.Equal(t, "a,b,c,q,z", queryIDs(t, ib, "SELECT sku FROM items ORDER BY sku"))
+	var deletionVectors int
+	require.NoError(t, ib.logs["items"].logDB.QueryRow(`
+		SELECT count("add".deletionVector) FROM log_json
+		WHERE version = (SELECT max(version) FROM log_json)`).Scan(&deletionVectors))
+	assert.Equal(t, 1, deletionVectors)
+
+	// deleting twice from a committed file within a transaction keeps the file for older versions,
+	// the deletion vector of the first DELETE is never committed and is deleted
+	items := ib.logs["items"]
+	committed := versions()[1]
+	_, err = ib.PostEndpoint("/query", "BEGIN; DELETE FROM items WHERE sku = 'a'; DELETE FROM items WHERE sku = 'b'; COMMIT")
+	require.NoError(t, err)
+	assert.Equal(t, "c,q,z", queryIDs(t, ib, "SELECT sku FROM items ORDER BY sku"))
+	assert.Equal(t, "a,b,c,q,z", queryIDs(t, ib, fmt.Sprintf("SELECT sku FROM items VERSION AS OF %d ORDER BY sku", committed)))
+	items.orphan_grace_seconds = 0
+	orphans, err := items.listOrphanedFiles()
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+
+	// when committing a table fails, tables committed before it are reverted
+	_, err = ib.PostEndpoint("/query", "ALTER TABLE items SET TBLPROPERTIES ('delta.appendOnly' = 'true')")
+	require.NoError(t, err)
+	before = versions()
+	_, err = ib.PostEndpoint("/query", "BEGIN; INSERT INTO orders VALUES (4); DELETE FROM items WHERE order_id = 1; COMMIT")
+	assert.ErrorContains(t, err, "commits of orders were reverted")
+	assert.Equal(t, [2]int64{before[0] + 2, before[1]}, versions())
+	assert.Equal(t, "1", queryIDs(t, ib, "SELECT id FROM orders"))
+	assert.Equal(t, "REVERT", lastOperation("orders"))
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// primaryKeyColumns lists columns of table's PRIMARY KEY, nil when it has none
+func primaryKeyColumns(dataTx *sql.Tx, table string) ([]string, error) {
+	var keys []any
+	err := dataTx.QueryRow(`
+		SELECT constraint_column_names
+		FROM duckdb_constraints()
+		WHERE table_name = $1 AND constraint_type = 'PRIMARY KEY'`, table).Scan(&keys)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get primary key of %s: %w", table, err)
+	}
+	columns := make([]string, len(keys))
+	for i, key := range keys {
+		columns[i] = fmt.Sprint(key)
+	}
+	return columns, nil
+}
+
+// hasPrimaryKey tells if the table has a PRIMARY KEY as of the latest metaData
+func (l *Log) hasPrimaryKey(logDB *sql.DB) (bool, error) {
+	createQuery, err := l.createTableAt(logDB, latestVersion)
+	if err != nil || createQuery == "" {
+		return false, err
+	}
+	// the log database doesn't have the table, create it for a moment to know its constraints
+	tx, err := logDB.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(createQuery); err != nil {
+		return false, fmt.Errorf("failed to execute schema_log query `%s`: %w", createQuery, err)
+	}
+	keys, err := primaryKeyColumns(tx, l.tableName)
+	return len(keys) > 0, err
+}
+
+// lowered returns names lowercased and sorted, to compare sets of column names
+func lowered(names []string) []string {
+	result := make([]string, len(names))
+	for i, name := range names {
+		result[i] = strings.ToLower(name)
+	}
+	slices.Sort(result)
+	return result
+}
+
+// keyRangePredicates are predicates on keys that hold for every row of table,
+// so files whose stats rule them out can't have rows with the same keys
+func keyRangePredicates(dataTx *sql.Tx, table string, keys []string) ([]statsPredicate, error) {
+	var predicates []statsPredicate
+	for _, key := range keys {
+		var minValue, maxValue sql.NullString
+		query := fmt.Sprintf(`SELECT min("%[1]s")::VARCHAR, max("%[1]s")::VARCHAR FROM %[2]s`, key, table)
+		if err := dataTx.QueryRow(query).Scan(&minValue, &maxValue); err != nil {
+			return nil, fmt.Errorf("failed to get range of %s: %w", key, err)
+		}
+		if !minValue.Valid || !maxValue.Valid {
+			continue
+		}
+		predicates = append(predicates,
+			statsPredicate{Column: key, Op: ">=", Value: quoteSQLString(minValue.String)},
+			statsPredicate{Column: key, Op: "<=", Value: quoteSQLString(maxValue.String)})
+	}
+	return predicates, nil
+}
+
+// keysMatch is a join condition of rows of a and b having the same keys
+func keysMatch(a, b string, keys []string) string {
+	conditions := make([]string, len(keys))
+	for i, key := range keys {
+		conditions[i] = fmt.Sprintf(`%s."%s" = %s."%s"`, a, key, b, key)
+	}
+	return strings.Join(conditions, " AND ")
+}
+
+// resolveConflicts applies conflict to rows of the in-memory table that have the primary key
+// of rows in live files, candidates are picked by stats of the key columns.
+// Rows ignored are deleted from the table. Rows replaced are left out of their files, whose
+// remaining rows are moved into the table and the files removed, so a single add of the table
+// rewrites them. Returns the number of files removed.
+func (l *Log) resolveConflicts(dataTx *sql.Tx, logDB *sql.DB, conflict OnConflict) (int, error) {
+	keys, err := primaryKeyColumns(dataTx, l.tableName)
+	if err != nil || len(keys) == 0 {
+		return 0, err
+	}
+	predicates, err := keyRangePredicates(dataTx, l.tableName, keys)
+	if err != nil || len(predicates) == 0 {
+		// no rows to insert
+		return 0, err
+	}
+	files, err := l.listLiveFilesWithStats(dataTx, predicates)
+	if err != nil {
+		return 0, fmt.Errorf("failed to list files with conflicting keys: %w", err)
+	}
+
+	schema, err := l.currentSchema(dataTx, logDB)
+	if err != nil {
+		return 0, err
+	}
+	removed := 0
+	for _, file := range files {
+		var conflicts int64
+		err := l.WithDuckDBSecret(dataTx, func() error {
+			rowsSQL, err := l.liveRowsSQL(dataTx, file)
+			if err != nil {
+				return err
+			}
+			_, err = dataTx.Exec(fmt.Sprintf("CREATE OR REPLACE TABLE duckpond_file_rows AS %s", schema.rowsSQL(rowsSQL)))
+			if err != nil {
+				return err
+			}
+			return dataTx.QueryRow(fmt.Sprintf(
+				"SELECT count(*) FROM duckpond_file_rows f SEMI JOIN %s t ON %s",
+				l.tableName, keysMatch("f", "t", keys))).Scan(&conflicts)
+		})
+		if err != nil {
+			return 0, fmt.Errorf("failed to look for conflicting keys in %s: %w", file.Path, err)
+		}
+		if conflicts == 0 {
+			continue
+		}
+
+		switch conflict {
+		case ConflictIgnore:
+			_, err = dataTx.Exec(fmt.Sprintf("DELETE FROM %s t USING duckpond_file_rows f WHERE %s",
+				l.tableName, keysMatch("t", "f", keys)))
+			if err != nil {
+				return 0, fmt.Errorf("failed to ignore rows conflicting with %s: %w", file.Path, err)
+			}
+		case ConflictReplace:
+			// OR IGNORE drops duplicates that piled up in files before keys were enforced
+			_, err = dataTx.Exec(fmt.Sprintf(
+				"INSERT OR IGNORE INTO %[1]s BY NAME SELECT * FROM duckpond_file_rows f ANTI JOIN %[1]s t ON %[2]s",
+				l.tableName, keysMatch("f", "t", keys)))
+			if err != nil {
+				return 0, fmt.Errorf("failed to rewrite %s: %w", file.Path, err)
+			}
+			if _, err := logDB.Exec(query_remove_file, file.Path, true, int64(latestVersion)); err != nil {
+				return 0, fmt.Errorf("failed to record 'remove' of %s: %w", file.Path, err)
+			}
+			removed++
+		case ConflictUpdate:
+			return 0, fmt.Errorf("ON CONFLICT DO UPDATE of persisted rows is not supported, use INSERT OR REPLACE")
+		default:
+			return 0, fmt.Errorf("%d rows violate primary key (%s) of %s, they are already in %s",
+				conflicts, strings.Join(keys, ", "), l.tableName, file.Path)
+		}
+	}
+	return removed, nil
+}